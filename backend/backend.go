@@ -0,0 +1,85 @@
+package backend
+
+import (
+	"context"
+	"errors"
+)
+
+var (
+	// ErrNotSupported 后端不支持该操作
+	ErrNotSupported = errors.New("backend: operation not supported")
+	// ErrCompacted 监听的起始版本已被压缩，需要重新加载全量数据
+	ErrCompacted = errors.New("backend: required revision has been compacted")
+)
+
+// LeaseID 租约ID
+type LeaseID int64
+
+// NoLease 不绑定租约
+const NoLease LeaseID = 0
+
+// EventType 事件类型
+type EventType int32
+
+const (
+	// EventPut 写入事件
+	EventPut EventType = 0
+	// EventDelete 删除事件
+	EventDelete EventType = 1
+)
+
+// KeyValue 键值对
+type KeyValue struct {
+	Key         []byte  // 键
+	Value       []byte  // 值
+	Lease       LeaseID // 绑定的租约
+	ModRevision int64   // 最后修改版本
+}
+
+// Event 监听事件
+type Event struct {
+	Type EventType // 事件类型
+	Kv   *KeyValue // 事件对应的键值
+}
+
+// GetResponse 前缀查询结果
+type GetResponse struct {
+	Revision int64       // 查询时的存储版本
+	Kvs      []*KeyValue // 查询结果
+}
+
+// WatchResponse 监听结果
+type WatchResponse struct {
+	Revision        int64    // 本次响应时的存储版本
+	Events          []*Event // 变更事件
+	Canceled        bool     // 监听是否已被取消
+	CompactRevision int64    // 起始版本已被压缩时，当前可监听的最小版本，此时Err为ErrCompacted
+	Err             error    // 监听异常
+}
+
+// Backend 服务注册与服务发现的存储后端
+type Backend interface {
+	// Grant 创建租约，ttl单位为秒
+	Grant(ctx context.Context, ttl int64) (LeaseID, error)
+
+	// KeepAlive 保持租约，租约失效、ctx取消或连接断开时返回的channel会被关闭
+	KeepAlive(ctx context.Context, id LeaseID) (<-chan struct{}, error)
+
+	// Revoke 撤销租约，租约下的所有键值会被删除
+	Revoke(ctx context.Context, id LeaseID) error
+
+	// Put 写入键值，lease为NoLease时不绑定租约
+	Put(ctx context.Context, key, value string, lease LeaseID) error
+
+	// Delete 删除键值
+	Delete(ctx context.Context, key string) error
+
+	// Get 按前缀查询键值
+	Get(ctx context.Context, prefix string) (*GetResponse, error)
+
+	// Watch 按前缀监听键值变化，rev大于0时从该版本开始监听，ctx取消时返回的channel会被关闭
+	Watch(ctx context.Context, prefix string, rev int64) <-chan *WatchResponse
+
+	// Close 关闭后端连接
+	Close() error
+}
@@ -0,0 +1,176 @@
+package consul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// agentCheck 服务注册时附带的TTL检查
+type agentCheck struct {
+	CheckID                        string `json:"CheckID"`
+	TTL                            string `json:"TTL"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter,omitempty"`
+}
+
+// agentWeights 服务权重，consul DNS按Passing权重返回SRV记录
+type agentWeights struct {
+	Passing int `json:"Passing"`
+	Warning int `json:"Warning"`
+}
+
+// agentService 服务注册请求
+type agentService struct {
+	ID      string            `json:"ID"`
+	Name    string            `json:"Name"`
+	Tags    []string          `json:"Tags,omitempty"`
+	Address string            `json:"Address"`
+	Port    int               `json:"Port"`
+	Meta    map[string]string `json:"Meta,omitempty"`
+	Weights *agentWeights     `json:"Weights,omitempty"`
+	Check   *agentCheck       `json:"Check,omitempty"`
+}
+
+// healthEntry /v1/health/service返回的单条记录
+type healthEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		ID      string            `json:"ID"`
+		Service string            `json:"Service"`
+		Address string            `json:"Address"`
+		Port    int               `json:"Port"`
+		Meta    map[string]string `json:"Meta"`
+		Weights *agentWeights     `json:"Weights"`
+	} `json:"Service"`
+}
+
+// statusError consul返回的非200响应
+type statusError struct {
+	code int
+	body string
+}
+
+func (c *statusError) Error() string {
+	return fmt.Sprintf("consul: unexpected status %d: %s", c.code, c.body)
+}
+
+func (c *Backend) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) (uint64, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	u := c.cfg.Address + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	if c.cfg.Token != "" {
+		req.Header.Set("X-Consul-Token", c.cfg.Token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return 0, &statusError{code: resp.StatusCode, body: string(data)}
+	}
+
+	index, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if out != nil {
+		err = json.NewDecoder(resp.Body).Decode(out)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return index, nil
+}
+
+func (c *Backend) register(ctx context.Context, srv *agentService) error {
+	_, err := c.do(ctx, http.MethodPut, "/v1/agent/service/register", nil, srv, nil)
+	return err
+}
+
+func (c *Backend) deregister(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodPut, "/v1/agent/service/deregister/"+url.PathEscape(id), nil, nil, nil)
+	return err
+}
+
+func (c *Backend) passCheck(ctx context.Context, checkID string) error {
+	_, err := c.do(ctx, http.MethodPut, "/v1/agent/check/pass/"+url.PathEscape(checkID), nil, nil, nil)
+	return err
+}
+
+// services 获取所有服务名称
+func (c *Backend) services(ctx context.Context) ([]string, uint64, error) {
+	var ret map[string][]string
+	index, err := c.do(ctx, http.MethodGet, "/v1/catalog/services", nil, nil, &ret)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	names := make([]string, 0, len(ret))
+	for name := range ret {
+		if name == "consul" {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, index, nil
+}
+
+// health 获取服务的健康实例，index大于0时为阻塞查询
+func (c *Backend) health(ctx context.Context, name string, index uint64) ([]*healthEntry, uint64, error) {
+	query := url.Values{}
+	query.Set("passing", "1")
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", formatDuration(c.cfg.WaitTime))
+	}
+
+	var ret []*healthEntry
+	idx, err := c.do(ctx, http.MethodGet, "/v1/health/service/"+url.PathEscape(name), query, nil, &ret)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ret, idx, nil
+}
+
+// waitState 阻塞等待任意健康检查状态变化，用于监听全部服务
+func (c *Backend) waitState(ctx context.Context, index uint64) (uint64, error) {
+	query := url.Values{}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", formatDuration(c.cfg.WaitTime))
+	}
+	return c.do(ctx, http.MethodGet, "/v1/health/state/any", query, nil, nil)
+}
+
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return strconv.FormatInt(int64(d/time.Millisecond), 10) + "ms"
+	}
+	return strconv.FormatInt(int64(d/time.Second), 10) + "s"
+}
@@ -0,0 +1,556 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuanzhangcai/srsd/backend"
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+var (
+	defaultAddress         = "http://127.0.0.1:8500"
+	defaultPrefix          = "/srsd/services/"
+	defaultWaitTime        = 30 * time.Second
+	defaultDeregisterAfter = time.Minute
+	defaultRetryInterval   = time.Second
+
+	// ErrClosed 后端已关闭
+	ErrClosed = errors.New("consul: backend closed")
+	// ErrLeaseNotFound 租约不存在或已失效
+	ErrLeaseNotFound = errors.New("consul: lease not found")
+	// ErrInvalidKey key格式不是 前缀+服务名/服务ID
+	ErrInvalidKey = errors.New("consul: invalid service key")
+)
+
+// 保存service.Service中无法直接映射到consul服务字段的信息
+const (
+	metaVersion    = "srsd_version"
+	metaPProf      = "srsd_pprof"
+	metaMetrics    = "srsd_metrics"
+	metaCreateTime = "srsd_create_time"
+	metaStatus     = "srsd_status"
+	serviceTag     = "srsd"
+	checkPrefix    = "srsd:"
+)
+
+// Config consul连接参数
+type Config struct {
+	Address         string        // consul agent地址
+	Token           string        // consul ACL token
+	Prefix          string        // 服务注册前缀，需与registry、discovery的Prefix一致
+	WaitTime        time.Duration // 阻塞查询最长等待时间
+	DeregisterAfter time.Duration // TTL检查失败多久后由consul自动注销服务
+}
+
+// Backend 基于consul catalog的存储后端，租约由服务的TTL检查模拟，监听由阻塞查询实现
+type Backend struct {
+	cfg    Config
+	client *http.Client
+	done   chan struct{}
+
+	m         sync.Mutex
+	nextLease backend.LeaseID
+	leases    map[backend.LeaseID]*lease
+	closed    bool
+}
+
+type lease struct {
+	ttl    time.Duration
+	checks map[string]string // 服务ID -> 检查ID
+	keeper []chan struct{}
+}
+
+// NewBackend 创建consul存储后端
+func NewBackend(cfg Config) (*Backend, error) {
+	if cfg.Address == "" {
+		cfg.Address = defaultAddress
+	}
+	if !strings.Contains(cfg.Address, "://") {
+		cfg.Address = "http://" + cfg.Address
+	}
+	cfg.Address = strings.TrimRight(cfg.Address, "/")
+
+	if cfg.Prefix == "" {
+		cfg.Prefix = defaultPrefix
+	}
+	if cfg.Prefix[len(cfg.Prefix)-1] != '/' {
+		cfg.Prefix += "/"
+	}
+
+	if cfg.WaitTime <= 0 {
+		cfg.WaitTime = defaultWaitTime
+	}
+
+	if cfg.DeregisterAfter <= 0 {
+		cfg.DeregisterAfter = defaultDeregisterAfter
+	}
+
+	return &Backend{
+		cfg:    cfg,
+		client: &http.Client{},
+		done:   make(chan struct{}),
+		leases: make(map[backend.LeaseID]*lease),
+	}, nil
+}
+
+// Grant 创建租约，租约在写入服务时转换为对应服务的TTL检查
+func (c *Backend) Grant(ctx context.Context, ttl int64) (backend.LeaseID, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return backend.NoLease, ErrClosed
+	}
+
+	c.nextLease++
+	c.leases[c.nextLease] = &lease{
+		ttl:    time.Duration(ttl) * time.Second,
+		checks: make(map[string]string),
+	}
+	return c.nextLease, nil
+}
+
+// KeepAlive 定时将租约下所有服务的TTL检查置为passing
+func (c *Backend) KeepAlive(ctx context.Context, id backend.LeaseID) (<-chan struct{}, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	l, ok := c.leases[id]
+	if !ok {
+		return nil, ErrLeaseNotFound
+	}
+
+	done := make(chan struct{})
+	l.keeper = append(l.keeper, done)
+
+	interval := l.ttl / 3
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		last := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case <-c.done:
+				c.stopKeeper(id, done)
+				return
+			case <-ctx.Done():
+				c.stopKeeper(id, done)
+				return
+			case <-ticker.C:
+			}
+
+			err := c.passLease(ctx, id)
+			if err == nil {
+				last = time.Now()
+				continue
+			}
+
+			// 检查已不存在或长时间无法续约，视为租约过期
+			var sErr *statusError
+			if errors.As(err, &sErr) || time.Since(last) > l.ttl {
+				c.expireLease(id)
+				return
+			}
+		}
+	}()
+	return done, nil
+}
+
+func (c *Backend) passLease(ctx context.Context, id backend.LeaseID) error {
+	c.m.Lock()
+	l, ok := c.leases[id]
+	if !ok {
+		c.m.Unlock()
+		return ErrLeaseNotFound
+	}
+	checks := make([]string, 0, len(l.checks))
+	for _, one := range l.checks {
+		checks = append(checks, one)
+	}
+	c.m.Unlock()
+
+	for _, one := range checks {
+		err := c.passCheck(ctx, one)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Backend) stopKeeper(id backend.LeaseID, done chan struct{}) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	l, ok := c.leases[id]
+	if !ok {
+		return
+	}
+
+	for i, one := range l.keeper {
+		if one == done {
+			l.keeper = append(l.keeper[:i], l.keeper[i+1:]...)
+			close(done)
+			return
+		}
+	}
+}
+
+func (c *Backend) expireLease(id backend.LeaseID) *lease {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	l, ok := c.leases[id]
+	if !ok {
+		return nil
+	}
+
+	delete(c.leases, id)
+	for _, one := range l.keeper {
+		close(one)
+	}
+	l.keeper = nil
+	return l
+}
+
+// Revoke 撤销租约，注销租约下的所有服务
+func (c *Backend) Revoke(ctx context.Context, id backend.LeaseID) error {
+	l := c.expireLease(id)
+	if l == nil {
+		return ErrLeaseNotFound
+	}
+
+	for srvID := range l.checks {
+		err := c.deregister(ctx, srvID)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put 将service.Service的JSON注册为consul服务
+func (c *Backend) Put(ctx context.Context, key, value string, id backend.LeaseID) error {
+	name, srvID, err := c.parseKey(key)
+	if err != nil {
+		return err
+	}
+
+	srv := &service.Service{}
+	err = json.Unmarshal([]byte(value), srv)
+	if err != nil {
+		return err
+	}
+
+	reg, err := toAgentService(name, srvID, srv)
+	if err != nil {
+		return err
+	}
+
+	c.m.Lock()
+	if c.closed {
+		c.m.Unlock()
+		return ErrClosed
+	}
+
+	var l *lease
+	if id != backend.NoLease {
+		var ok bool
+		l, ok = c.leases[id]
+		if !ok {
+			c.m.Unlock()
+			return ErrLeaseNotFound
+		}
+		reg.Check = &agentCheck{
+			CheckID:                        checkPrefix + srvID,
+			TTL:                            formatDuration(l.ttl),
+			DeregisterCriticalServiceAfter: formatDuration(c.cfg.DeregisterAfter),
+		}
+	}
+
+	for leaseID, one := range c.leases {
+		if leaseID != id {
+			delete(one.checks, srvID)
+		}
+	}
+	if l != nil {
+		l.checks[srvID] = reg.Check.CheckID
+	}
+	c.m.Unlock()
+
+	err = c.register(ctx, reg)
+	if err != nil {
+		return err
+	}
+
+	// TTL检查注册后默认为critical，需立即置为passing
+	if reg.Check != nil {
+		return c.passCheck(ctx, reg.Check.CheckID)
+	}
+	return nil
+}
+
+// Delete 注销key对应的consul服务
+func (c *Backend) Delete(ctx context.Context, key string) error {
+	_, srvID, err := c.parseKey(key)
+	if err != nil {
+		return err
+	}
+
+	c.m.Lock()
+	if c.closed {
+		c.m.Unlock()
+		return ErrClosed
+	}
+	for _, one := range c.leases {
+		delete(one.checks, srvID)
+	}
+	c.m.Unlock()
+
+	err = c.deregister(ctx, srvID)
+	if err != nil && !isNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// Get 查询前缀对应服务的所有健康实例，Revision为consul的X-Consul-Index
+func (c *Backend) Get(ctx context.Context, prefix string) (*backend.GetResponse, error) {
+	if c.isClosed() {
+		return nil, ErrClosed
+	}
+
+	kvs, index, err := c.fetch(ctx, c.parseName(prefix), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &backend.GetResponse{Revision: int64(index)}
+	for _, kv := range kvs {
+		resp.Kvs = append(resp.Kvs, kv)
+	}
+	sortKvs(resp.Kvs)
+	return resp, nil
+}
+
+// Watch 通过阻塞查询监听服务实例变化，与上一次结果对比后生成PUT/DELETE事件。
+// 监听基准在返回前同步获取，rev大于0且基准已晚于rev时，基准中的实例会先以PUT事件推送
+func (c *Backend) Watch(ctx context.Context, prefix string, rev int64) <-chan *backend.WatchResponse {
+	name := c.parseName(prefix)
+
+	// 阻塞查询在有变化或超时时返回，查询之间不需要等待
+	var index uint64
+	next := func(ctx context.Context) bool {
+		return ctx.Err() == nil
+	}
+	p := &backend.Poller{
+		Load: func(ctx context.Context) (map[string]*backend.KeyValue, int64, func(ctx context.Context) bool, error) {
+			kvs, idx, err := c.fetch(ctx, name, index)
+			if err != nil {
+				return nil, 0, nil, err
+			}
+
+			// index回退时需重新开始阻塞查询
+			if idx < index {
+				idx = 0
+			}
+			index = idx
+			return kvs, int64(index), next, nil
+		},
+		Retry: defaultRetryInterval,
+		Done:  c.done,
+	}
+	return p.Watch(ctx, rev)
+}
+
+// Close 关闭后端，结束所有租约保持与监听，已注册的服务由TTL检查自动失效
+func (c *Backend) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	return nil
+}
+
+func (c *Backend) isClosed() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.closed
+}
+
+// fetch 查询服务实例，name为空时查询所有服务，index大于0时阻塞等待变化
+func (c *Backend) fetch(ctx context.Context, name string, index uint64) (map[string]*backend.KeyValue, uint64, error) {
+	if name != "" {
+		entries, idx, err := c.health(ctx, name, index)
+		if err != nil {
+			return nil, 0, err
+		}
+		return c.toKvs(entries, idx)
+	}
+
+	idx, err := c.waitState(ctx, index)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	names, _, err := c.services(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ret := make(map[string]*backend.KeyValue)
+	for _, one := range names {
+		entries, _, err := c.health(ctx, one, 0)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		kvs, _, err := c.toKvs(entries, idx)
+		if err != nil {
+			return nil, 0, err
+		}
+		for key, kv := range kvs {
+			ret[key] = kv
+		}
+	}
+	return ret, idx, nil
+}
+
+func (c *Backend) toKvs(entries []*healthEntry, index uint64) (map[string]*backend.KeyValue, uint64, error) {
+	ret := make(map[string]*backend.KeyValue, len(entries))
+	for _, one := range entries {
+		srv := fromHealthEntry(one)
+		val, err := json.Marshal(srv)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		key := c.cfg.Prefix + srv.Name + "/" + srv.ID
+		ret[key] = &backend.KeyValue{
+			Key:         []byte(key),
+			Value:       val,
+			ModRevision: int64(index),
+		}
+	}
+	return ret, index, nil
+}
+
+func (c *Backend) parseName(prefix string) string {
+	name := strings.TrimPrefix(prefix, c.cfg.Prefix)
+	return strings.TrimRight(name, "/")
+}
+
+func (c *Backend) parseKey(key string) (string, string, error) {
+	key = strings.TrimPrefix(key, c.cfg.Prefix)
+	index := strings.LastIndex(key, "/")
+	if index <= 0 || index == len(key)-1 {
+		return "", "", ErrInvalidKey
+	}
+	return key[:index], key[index+1:], nil
+}
+
+func toAgentService(name, id string, srv *service.Service) (*agentService, error) {
+	ret := &agentService{
+		ID:   id,
+		Name: name,
+		Tags: []string{serviceTag},
+		Meta: make(map[string]string),
+	}
+
+	if srv.Host != "" {
+		host, port, err := net.SplitHostPort(srv.Host)
+		if err != nil {
+			return nil, err
+		}
+		ret.Address = host
+		ret.Port, err = strconv.Atoi(port)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for k, v := range srv.Metadata {
+		ret.Meta[k] = v
+	}
+	ret.Meta[metaVersion] = srv.Version
+	ret.Meta[metaPProf] = srv.PProf
+	ret.Meta[metaMetrics] = srv.Metrics
+	ret.Meta[metaCreateTime] = srv.CreateTime
+	ret.Meta[metaStatus] = srv.Status
+	if srv.Weight > 0 {
+		ret.Weights = &agentWeights{Passing: srv.Weight, Warning: srv.Weight}
+	}
+	return ret, nil
+}
+
+func fromHealthEntry(entry *healthEntry) *service.Service {
+	srv := &service.Service{
+		ID:       entry.Service.ID,
+		Name:     entry.Service.Service,
+		Metadata: make(map[string]string),
+	}
+
+	address := entry.Service.Address
+	if address == "" {
+		address = entry.Node.Address
+	}
+	if address != "" || entry.Service.Port > 0 {
+		srv.Host = net.JoinHostPort(address, strconv.Itoa(entry.Service.Port))
+	}
+
+	if entry.Service.Weights != nil {
+		srv.Weight = entry.Service.Weights.Passing
+	}
+
+	for k, v := range entry.Service.Meta {
+		switch k {
+		case metaVersion:
+			srv.Version = v
+		case metaPProf:
+			srv.PProf = v
+		case metaMetrics:
+			srv.Metrics = v
+		case metaCreateTime:
+			srv.CreateTime = v
+		case metaStatus:
+			srv.Status = v
+		default:
+			srv.Metadata[k] = v
+		}
+	}
+	return srv
+}
+
+func sortKvs(kvs []*backend.KeyValue) {
+	sort.Slice(kvs, func(i, j int) bool {
+		return string(kvs[i].Key) < string(kvs[j].Key)
+	})
+}
+
+func isNotFound(err error) bool {
+	var sErr *statusError
+	return errors.As(err, &sErr) && sErr.code == http.StatusNotFound
+}
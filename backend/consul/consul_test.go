@@ -0,0 +1,196 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuanzhangcai/srsd/backend"
+	"github.com/yuanzhangcai/srsd/discovery"
+	"github.com/yuanzhangcai/srsd/registry"
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+func newTestBackend(t *testing.T, f *fakeConsul) *Backend {
+	b, err := NewBackend(Config{Address: f.URL, WaitTime: 200 * time.Millisecond})
+	assert.Nil(t, err)
+	return b
+}
+
+func newTestValue(name, id, host string) string {
+	srv := service.NewService()
+	srv.ID = id
+	srv.Name = name
+	srv.Host = host
+	srv.Version = "v1"
+	srv.Metadata["zone"] = "sh"
+	val, _ := json.Marshal(srv)
+	return string(val)
+}
+
+func TestNewBackend(t *testing.T) {
+	b, err := NewBackend(Config{Address: "127.0.0.1:8500", Prefix: "/zacyuan/test"})
+	assert.Nil(t, err)
+	assert.Equal(t, "http://127.0.0.1:8500", b.cfg.Address)
+	assert.Equal(t, "/zacyuan/test/", b.cfg.Prefix)
+	assert.Equal(t, defaultWaitTime, b.cfg.WaitTime)
+}
+
+func TestPutGetDelete(t *testing.T) {
+	f := newFakeConsul()
+	defer f.Close()
+	b := newTestBackend(t, f)
+	defer b.Close()
+	ctx := context.Background()
+
+	err := b.Put(ctx, "/srsd/services/zacyuan.com", newTestValue("zacyuan.com", "1", "127.0.0.1:4001"), backend.NoLease)
+	assert.Equal(t, ErrInvalidKey, err)
+
+	err = b.Put(ctx, "/srsd/services/zacyuan.com/1", newTestValue("zacyuan.com", "1", "127.0.0.1:4001"), backend.NoLease)
+	assert.Nil(t, err)
+	err = b.Put(ctx, "/srsd/services/zacyuan.com/2", newTestValue("zacyuan.com", "2", "127.0.0.1:4002"), backend.NoLease)
+	assert.Nil(t, err)
+	err = b.Put(ctx, "/srsd/services/other.com/3", newTestValue("other.com", "3", "127.0.0.1:4003"), backend.NoLease)
+	assert.Nil(t, err)
+
+	resp, err := b.Get(ctx, "/srsd/services/zacyuan.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(resp.Kvs))
+	assert.Less(t, int64(0), resp.Revision)
+	assert.Equal(t, "/srsd/services/zacyuan.com/1", string(resp.Kvs[0].Key))
+
+	srv := &service.Service{}
+	assert.Nil(t, json.Unmarshal(resp.Kvs[0].Value, srv))
+	assert.Equal(t, "1", srv.ID)
+	assert.Equal(t, "zacyuan.com", srv.Name)
+	assert.Equal(t, "127.0.0.1:4001", srv.Host)
+	assert.Equal(t, "v1", srv.Version)
+	assert.Equal(t, service.StatusUp, srv.Status)
+	assert.Equal(t, 1, srv.Weight)
+	assert.Equal(t, map[string]string{"zone": "sh"}, srv.Metadata)
+
+	// 实例状态保存在Meta中，权重保存在Weights中
+	draining := service.NewService()
+	draining.ID = "1"
+	draining.Name = "zacyuan.com"
+	draining.Host = "127.0.0.1:4001"
+	draining.Status = service.StatusDraining
+	draining.Weight = 5
+	val, _ := json.Marshal(draining)
+	assert.Nil(t, b.Put(ctx, "/srsd/services/zacyuan.com/1", string(val), backend.NoLease))
+	resp, err = b.Get(ctx, "/srsd/services/zacyuan.com")
+	assert.Nil(t, err)
+	srv = &service.Service{}
+	assert.Nil(t, json.Unmarshal(resp.Kvs[0].Value, srv))
+	assert.Equal(t, service.StatusDraining, srv.Status)
+	assert.False(t, srv.IsUp())
+	assert.Equal(t, 5, srv.Weight)
+
+	resp, err = b.Get(ctx, "/srsd/services/")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(resp.Kvs))
+
+	assert.Nil(t, b.Delete(ctx, "/srsd/services/zacyuan.com/1"))
+	assert.Nil(t, b.Delete(ctx, "/srsd/services/zacyuan.com/1"))
+	resp, err = b.Get(ctx, "/srsd/services/zacyuan.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(resp.Kvs))
+}
+
+func TestLease(t *testing.T) {
+	f := newFakeConsul()
+	defer f.Close()
+	b := newTestBackend(t, f)
+	defer b.Close()
+	ctx := context.Background()
+
+	id, err := b.Grant(ctx, 1)
+	assert.Nil(t, err)
+	err = b.Put(ctx, "/srsd/services/zacyuan.com/1", newTestValue("zacyuan.com", "1", "127.0.0.1:4001"), id)
+	assert.Nil(t, err)
+
+	ch, err := b.KeepAlive(ctx, id)
+	assert.Nil(t, err)
+	time.Sleep(1500 * time.Millisecond)
+	resp, err := b.Get(ctx, "/srsd/services/zacyuan.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(resp.Kvs))
+
+	// consul中的检查丢失后，KeepAlive返回的channel被关闭
+	f.expire("1")
+	select {
+	case _, ok := <-ch:
+		assert.False(t, ok)
+	case <-time.After(2 * time.Second):
+		t.Fatal("keepalive channel not closed")
+	}
+
+	id, err = b.Grant(ctx, 10)
+	assert.Nil(t, err)
+	err = b.Put(ctx, "/srsd/services/zacyuan.com/2", newTestValue("zacyuan.com", "2", "127.0.0.1:4002"), id)
+	assert.Nil(t, err)
+	assert.Nil(t, b.Revoke(ctx, id))
+	assert.Equal(t, ErrLeaseNotFound, b.Revoke(ctx, id))
+	assert.Equal(t, 1, f.count())
+}
+
+func TestWatch(t *testing.T) {
+	f := newFakeConsul()
+	defer f.Close()
+	b := newTestBackend(t, f)
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := b.Watch(ctx, "/srsd/services/zacyuan.com", 0)
+	time.Sleep(100 * time.Millisecond)
+
+	err := b.Put(ctx, "/srsd/services/zacyuan.com/1", newTestValue("zacyuan.com", "1", "127.0.0.1:4001"), backend.NoLease)
+	assert.Nil(t, err)
+	resp := <-ch
+	assert.Equal(t, 1, len(resp.Events))
+	assert.Equal(t, backend.EventPut, resp.Events[0].Type)
+	assert.Equal(t, "/srsd/services/zacyuan.com/1", string(resp.Events[0].Kv.Key))
+
+	assert.Nil(t, b.Delete(ctx, "/srsd/services/zacyuan.com/1"))
+	resp = <-ch
+	assert.Equal(t, 1, len(resp.Events))
+	assert.Equal(t, backend.EventDelete, resp.Events[0].Type)
+
+	cancel()
+	for range ch {
+	}
+}
+
+func TestRegistryDiscovery(t *testing.T) {
+	f := newFakeConsul()
+	defer f.Close()
+	b := newTestBackend(t, f)
+	defer b.Close()
+
+	dis := discovery.NewDiscovery(discovery.Backend(b))
+	err := dis.Start("")
+	assert.Nil(t, err)
+
+	info := service.NewService()
+	info.Name = "zacyuan.com"
+	info.Host = "127.0.0.1:4001"
+	reg := registry.NewRegistry(info, registry.Backend(b), registry.TTL(2*time.Second))
+	err = reg.Start()
+	assert.Nil(t, err)
+
+	time.Sleep(500 * time.Millisecond)
+	srv := dis.Select("zacyuan.com")
+	assert.NotNil(t, srv)
+	assert.Equal(t, info.ID, srv.ID)
+	assert.Equal(t, "127.0.0.1:4001", srv.Host)
+	assert.Equal(t, 1, len(dis.GetAll("")))
+
+	err = reg.Stop()
+	assert.Nil(t, err)
+	time.Sleep(500 * time.Millisecond)
+	assert.Nil(t, dis.Select("zacyuan.com"))
+	_ = dis.Stop()
+}
@@ -0,0 +1,232 @@
+package consul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fakeConsul 模拟consul agent的部分HTTP接口，支持TTL检查与阻塞查询
+type fakeConsul struct {
+	*httptest.Server
+
+	m        sync.Mutex
+	index    uint64
+	changed  chan struct{}
+	services map[string]*fakeService
+	stop     chan struct{}
+}
+
+type fakeService struct {
+	srv      *agentService
+	ttl      time.Duration
+	passing  bool
+	lastPass time.Time
+}
+
+func newFakeConsul() *fakeConsul {
+	f := &fakeConsul{
+		index:    1,
+		changed:  make(chan struct{}),
+		services: make(map[string]*fakeService),
+		stop:     make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/agent/service/register", f.handleRegister)
+	mux.HandleFunc("/v1/agent/service/deregister/", f.handleDeregister)
+	mux.HandleFunc("/v1/agent/check/pass/", f.handlePass)
+	mux.HandleFunc("/v1/catalog/services", f.handleServices)
+	mux.HandleFunc("/v1/health/service/", f.handleHealth)
+	mux.HandleFunc("/v1/health/state/any", f.handleState)
+	f.Server = httptest.NewServer(mux)
+
+	go f.reap()
+	return f
+}
+
+func (f *fakeConsul) Close() {
+	close(f.stop)
+	f.Server.Close()
+}
+
+// bump 数据变化，index加一并唤醒阻塞查询，调用方需持有锁
+func (f *fakeConsul) bump() {
+	f.index++
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// reap 将超过TTL未续约的检查置为critical
+func (f *fakeConsul) reap() {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		}
+
+		f.m.Lock()
+		for _, one := range f.services {
+			if one.ttl > 0 && one.passing && time.Since(one.lastPass) > one.ttl {
+				one.passing = false
+				f.bump()
+			}
+		}
+		f.m.Unlock()
+	}
+}
+
+// expire 立即让服务的TTL检查失败
+func (f *fakeConsul) expire(id string) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if one, ok := f.services[id]; ok {
+		one.passing = false
+		one.ttl = 0
+		f.bump()
+	}
+}
+
+func (f *fakeConsul) count() int {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return len(f.services)
+}
+
+func (f *fakeConsul) handleRegister(w http.ResponseWriter, r *http.Request) {
+	srv := &agentService{}
+	err := json.NewDecoder(r.Body).Decode(srv)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	one := &fakeService{srv: srv, passing: true, lastPass: time.Now()}
+	if srv.Check != nil {
+		one.ttl, _ = time.ParseDuration(srv.Check.TTL)
+		one.passing = false
+	}
+
+	f.m.Lock()
+	f.services[srv.ID] = one
+	f.bump()
+	f.m.Unlock()
+}
+
+func (f *fakeConsul) handleDeregister(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+
+	f.m.Lock()
+	defer f.m.Unlock()
+	if _, ok := f.services[id]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	delete(f.services, id)
+	f.bump()
+}
+
+func (f *fakeConsul) handlePass(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/v1/agent/check/pass/")
+
+	f.m.Lock()
+	defer f.m.Unlock()
+	for _, one := range f.services {
+		if one.srv.Check != nil && one.srv.Check.CheckID == id && one.ttl > 0 {
+			one.lastPass = time.Now()
+			if !one.passing {
+				one.passing = true
+				f.bump()
+			}
+			return
+		}
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+func (f *fakeConsul) handleServices(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	ret := map[string][]string{"consul": {}}
+	for _, one := range f.services {
+		ret[one.srv.Name] = one.srv.Tags
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	_ = json.NewEncoder(w).Encode(ret)
+}
+
+func (f *fakeConsul) handleHealth(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/v1/health/service/")
+	f.wait(r)
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	ret := []*healthEntry{}
+	for _, one := range f.services {
+		if one.srv.Name != name || !one.passing {
+			continue
+		}
+		entry := &healthEntry{}
+		entry.Node.Address = "127.0.0.1"
+		entry.Service.ID = one.srv.ID
+		entry.Service.Service = one.srv.Name
+		entry.Service.Address = one.srv.Address
+		entry.Service.Port = one.srv.Port
+		entry.Service.Meta = one.srv.Meta
+		entry.Service.Weights = one.srv.Weights
+		ret = append(ret, entry)
+	}
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	_ = json.NewEncoder(w).Encode(ret)
+}
+
+func (f *fakeConsul) handleState(w http.ResponseWriter, r *http.Request) {
+	f.wait(r)
+
+	f.m.Lock()
+	defer f.m.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(f.index, 10))
+	_, _ = w.Write([]byte("[]"))
+}
+
+// wait 阻塞查询，直到index大于请求的index或超过wait时间
+func (f *fakeConsul) wait(r *http.Request) {
+	index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+	if index == 0 {
+		return
+	}
+
+	wait, err := time.ParseDuration(r.URL.Query().Get("wait"))
+	if err != nil {
+		wait = 5 * time.Minute
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for {
+		f.m.Lock()
+		if f.index > index {
+			f.m.Unlock()
+			return
+		}
+		ch := f.changed
+		f.m.Unlock()
+
+		select {
+		case <-ch:
+		case <-timer.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
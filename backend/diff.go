@@ -0,0 +1,32 @@
+package backend
+
+import "sort"
+
+// Diff 对比两次查询结果，生成DELETE与PUT事件，供不支持原生监听的后端使用。
+// 删除事件在前，同类事件按key排序
+func Diff(last, now map[string]*KeyValue) []*Event {
+	var events []*Event
+	for key, kv := range last {
+		if _, ok := now[key]; !ok {
+			events = append(events, &Event{
+				Type: EventDelete,
+				Kv:   &KeyValue{Key: kv.Key},
+			})
+		}
+	}
+
+	for key, kv := range now {
+		if old, ok := last[key]; ok && string(old.Value) == string(kv.Value) {
+			continue
+		}
+		events = append(events, &Event{Type: EventPut, Kv: kv})
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Type != events[j].Type {
+			return events[i].Type > events[j].Type
+		}
+		return string(events[i].Kv.Key) < string(events[j].Kv.Key)
+	})
+	return events
+}
@@ -0,0 +1,31 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiff(t *testing.T) {
+	last := map[string]*KeyValue{
+		"/a/1": {Key: []byte("/a/1"), Value: []byte("1")},
+		"/a/2": {Key: []byte("/a/2"), Value: []byte("2")},
+		"/a/3": {Key: []byte("/a/3"), Value: []byte("3")},
+	}
+	now := map[string]*KeyValue{
+		"/a/2": {Key: []byte("/a/2"), Value: []byte("2")},
+		"/a/3": {Key: []byte("/a/3"), Value: []byte("33")},
+		"/a/4": {Key: []byte("/a/4"), Value: []byte("4")},
+	}
+
+	events := Diff(last, now)
+	assert.Equal(t, 3, len(events))
+	assert.Equal(t, EventDelete, events[0].Type)
+	assert.Equal(t, "/a/1", string(events[0].Kv.Key))
+	assert.Equal(t, EventPut, events[1].Type)
+	assert.Equal(t, "/a/3", string(events[1].Kv.Key))
+	assert.Equal(t, EventPut, events[2].Type)
+	assert.Equal(t, "/a/4", string(events[2].Kv.Key))
+
+	assert.Equal(t, 0, len(Diff(now, now)))
+}
@@ -0,0 +1,156 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// errNameNotFound 域名不存在(NXDOMAIN)
+var errNameNotFound = errors.New("dns: name not found")
+
+// exchange 向DNS服务器发送查询，返回应答与附加记录；UDP应答被截断时改用TCP重试
+func (c *Backend) exchange(ctx context.Context, name string, qtype dnsmessage.Type) (*dnsmessage.Message, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+
+	qname, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	id := uint16(rand.Int())
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	err = b.StartQuestions()
+	if err != nil {
+		return nil, err
+	}
+	err = b.Question(dnsmessage.Question{Name: qname, Type: qtype, Class: dnsmessage.ClassINET})
+	if err != nil {
+		return nil, err
+	}
+	req, err := b.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, server := range c.cfg.Servers {
+		msg, err := c.exchangeUDP(ctx, server, req, id)
+		if err == nil && msg.Truncated {
+			msg, err = c.exchangeTCP(ctx, server, req, id)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		switch msg.RCode {
+		case dnsmessage.RCodeSuccess:
+			return msg, nil
+		case dnsmessage.RCodeNameError:
+			return nil, errNameNotFound
+		default:
+			lastErr = errors.New("dns: server " + server + " returned " + msg.RCode.String())
+		}
+	}
+	return nil, lastErr
+}
+
+func (c *Backend) exchangeUDP(ctx context.Context, server string, req []byte, id uint16) (*dnsmessage.Message, error) {
+	conn, err := c.dial(ctx, "udp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(req)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		msg := &dnsmessage.Message{}
+		err = msg.Unpack(buf[:n])
+		if err != nil || msg.ID != id || !msg.Response {
+			continue // 丢弃不匹配的应答
+		}
+		return msg, nil
+	}
+}
+
+func (c *Backend) exchangeTCP(ctx context.Context, server string, req []byte, id uint16) (*dnsmessage.Message, error) {
+	conn, err := c.dial(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	data := make([]byte, 2+len(req))
+	binary.BigEndian.PutUint16(data, uint16(len(req)))
+	copy(data[2:], req)
+	_, err = conn.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var length uint16
+	err = binary.Read(conn, binary.BigEndian, &length)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := ioutil.ReadAll(io.LimitReader(conn, int64(length)))
+	if err != nil {
+		return nil, err
+	}
+
+	msg := &dnsmessage.Message{}
+	err = msg.Unpack(resp)
+	if err != nil {
+		return nil, err
+	}
+	if msg.ID != id {
+		return nil, errors.New("dns: response id mismatch")
+	}
+	return msg, nil
+}
+
+func (c *Backend) dial(ctx context.Context, network, server string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.cfg.Timeout)
+	d := net.Dialer{}
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	return &ctxConn{Conn: conn, cancel: cancel}, nil
+}
+
+// ctxConn 关闭连接时释放超时context
+type ctxConn struct {
+	net.Conn
+	cancel context.CancelFunc
+}
+
+func (c *ctxConn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
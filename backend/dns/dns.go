@@ -0,0 +1,356 @@
+package dns
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yuanzhangcai/srsd/backend"
+	"github.com/yuanzhangcai/srsd/service"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var (
+	defaultServers     = []string{"127.0.0.1:53"}
+	defaultPrefix      = "/srsd/services/"
+	defaultProto       = "tcp"
+	defaultMinInterval = time.Second
+	defaultMaxInterval = 30 * time.Second
+	defaultTimeout     = 2 * time.Second
+	defaultResolvConf  = "/etc/resolv.conf"
+)
+
+// SRV记录中的优先级与权重保存在Metadata中，权重同时写入Weight，供选择器使用。
+// 按RFC 2782只返回优先级数值最小的一组实例
+const (
+	MetaPriority = "priority"
+	MetaWeight   = "weight"
+	MetaTarget   = "target"
+)
+
+// Config DNS服务发现参数
+type Config struct {
+	Servers     []string      // DNS服务器地址，为空时读取/etc/resolv.conf
+	Prefix      string        // 服务注册前缀，需与discovery的Prefix一致
+	Names       []string      // 服务名列表，discovery.Start("")时解析这些服务
+	Service     string        // SRV服务标识，不为空时查询 _Service._Proto.服务名
+	Proto       string        // SRV协议，默认为tcp
+	Port        int           // 没有SRV记录时按A/AAAA记录解析，并使用该端口
+	MinInterval time.Duration // 最小轮询间隔
+	MaxInterval time.Duration // 最大轮询间隔
+	Timeout     time.Duration // 单次查询超时时间
+}
+
+// Backend 基于DNS SRV/A记录的只读服务发现后端，按记录TTL定时轮询，应答变化时生成PUT/DELETE事件
+type Backend struct {
+	cfg  Config
+	done chan struct{}
+}
+
+// NewBackend 创建DNS服务发现后端
+func NewBackend(cfg Config) (*Backend, error) {
+	if len(cfg.Servers) == 0 {
+		cfg.Servers = readResolvConf(defaultResolvConf)
+	}
+
+	servers := make([]string, 0, len(cfg.Servers))
+	for _, one := range cfg.Servers {
+		if _, _, err := net.SplitHostPort(one); err != nil {
+			one = net.JoinHostPort(one, "53")
+		}
+		servers = append(servers, one)
+	}
+	cfg.Servers = servers
+
+	if cfg.Prefix == "" {
+		cfg.Prefix = defaultPrefix
+	}
+	if cfg.Prefix[len(cfg.Prefix)-1] != '/' {
+		cfg.Prefix += "/"
+	}
+
+	if cfg.Proto == "" {
+		cfg.Proto = defaultProto
+	}
+
+	if cfg.MinInterval <= 0 {
+		cfg.MinInterval = defaultMinInterval
+	}
+
+	if cfg.MaxInterval < cfg.MinInterval {
+		cfg.MaxInterval = defaultMaxInterval
+		if cfg.MaxInterval < cfg.MinInterval {
+			cfg.MaxInterval = cfg.MinInterval
+		}
+	}
+
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
+	return &Backend{
+		cfg:  cfg,
+		done: make(chan struct{}),
+	}, nil
+}
+
+// Grant DNS后端不支持服务注册
+func (c *Backend) Grant(ctx context.Context, ttl int64) (backend.LeaseID, error) {
+	return backend.NoLease, backend.ErrNotSupported
+}
+
+// KeepAlive DNS后端不支持服务注册
+func (c *Backend) KeepAlive(ctx context.Context, id backend.LeaseID) (<-chan struct{}, error) {
+	return nil, backend.ErrNotSupported
+}
+
+// Revoke DNS后端不支持服务注册
+func (c *Backend) Revoke(ctx context.Context, id backend.LeaseID) error {
+	return backend.ErrNotSupported
+}
+
+// Put DNS后端不支持服务注册
+func (c *Backend) Put(ctx context.Context, key, value string, lease backend.LeaseID) error {
+	return backend.ErrNotSupported
+}
+
+// Delete DNS后端不支持服务注册
+func (c *Backend) Delete(ctx context.Context, key string) error {
+	return backend.ErrNotSupported
+}
+
+// Get 解析前缀对应服务的DNS记录，前缀不含服务名时解析Config.Names中的所有服务
+func (c *Backend) Get(ctx context.Context, prefix string) (*backend.GetResponse, error) {
+	kvs, _, err := c.resolveAll(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &backend.GetResponse{Revision: time.Now().UnixNano()}
+	for _, kv := range kvs {
+		resp.Kvs = append(resp.Kvs, kv)
+	}
+	sort.Slice(resp.Kvs, func(i, j int) bool {
+		return string(resp.Kvs[i].Key) < string(resp.Kvs[j].Key)
+	})
+	return resp, nil
+}
+
+// Watch 按记录TTL轮询DNS，与上一次结果对比后生成PUT/DELETE事件。
+// 监听基准在返回前同步获取，rev大于0时基准中的记录会先以PUT事件推送
+func (c *Backend) Watch(ctx context.Context, prefix string, rev int64) <-chan *backend.WatchResponse {
+	p := &backend.Poller{
+		Load: func(ctx context.Context) (map[string]*backend.KeyValue, int64, func(ctx context.Context) bool, error) {
+			kvs, ttl, err := c.resolveAll(ctx, prefix)
+			if err != nil {
+				return nil, 0, nil, err
+			}
+
+			// 按记录TTL等待下一次轮询
+			next := func(ctx context.Context) bool {
+				timer := time.NewTimer(c.interval(ttl))
+				defer timer.Stop()
+				select {
+				case <-timer.C:
+					return true
+				case <-ctx.Done():
+					return false
+				}
+			}
+			return kvs, time.Now().UnixNano(), next, nil
+		},
+		Retry: c.cfg.MinInterval, // 查询失败时按最小间隔重试
+		Done:  c.done,
+	}
+	return p.Watch(ctx, rev)
+}
+
+// Close 关闭后端，结束所有监听
+func (c *Backend) Close() error {
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+	return nil
+}
+
+// interval 根据记录TTL计算轮询间隔
+func (c *Backend) interval(ttl uint32) time.Duration {
+	d := time.Duration(ttl) * time.Second
+	if d < c.cfg.MinInterval {
+		return c.cfg.MinInterval
+	}
+	if d > c.cfg.MaxInterval {
+		return c.cfg.MaxInterval
+	}
+	return d
+}
+
+// resolveAll 解析前缀对应的所有服务，返回记录与最小TTL
+func (c *Backend) resolveAll(ctx context.Context, prefix string) (map[string]*backend.KeyValue, uint32, error) {
+	names := c.cfg.Names
+	name := strings.Trim(strings.TrimPrefix(prefix, c.cfg.Prefix), "/")
+	if name != "" {
+		names = []string{name}
+	}
+
+	var minTTL uint32
+	ret := make(map[string]*backend.KeyValue)
+	for _, one := range names {
+		srvs, ttl, err := c.resolve(ctx, one)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if ttl > 0 && (minTTL == 0 || ttl < minTTL) {
+			minTTL = ttl
+		}
+
+		for _, srv := range srvs {
+			val, err := json.Marshal(srv)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			key := c.cfg.Prefix + srv.Name + "/" + srv.ID
+			ret[key] = &backend.KeyValue{Key: []byte(key), Value: val}
+		}
+	}
+	return ret, minTTL, nil
+}
+
+// resolve 解析单个服务，优先使用SRV记录并只保留优先级数值最小的记录，没有SRV记录且配置了Port时使用A/AAAA记录
+func (c *Backend) resolve(ctx context.Context, name string) ([]*service.Service, uint32, error) {
+	srvName := name
+	if c.cfg.Service != "" {
+		srvName = "_" + c.cfg.Service + "._" + c.cfg.Proto + "." + name
+	}
+
+	msg, err := c.exchange(ctx, srvName, dnsmessage.TypeSRV)
+	if err != nil && err != errNameNotFound {
+		return nil, 0, err
+	}
+
+	var list []*service.Service
+	var minTTL uint32
+	var minPriority uint16
+	if msg != nil {
+		addrs := make(map[string]string)
+		for _, one := range msg.Additionals {
+			switch body := one.Body.(type) {
+			case *dnsmessage.AResource:
+				addrs[one.Header.Name.String()] = net.IP(body.A[:]).String()
+			case *dnsmessage.AAAAResource:
+				if _, ok := addrs[one.Header.Name.String()]; !ok {
+					addrs[one.Header.Name.String()] = net.IP(body.AAAA[:]).String()
+				}
+			}
+		}
+
+		for _, one := range msg.Answers {
+			body, ok := one.Body.(*dnsmessage.SRVResource)
+			if !ok {
+				continue
+			}
+
+			// 优先级数值较大的记录只在优先级较小的实例全部不可用时使用，DNS应答中无法得知可用性，直接忽略
+			if len(list) > 0 && body.Priority > minPriority {
+				continue
+			}
+			if len(list) == 0 || body.Priority < minPriority {
+				list, minTTL, minPriority = list[:0], 0, body.Priority
+			}
+
+			target := body.Target.String()
+			host, ok := addrs[target]
+			if !ok {
+				host = strings.TrimSuffix(target, ".")
+			}
+
+			srv := newService(name, net.JoinHostPort(host, strconv.Itoa(int(body.Port))))
+			srv.Metadata[MetaPriority] = strconv.Itoa(int(body.Priority))
+			srv.Metadata[MetaWeight] = strconv.Itoa(int(body.Weight))
+			srv.Weight = int(body.Weight)
+			srv.Metadata[MetaTarget] = strings.TrimSuffix(target, ".")
+			list = append(list, srv)
+			minTTL = lowerTTL(minTTL, one.Header.TTL)
+		}
+	}
+
+	if len(list) > 0 || c.cfg.Port <= 0 {
+		return list, minTTL, nil
+	}
+
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		msg, err := c.exchange(ctx, name, qtype)
+		if err == errNameNotFound {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		for _, one := range msg.Answers {
+			var ip net.IP
+			switch body := one.Body.(type) {
+			case *dnsmessage.AResource:
+				ip = net.IP(body.A[:])
+			case *dnsmessage.AAAAResource:
+				ip = net.IP(body.AAAA[:])
+			default:
+				continue
+			}
+
+			list = append(list, newService(name, net.JoinHostPort(ip.String(), strconv.Itoa(c.cfg.Port))))
+			minTTL = lowerTTL(minTTL, one.Header.TTL)
+		}
+	}
+	return list, minTTL, nil
+}
+
+// newService 由DNS记录生成服务信息，使用地址作为服务ID
+func newService(name, host string) *service.Service {
+	return &service.Service{
+		ID:       host,
+		Name:     name,
+		Host:     host,
+		Metadata: make(map[string]string),
+	}
+}
+
+func lowerTTL(cur, ttl uint32) uint32 {
+	if cur == 0 || ttl < cur {
+		return ttl
+	}
+	return cur
+}
+
+// readResolvConf 读取系统DNS服务器地址
+func readResolvConf(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return defaultServers
+	}
+	defer f.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+
+	if len(servers) == 0 {
+		return defaultServers
+	}
+	return servers
+}
@@ -0,0 +1,350 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuanzhangcai/srsd/backend"
+	"github.com/yuanzhangcai/srsd/discovery"
+	"github.com/yuanzhangcai/srsd/service"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// testServer 测试用DNS服务器，按域名与类型返回预设记录
+type testServer struct {
+	mu       sync.Mutex
+	srv      map[string][]dnsmessage.SRVResource
+	a        map[string][][4]byte
+	truncate bool
+	udp      net.PacketConn
+	tcp      net.Listener
+}
+
+func newTestServer(t *testing.T) *testServer {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	assert.Nil(t, err)
+
+	c := &testServer{
+		srv: make(map[string][]dnsmessage.SRVResource),
+		a:   make(map[string][][4]byte),
+		udp: udp,
+		tcp: tcp,
+	}
+	go c.serveUDP()
+	go c.serveTCP()
+	return c
+}
+
+func (c *testServer) addr() string {
+	return c.udp.LocalAddr().String()
+}
+
+func (c *testServer) close() {
+	_ = c.udp.Close()
+	_ = c.tcp.Close()
+}
+
+func (c *testServer) setSRV(name string, list ...dnsmessage.SRVResource) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.srv[name] = list
+}
+
+func (c *testServer) setA(name string, list ...[4]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.a[name] = list
+}
+
+func (c *testServer) serveUDP() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := c.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		resp := c.handle(buf[:n], true)
+		if resp != nil {
+			_, _ = c.udp.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (c *testServer) serveTCP() {
+	for {
+		conn, err := c.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			var length uint16
+			if binary.Read(conn, binary.BigEndian, &length) != nil {
+				return
+			}
+			req := make([]byte, length)
+			if _, err := io.ReadFull(conn, req); err != nil {
+				return
+			}
+			resp := c.handle(req, false)
+			data := make([]byte, 2+len(resp))
+			binary.BigEndian.PutUint16(data, uint16(len(resp)))
+			copy(data[2:], resp)
+			_, _ = conn.Write(data)
+		}()
+	}
+}
+
+func (c *testServer) handle(req []byte, udp bool) []byte {
+	msg := &dnsmessage.Message{}
+	if msg.Unpack(req) != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	q := msg.Questions[0]
+	name := strings.TrimSuffix(q.Name.String(), ".")
+	resp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: msg.ID, Response: true, Authoritative: true},
+		Questions: msg.Questions,
+	}
+
+	if c.truncate && udp {
+		resp.Truncated = true
+		data, _ := resp.Pack()
+		return data
+	}
+
+	header := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 1}
+	srvs, hasSRV := c.srv[name]
+	addrs, hasA := c.a[name]
+	switch {
+	case q.Type == dnsmessage.TypeSRV && hasSRV:
+		for _, one := range srvs {
+			one := one
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &one})
+			target := strings.TrimSuffix(one.Target.String(), ".")
+			for _, ip := range c.a[target] {
+				h := dnsmessage.ResourceHeader{Name: one.Target, Class: dnsmessage.ClassINET, TTL: 1}
+				resp.Additionals = append(resp.Additionals, dnsmessage.Resource{Header: h, Body: &dnsmessage.AResource{A: ip}})
+			}
+		}
+	case q.Type == dnsmessage.TypeA && hasA:
+		for _, ip := range addrs {
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{Header: header, Body: &dnsmessage.AResource{A: ip}})
+		}
+	case !hasSRV && !hasA:
+		resp.RCode = dnsmessage.RCodeNameError
+	}
+
+	data, _ := resp.Pack()
+	return data
+}
+
+func newSRV(target string, port, priority, weight uint16) dnsmessage.SRVResource {
+	return dnsmessage.SRVResource{
+		Target:   dnsmessage.MustNewName(target + "."),
+		Port:     port,
+		Priority: priority,
+		Weight:   weight,
+	}
+}
+
+func decode(t *testing.T, kv *backend.KeyValue) *service.Service {
+	srv := &service.Service{}
+	assert.Nil(t, json.Unmarshal(kv.Value, srv))
+	return srv
+}
+
+func TestNewBackend(t *testing.T) {
+	b, err := NewBackend(Config{Servers: []string{"127.0.0.1", "127.0.0.1:5353"}, Prefix: "/zacyuan/test"})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"127.0.0.1:53", "127.0.0.1:5353"}, b.cfg.Servers)
+	assert.Equal(t, "/zacyuan/test/", b.cfg.Prefix)
+	assert.Equal(t, defaultProto, b.cfg.Proto)
+	assert.Equal(t, defaultTimeout, b.cfg.Timeout)
+	assert.Equal(t, defaultMinInterval, b.interval(0))
+	assert.Equal(t, 5*time.Second, b.interval(5))
+	assert.Equal(t, defaultMaxInterval, b.interval(3600))
+
+	assert.Equal(t, defaultServers, readResolvConf("/not/exist/resolv.conf"))
+}
+
+func TestNotSupported(t *testing.T) {
+	b, err := NewBackend(Config{})
+	assert.Nil(t, err)
+	defer b.Close()
+	ctx := context.Background()
+
+	_, err = b.Grant(ctx, 10)
+	assert.Equal(t, backend.ErrNotSupported, err)
+	_, err = b.KeepAlive(ctx, 1)
+	assert.Equal(t, backend.ErrNotSupported, err)
+	assert.Equal(t, backend.ErrNotSupported, b.Revoke(ctx, 1))
+	assert.Equal(t, backend.ErrNotSupported, b.Put(ctx, "/srsd/services/a/1", "{}", backend.NoLease))
+	assert.Equal(t, backend.ErrNotSupported, b.Delete(ctx, "/srsd/services/a/1"))
+}
+
+func TestGet(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	s.setSRV("_http._tcp.zacyuan.com", newSRV("node3.zacyuan.com", 4003, 20, 100),
+		newSRV("node1.zacyuan.com", 4001, 10, 60), newSRV("node2.zacyuan.com", 4002, 10, 40))
+	s.setA("node1.zacyuan.com", [4]byte{127, 0, 0, 1})
+	s.setA("other.com", [4]byte{127, 0, 0, 2}, [4]byte{127, 0, 0, 3})
+
+	b, err := NewBackend(Config{Servers: []string{s.addr()}, Service: "http"})
+	assert.Nil(t, err)
+	defer b.Close()
+	ctx := context.Background()
+
+	t.Run("srv", func(t *testing.T) {
+		resp, err := b.Get(ctx, "/srsd/services/zacyuan.com")
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(resp.Kvs))
+		assert.Equal(t, "/srsd/services/zacyuan.com/127.0.0.1:4001", string(resp.Kvs[0].Key))
+
+		srv := decode(t, resp.Kvs[0])
+		assert.Equal(t, "zacyuan.com", srv.Name)
+		assert.Equal(t, "127.0.0.1:4001", srv.Host)
+		assert.Equal(t, "10", srv.Metadata[MetaPriority])
+		assert.Equal(t, "60", srv.Metadata[MetaWeight])
+		assert.Equal(t, 60, srv.Weight)
+		assert.Equal(t, "node1.zacyuan.com", srv.Metadata[MetaTarget])
+
+		// 附加记录中没有地址时使用SRV目标域名
+		srv = decode(t, resp.Kvs[1])
+		assert.Equal(t, "node2.zacyuan.com:4002", srv.Host)
+
+		// 只返回优先级数值最小的一组实例
+		for _, kv := range resp.Kvs {
+			assert.Equal(t, "10", decode(t, kv).Metadata[MetaPriority])
+		}
+	})
+
+	t.Run("a fallback", func(t *testing.T) {
+		resp, err := b.Get(ctx, "/srsd/services/other.com")
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(resp.Kvs))
+
+		b, err := NewBackend(Config{Servers: []string{s.addr()}, Port: 8080})
+		assert.Nil(t, err)
+		defer b.Close()
+
+		resp, err = b.Get(ctx, "/srsd/services/other.com")
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(resp.Kvs))
+		assert.Equal(t, "127.0.0.2:8080", decode(t, resp.Kvs[0]).Host)
+
+		resp, err = b.Get(ctx, "/srsd/services/notfound.com")
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(resp.Kvs))
+	})
+
+	t.Run("names", func(t *testing.T) {
+		b, err := NewBackend(Config{Servers: []string{s.addr()}, Service: "http", Port: 8080, Names: []string{"zacyuan.com", "other.com"}})
+		assert.Nil(t, err)
+		defer b.Close()
+
+		resp, err := b.Get(ctx, "/srsd/services/")
+		assert.Nil(t, err)
+		assert.Equal(t, 4, len(resp.Kvs))
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		s.mu.Lock()
+		s.truncate = true
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			s.truncate = false
+			s.mu.Unlock()
+		}()
+
+		resp, err := b.Get(ctx, "/srsd/services/zacyuan.com")
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(resp.Kvs))
+	})
+
+	t.Run("server error", func(t *testing.T) {
+		b, err := NewBackend(Config{Servers: []string{"127.0.0.1:1"}, Timeout: 200 * time.Millisecond})
+		assert.Nil(t, err)
+		defer b.Close()
+
+		_, err = b.Get(ctx, "/srsd/services/zacyuan.com")
+		assert.NotNil(t, err)
+	})
+}
+
+func TestWatch(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	s.setSRV("zacyuan.com", newSRV("node1.zacyuan.com", 4001, 10, 60))
+	s.setA("node1.zacyuan.com", [4]byte{127, 0, 0, 1})
+
+	b, err := NewBackend(Config{Servers: []string{s.addr()}, MinInterval: 100 * time.Millisecond, MaxInterval: 100 * time.Millisecond})
+	assert.Nil(t, err)
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := b.Watch(ctx, "/srsd/services/zacyuan.com", 0)
+
+	s.setSRV("zacyuan.com", newSRV("node1.zacyuan.com", 4001, 10, 60), newSRV("node1.zacyuan.com", 4002, 10, 40))
+	resp := <-ch
+	assert.Equal(t, 1, len(resp.Events))
+	assert.Equal(t, backend.EventPut, resp.Events[0].Type)
+	assert.Equal(t, "/srsd/services/zacyuan.com/127.0.0.1:4002", string(resp.Events[0].Kv.Key))
+
+	s.setSRV("zacyuan.com", newSRV("node1.zacyuan.com", 4002, 10, 40))
+	resp = <-ch
+	assert.Equal(t, 1, len(resp.Events))
+	assert.Equal(t, backend.EventDelete, resp.Events[0].Type)
+	assert.Equal(t, "/srsd/services/zacyuan.com/127.0.0.1:4001", string(resp.Events[0].Kv.Key))
+
+	// 指定版本时先推送当前记录
+	ch2 := b.Watch(ctx, "/srsd/services/zacyuan.com", 1)
+	resp = <-ch2
+	assert.Equal(t, 1, len(resp.Events))
+	assert.Equal(t, backend.EventPut, resp.Events[0].Type)
+
+	// 后端关闭后监听结束
+	_ = b.Close()
+	for range ch {
+	}
+	for range ch2 {
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	s := newTestServer(t)
+	defer s.close()
+	s.setSRV("zacyuan.com", newSRV("node1.zacyuan.com", 4001, 10, 60), newSRV("node1.zacyuan.com", 4002, 10, 40))
+	s.setA("node1.zacyuan.com", [4]byte{127, 0, 0, 1})
+
+	b, err := NewBackend(Config{Servers: []string{s.addr()}, Names: []string{"zacyuan.com"}, MinInterval: 100 * time.Millisecond, MaxInterval: 100 * time.Millisecond})
+	assert.Nil(t, err)
+	defer b.Close()
+
+	dis := discovery.NewDiscovery(discovery.Backend(b))
+	err = dis.Start("")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(dis.GetAll("zacyuan.com")))
+
+	s.setSRV("zacyuan.com", newSRV("node1.zacyuan.com", 4001, 10, 60))
+	time.Sleep(500 * time.Millisecond)
+	assert.Equal(t, 1, len(dis.GetAll("zacyuan.com")))
+	_ = dis.Stop()
+}
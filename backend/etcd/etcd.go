@@ -0,0 +1,176 @@
+package etcd
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/yuanzhangcai/srsd/backend"
+)
+
+// Config etcd连接参数
+type Config struct {
+	Addresses []string      // etcd地址
+	Username  string        // etcd用户名
+	Password  string        // etcd密码
+	Timeout   time.Duration // etcd超时时间
+	TLS       *TLSConfig    // TLS连接参数，为空时不使用TLS
+}
+
+// Backend 基于etcd clientv3的存储后端
+type Backend struct {
+	cli *clientv3.Client
+}
+
+// NewBackend 创建etcd存储后端
+func NewBackend(cfg Config) (*Backend, error) {
+	var tlsConfig *tls.Config
+	if cfg.TLS != nil {
+		var err error
+		tlsConfig, err = NewTLSConfig(*cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	cli, err := clientv3.New(clientv3.Config{
+		Context:     ctx,
+		Endpoints:   cfg.Addresses,
+		DialTimeout: cfg.Timeout,
+		Username:    cfg.Username,
+		Password:    cfg.Password,
+		TLS:         tlsConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Backend{cli: cli}, nil
+}
+
+// Client 获取etcd客户端
+func (c *Backend) Client() *clientv3.Client {
+	return c.cli
+}
+
+// Grant 创建租约
+func (c *Backend) Grant(ctx context.Context, ttl int64) (backend.LeaseID, error) {
+	grant, err := c.cli.Grant(ctx, ttl)
+	if err != nil {
+		return backend.NoLease, err
+	}
+	return backend.LeaseID(grant.ID), nil
+}
+
+// KeepAlive 保持租约
+func (c *Backend) KeepAlive(ctx context.Context, id backend.LeaseID) (<-chan struct{}, error) {
+	ch, err := c.cli.KeepAlive(ctx, clientv3.LeaseID(id))
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for range ch {
+		}
+		close(done)
+	}()
+	return done, nil
+}
+
+// Revoke 撤销租约
+func (c *Backend) Revoke(ctx context.Context, id backend.LeaseID) error {
+	_, err := c.cli.Revoke(ctx, clientv3.LeaseID(id))
+	return err
+}
+
+// Put 写入键值
+func (c *Backend) Put(ctx context.Context, key, value string, lease backend.LeaseID) error {
+	var opts []clientv3.OpOption
+	if lease != backend.NoLease {
+		opts = append(opts, clientv3.WithLease(clientv3.LeaseID(lease)))
+	}
+	_, err := c.cli.Put(ctx, key, value, opts...)
+	return err
+}
+
+// Delete 删除键值
+func (c *Backend) Delete(ctx context.Context, key string) error {
+	_, err := c.cli.Delete(ctx, key)
+	return err
+}
+
+// Get 按前缀查询键值
+func (c *Backend) Get(ctx context.Context, prefix string) (*backend.GetResponse, error) {
+	resp, err := c.cli.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &backend.GetResponse{
+		Revision: resp.Header.Revision,
+		Kvs:      make([]*backend.KeyValue, 0, len(resp.Kvs)),
+	}
+	for _, kv := range resp.Kvs {
+		ret.Kvs = append(ret.Kvs, convertKeyValue(kv))
+	}
+	return ret, nil
+}
+
+// Watch 按前缀监听键值变化
+func (c *Backend) Watch(ctx context.Context, prefix string, rev int64) <-chan *backend.WatchResponse {
+	opts := []clientv3.OpOption{clientv3.WithPrefix()}
+	if rev > 0 {
+		opts = append(opts, clientv3.WithRev(rev))
+	}
+
+	wch := c.cli.Watch(ctx, prefix, opts...)
+	ch := make(chan *backend.WatchResponse)
+	go func() {
+		defer close(ch)
+		for resp := range wch {
+			ret := &backend.WatchResponse{
+				Revision:        resp.Header.Revision,
+				Canceled:        resp.Canceled,
+				CompactRevision: resp.CompactRevision,
+				Err:             resp.Err(),
+			}
+			if resp.CompactRevision != 0 {
+				ret.Err = backend.ErrCompacted
+			}
+			for _, one := range resp.Events {
+				ev := &backend.Event{Kv: convertKeyValue(one.Kv)}
+				if one.Type == mvccpb.DELETE {
+					ev.Type = backend.EventDelete
+				}
+				ret.Events = append(ret.Events, ev)
+			}
+
+			select {
+			case ch <- ret:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// Close 关闭etcd连接
+func (c *Backend) Close() error {
+	return c.cli.Close()
+}
+
+func convertKeyValue(kv *mvccpb.KeyValue) *backend.KeyValue {
+	return &backend.KeyValue{
+		Key:         kv.Key,
+		Value:       kv.Value,
+		Lease:       backend.LeaseID(kv.Lease),
+		ModRevision: kv.ModRevision,
+	}
+}
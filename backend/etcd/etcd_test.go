@@ -0,0 +1,16 @@
+package etcd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewBackend(t *testing.T) {
+	t.Run("no etcd address", func(t *testing.T) {
+		b, err := NewBackend(Config{Addresses: []string{}, Timeout: time.Second})
+		assert.NotNil(t, err)
+		assert.Nil(t, b)
+	})
+}
@@ -0,0 +1,166 @@
+package etcd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLSConfig etcd TLS连接参数，证书文件更新后在下一次建立连接时自动重新加载
+type TLSConfig struct {
+	CAFile             string // CA证书文件，为空时使用系统根证书
+	CertFile           string // 客户端证书文件，mTLS时使用
+	KeyFile            string // 客户端私钥文件，mTLS时使用
+	ServerName         string // 校验服务端证书使用的域名或IP，为空时使用连接域名；使用自定义CA且连接地址为IP时必须设置
+	InsecureSkipVerify bool   // 不校验服务端证书，仅用于测试
+}
+
+var (
+	// ErrNoCertificate CA证书文件中没有有效证书
+	ErrNoCertificate = errors.New("etcd: no certificate found in ca file")
+	// ErrNoServerName 使用自定义CA时无法得知校验服务端证书的域名，连接地址为IP时需设置ServerName
+	ErrNoServerName = errors.New("etcd: server name required to verify server certificate")
+)
+
+// NewTLSConfig 创建tls.Config，创建时加载一次证书以检查配置，之后每次握手时检查文件是否更新
+func NewTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	r := &reloader{cfg: cfg}
+	err := r.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		ret.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			_ = r.reload()
+			cert, _ := r.get()
+			return cert, nil
+		}
+	}
+
+	// 使用自定义CA时由VerifyConnection（Go 1.15）按最新的CA证书校验
+	if cfg.CAFile != "" && !cfg.InsecureSkipVerify {
+		ret.InsecureSkipVerify = true
+		ret.VerifyConnection = func(cs tls.ConnectionState) error {
+			_ = r.reload()
+			_, pool := r.get()
+			return verify(cs, pool, cfg.ServerName)
+		}
+	}
+	return ret, nil
+}
+
+// verify 按CA证书校验服务端证书链与域名。连接地址为IP时cs.ServerName为空，使用配置的serverName，
+// 都为空时校验失败，避免同一CA签发的任意证书都能通过校验
+func verify(cs tls.ConnectionState, pool *x509.CertPool, serverName string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("etcd: no server certificate")
+	}
+
+	name := cs.ServerName
+	if name == "" {
+		name = serverName
+	}
+	if name == "" {
+		return ErrNoServerName
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		DNSName:       name,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, one := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(one)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// reloader 证书文件修改时间变化时重新加载，加载失败时继续使用上一次的证书
+type reloader struct {
+	cfg TLSConfig
+
+	m       sync.Mutex
+	modTime map[string]time.Time
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+}
+
+func (c *reloader) get() (*tls.Certificate, *x509.CertPool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.cert, c.pool
+}
+
+// changed 判断文件是否修改过，返回最新的修改时间
+func (c *reloader) changed(files ...string) (map[string]time.Time, bool, error) {
+	ret := make(map[string]time.Time, len(files))
+	changed := false
+	for _, one := range files {
+		info, err := os.Stat(one)
+		if err != nil {
+			return nil, false, err
+		}
+
+		ret[one] = info.ModTime()
+		if old, ok := c.modTime[one]; !ok || !old.Equal(info.ModTime()) {
+			changed = true
+		}
+	}
+	return ret, changed, nil
+}
+
+func (c *reloader) reload() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	var files []string
+	if c.cfg.CertFile != "" || c.cfg.KeyFile != "" {
+		files = append(files, c.cfg.CertFile, c.cfg.KeyFile)
+	}
+	if c.cfg.CAFile != "" {
+		files = append(files, c.cfg.CAFile)
+	}
+
+	modTime, changed, err := c.changed(files...)
+	if err != nil || !changed {
+		return err
+	}
+
+	var cert *tls.Certificate
+	if c.cfg.CertFile != "" || c.cfg.KeyFile != "" {
+		one, err := tls.LoadX509KeyPair(c.cfg.CertFile, c.cfg.KeyFile)
+		if err != nil {
+			return err
+		}
+		cert = &one
+	}
+
+	var pool *x509.CertPool
+	if c.cfg.CAFile != "" {
+		data, err := ioutil.ReadFile(c.cfg.CAFile)
+		if err != nil {
+			return err
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return ErrNoCertificate
+		}
+	}
+
+	c.modTime = modTime
+	c.cert = cert
+	c.pool = pool
+	return nil
+}
@@ -0,0 +1,252 @@
+package etcd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCA 测试使用的CA
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+var serial int64
+
+func newCert(t *testing.T, cn string, parent *testCA, ca bool) ([]byte, []byte, *x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if ip := net.ParseIP(cn); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{cn}
+	}
+	if ca {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	}
+
+	parentCert, parentKey := tmpl, key
+	if parent != nil {
+		parentCert, parentKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM, cert, key
+}
+
+func newCA(t *testing.T) *testCA {
+	certPEM, _, cert, key := newCert(t, "srsd-ca", nil, true)
+	return &testCA{cert: cert, key: key, pem: certPEM}
+}
+
+// writeFile 写入文件并修改修改时间，确保文件更新能被检测到
+func writeFile(t *testing.T, path string, data []byte) {
+	assert.Nil(t, ioutil.WriteFile(path, data, 0600))
+	mod := time.Now().Add(time.Duration(serial) * time.Second)
+	assert.Nil(t, os.Chtimes(path, mod, mod))
+}
+
+// tlsServer 要求客户端证书的TLS服务，返回客户端证书的CN
+func tlsServer(t *testing.T, cert tls.Certificate, ca *testCA) (string, func(), chan string) {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	assert.Nil(t, err)
+
+	names := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			tc := conn.(*tls.Conn)
+			if tc.Handshake() == nil {
+				names <- tc.ConnectionState().PeerCertificates[0].Subject.CommonName
+			}
+			_ = conn.Close()
+		}
+	}()
+	return ln.Addr().String(), func() { _ = ln.Close() }, names
+}
+
+func dial(addr string, cfg *tls.Config) error {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: time.Second}, "tcp", addr, cfg)
+	if err != nil {
+		return err
+	}
+	_, _ = conn.Read(make([]byte, 1)) // 等待服务端完成握手
+	return conn.Close()
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srsd-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+
+	ca := newCA(t)
+	writeFile(t, caFile, ca.pem)
+	certPEM, keyPEM, _, _ := newCert(t, "client-1", ca, false)
+	writeFile(t, certFile, certPEM)
+	writeFile(t, keyFile, keyPEM)
+
+	srvCertPEM, srvKeyPEM, _, _ := newCert(t, "etcd.zacyuan.com", ca, false)
+	srvCert, err := tls.X509KeyPair(srvCertPEM, srvKeyPEM)
+	assert.Nil(t, err)
+	addr, stop, names := tlsServer(t, srvCert, ca)
+	defer stop()
+
+	cfg, err := NewTLSConfig(TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "etcd.zacyuan.com"})
+	assert.Nil(t, err)
+	assert.Nil(t, dial(addr, cfg))
+	assert.Equal(t, "client-1", <-names)
+
+	// 客户端证书更新后重新加载
+	certPEM, keyPEM, _, _ = newCert(t, "client-2", ca, false)
+	writeFile(t, certFile, certPEM)
+	writeFile(t, keyFile, keyPEM)
+	assert.Nil(t, dial(addr, cfg))
+	assert.Equal(t, "client-2", <-names)
+
+	// 证书与私钥不匹配时继续使用上一次的证书
+	_, keyPEM, _, _ = newCert(t, "client-3", ca, false)
+	writeFile(t, keyFile, keyPEM)
+	assert.Nil(t, dial(addr, cfg))
+	assert.Equal(t, "client-2", <-names)
+
+	// 域名不匹配时校验失败
+	other, err := NewTLSConfig(TLSConfig{CAFile: caFile, ServerName: "other.com"})
+	assert.Nil(t, err)
+	assert.NotNil(t, dial(addr, other))
+
+	// CA证书更新后按新的CA校验服务端证书
+	newCA := newCA(t)
+	srvCertPEM, srvKeyPEM, _, _ = newCert(t, "etcd.zacyuan.com", newCA, false)
+	srvCert, err = tls.X509KeyPair(srvCertPEM, srvKeyPEM)
+	assert.Nil(t, err)
+	addr2, stop2, names2 := tlsServer(t, srvCert, ca)
+	defer stop2()
+	assert.NotNil(t, dial(addr2, cfg))
+	writeFile(t, caFile, newCA.pem)
+	certPEM, keyPEM, _, _ = newCert(t, "client-4", ca, false)
+	writeFile(t, certFile, certPEM)
+	writeFile(t, keyFile, keyPEM)
+	assert.Nil(t, dial(addr2, cfg))
+	assert.Equal(t, "client-4", <-names2)
+
+	// 不校验服务端证书
+	insecure, err := NewTLSConfig(TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, InsecureSkipVerify: true})
+	assert.Nil(t, err)
+	assert.Nil(t, dial(addr, insecure))
+	assert.Equal(t, "client-4", <-names)
+}
+
+func TestTLSConfigIP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srsd-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "client.pem")
+	keyFile := filepath.Join(dir, "client-key.pem")
+
+	ca := newCA(t)
+	writeFile(t, caFile, ca.pem)
+	certPEM, keyPEM, _, _ := newCert(t, "client-1", ca, false)
+	writeFile(t, certFile, certPEM)
+	writeFile(t, keyFile, keyPEM)
+
+	// 同一CA签发的其他域名证书，按IP连接且没有设置ServerName时校验失败
+	evilPEM, evilKeyPEM, _, _ := newCert(t, "evil.example.com", ca, false)
+	evil, err := tls.X509KeyPair(evilPEM, evilKeyPEM)
+	assert.Nil(t, err)
+	addr, stop, _ := tlsServer(t, evil, ca)
+	defer stop()
+
+	cfg, err := NewTLSConfig(TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile})
+	assert.Nil(t, err)
+	err = dial(addr, cfg)
+	assert.NotNil(t, err)
+	assert.True(t, errors.Is(err, ErrNoServerName), err)
+	ipCfg, err := NewTLSConfig(TLSConfig{CAFile: caFile, CertFile: certFile, KeyFile: keyFile, ServerName: "127.0.0.1"})
+	assert.Nil(t, err)
+	assert.NotNil(t, dial(addr, ipCfg))
+
+	// 证书包含连接IP时按配置的ServerName校验通过
+	srvPEM, srvKeyPEM, _, _ := newCert(t, "127.0.0.1", ca, false)
+	srv, err := tls.X509KeyPair(srvPEM, srvKeyPEM)
+	assert.Nil(t, err)
+	addr2, stop2, names := tlsServer(t, srv, ca)
+	defer stop2()
+	assert.NotNil(t, dial(addr2, cfg))
+	assert.Nil(t, dial(addr2, ipCfg))
+	assert.Equal(t, "client-1", <-names)
+}
+
+func TestTLSConfigError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srsd-tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	_, err = NewTLSConfig(TLSConfig{CAFile: filepath.Join(dir, "none.pem")})
+	assert.NotNil(t, err)
+	_, err = NewTLSConfig(TLSConfig{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")})
+	assert.NotNil(t, err)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	writeFile(t, caFile, []byte("invalid"))
+	_, err = NewTLSConfig(TLSConfig{CAFile: caFile})
+	assert.Equal(t, ErrNoCertificate, err)
+
+	_, err = NewBackend(Config{Addresses: []string{"127.0.0.1:2379"}, Timeout: time.Second, TLS: &TLSConfig{CAFile: caFile}})
+	assert.Equal(t, ErrNoCertificate, err)
+
+	// 不使用自定义CA时使用系统根证书校验
+	cfg, err := NewTLSConfig(TLSConfig{ServerName: "etcd.zacyuan.com"})
+	assert.Nil(t, err)
+	assert.False(t, cfg.InsecureSkipVerify)
+	assert.Nil(t, cfg.VerifyConnection)
+	assert.Nil(t, cfg.GetClientCertificate)
+}
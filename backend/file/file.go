@@ -0,0 +1,629 @@
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/yuanzhangcai/srsd/backend"
+)
+
+var (
+	defaultPrefix       = "/srsd/services/"
+	defaultWriteFile    = "srsd.json"
+	defaultPollInterval = time.Second
+	defaultDebounce     = 50 * time.Millisecond
+
+	// ErrClosed 后端已关闭
+	ErrClosed = errors.New("file: backend closed")
+	// ErrLeaseNotFound 租约不存在或已过期
+	ErrLeaseNotFound = errors.New("file: lease not found")
+	// ErrInvalidKey key格式不是 前缀+服务名/服务ID
+	ErrInvalidKey = errors.New("file: invalid service key")
+)
+
+// Config 文件存储后端参数
+type Config struct {
+	Path      string // 服务信息文件或目录，支持JSON与YAML
+	WriteFile string // 服务注册写入的文件，为空时Path为文件则写入Path，为目录则写入Path下的srsd.json
+	Prefix    string // 服务注册前缀，需与registry、discovery的Prefix一致
+}
+
+// Backend 基于本地文件的存储后端，用于本地开发与无法部署etcd的环境。
+// 服务发现读取文件并通过inotify监听变化；服务注册在文件锁保护下写入文件，记录按TTL过期
+type Backend struct {
+	cfg       Config
+	dir       bool
+	writeFile string
+	lockFile  string
+	done      chan struct{}
+
+	wm sync.Mutex // 进程内写文件互斥
+
+	m         sync.Mutex
+	nextLease backend.LeaseID
+	leases    map[backend.LeaseID]*lease
+	closed    bool
+}
+
+type lease struct {
+	ttl    time.Duration
+	keys   map[string]struct{}
+	keeper []chan struct{}
+}
+
+// NewBackend 创建文件存储后端
+func NewBackend(cfg Config) (*Backend, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("file: path is empty")
+	}
+
+	if cfg.Prefix == "" {
+		cfg.Prefix = defaultPrefix
+	}
+	if cfg.Prefix[len(cfg.Prefix)-1] != '/' {
+		cfg.Prefix += "/"
+	}
+
+	dir := false
+	info, err := os.Stat(cfg.Path)
+	if err == nil {
+		dir = info.IsDir()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	writeFile := cfg.WriteFile
+	if writeFile == "" {
+		writeFile = cfg.Path
+		if dir {
+			writeFile = filepath.Join(cfg.Path, defaultWriteFile)
+		}
+	}
+
+	return &Backend{
+		cfg:       cfg,
+		dir:       dir,
+		writeFile: writeFile,
+		lockFile:  filepath.Join(filepath.Dir(writeFile), "."+filepath.Base(writeFile)+".lock"),
+		done:      make(chan struct{}),
+		leases:    make(map[backend.LeaseID]*lease),
+	}, nil
+}
+
+// Grant 创建租约
+func (c *Backend) Grant(ctx context.Context, ttl int64) (backend.LeaseID, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return backend.NoLease, ErrClosed
+	}
+
+	c.nextLease++
+	c.leases[c.nextLease] = &lease{
+		ttl:  time.Duration(ttl) * time.Second,
+		keys: make(map[string]struct{}),
+	}
+	return c.nextLease, nil
+}
+
+// KeepAlive 每隔TTL的三分之一刷新租约下记录的过期时间，记录被删除或长时间无法写入时视为租约过期
+func (c *Backend) KeepAlive(ctx context.Context, id backend.LeaseID) (<-chan struct{}, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	l, ok := c.leases[id]
+	if !ok {
+		return nil, ErrLeaseNotFound
+	}
+
+	done := make(chan struct{})
+	l.keeper = append(l.keeper, done)
+
+	interval := l.ttl / 3
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		last := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case <-c.done:
+				c.stopKeeper(id, done)
+				return
+			case <-ctx.Done():
+				c.stopKeeper(id, done)
+				return
+			case <-ticker.C:
+			}
+
+			err := c.refresh(id)
+			if err == nil {
+				last = time.Now()
+				continue
+			}
+
+			if err == ErrLeaseNotFound || time.Since(last) > l.ttl {
+				c.expireLease(id)
+				return
+			}
+		}
+	}()
+	return done, nil
+}
+
+func (c *Backend) refresh(id backend.LeaseID) error {
+	c.m.Lock()
+	l, ok := c.leases[id]
+	if !ok {
+		c.m.Unlock()
+		return ErrLeaseNotFound
+	}
+	keys := make(map[string]struct{}, len(l.keys))
+	for key := range l.keys {
+		keys[key] = struct{}{}
+	}
+	c.m.Unlock()
+
+	expire := time.Now().Add(l.ttl)
+	return c.update(func(list []*entry) ([]*entry, error) {
+		found := 0
+		for _, one := range list {
+			if _, ok := keys[c.entryKey(one)]; ok {
+				one.ExpireAt = &expire
+				found++
+			}
+		}
+
+		if found < len(keys) {
+			return nil, ErrLeaseNotFound
+		}
+		return list, nil
+	})
+}
+
+func (c *Backend) stopKeeper(id backend.LeaseID, done chan struct{}) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	l, ok := c.leases[id]
+	if !ok {
+		return
+	}
+
+	for i, one := range l.keeper {
+		if one == done {
+			l.keeper = append(l.keeper[:i], l.keeper[i+1:]...)
+			close(done)
+			return
+		}
+	}
+}
+
+func (c *Backend) expireLease(id backend.LeaseID) *lease {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	l, ok := c.leases[id]
+	if !ok {
+		return nil
+	}
+
+	delete(c.leases, id)
+	for _, one := range l.keeper {
+		close(one)
+	}
+	l.keeper = nil
+	return l
+}
+
+// Revoke 撤销租约，删除租约下的所有记录
+func (c *Backend) Revoke(ctx context.Context, id backend.LeaseID) error {
+	l := c.expireLease(id)
+	if l == nil {
+		return ErrLeaseNotFound
+	}
+
+	return c.update(func(list []*entry) ([]*entry, error) {
+		ret := list[:0]
+		for _, one := range list {
+			if _, ok := l.keys[c.entryKey(one)]; !ok {
+				ret = append(ret, one)
+			}
+		}
+		return ret, nil
+	})
+}
+
+// Put 将服务信息写入文件，带租约时记录TTL过期时间
+func (c *Backend) Put(ctx context.Context, key, value string, id backend.LeaseID) error {
+	name, srvID, err := c.parseKey(key)
+	if err != nil {
+		return err
+	}
+
+	e := &entry{}
+	err = json.Unmarshal([]byte(value), &e.Service)
+	if err != nil {
+		return err
+	}
+	e.Name = name
+	e.ID = srvID
+
+	c.m.Lock()
+	if c.closed {
+		c.m.Unlock()
+		return ErrClosed
+	}
+
+	var l *lease
+	if id != backend.NoLease {
+		var ok bool
+		l, ok = c.leases[id]
+		if !ok {
+			c.m.Unlock()
+			return ErrLeaseNotFound
+		}
+		expire := time.Now().Add(l.ttl)
+		e.ExpireAt = &expire
+	}
+
+	for leaseID, one := range c.leases {
+		if leaseID != id {
+			delete(one.keys, key)
+		}
+	}
+	if l != nil {
+		l.keys[key] = struct{}{}
+	}
+	c.m.Unlock()
+
+	return c.update(func(list []*entry) ([]*entry, error) {
+		for i, one := range list {
+			if c.entryKey(one) == key {
+				list[i] = e
+				return list, nil
+			}
+		}
+		return append(list, e), nil
+	})
+}
+
+// Delete 从写入文件中删除记录，其他只读文件中的记录不受影响
+func (c *Backend) Delete(ctx context.Context, key string) error {
+	c.m.Lock()
+	if c.closed {
+		c.m.Unlock()
+		return ErrClosed
+	}
+	for _, one := range c.leases {
+		delete(one.keys, key)
+	}
+	c.m.Unlock()
+
+	return c.update(func(list []*entry) ([]*entry, error) {
+		ret := list[:0]
+		for _, one := range list {
+			if c.entryKey(one) != key {
+				ret = append(ret, one)
+			}
+		}
+		return ret, nil
+	})
+}
+
+// update 在文件锁保护下读取、修改并写回写入文件，过期记录会被清理
+func (c *Backend) update(fn func(list []*entry) ([]*entry, error)) error {
+	c.wm.Lock()
+	defer c.wm.Unlock()
+
+	unlock, err := lockFile(c.lockFile)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	list, _, err := readFile(c.writeFile)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	valid := list[:0]
+	for _, one := range list {
+		if !one.expired(now) {
+			valid = append(valid, one)
+		}
+	}
+
+	list, err = fn(valid)
+	if err != nil {
+		return err
+	}
+	return writeFile(c.writeFile, list)
+}
+
+// Get 按前缀查询未过期的服务记录，Revision为文件的最后修改时间
+func (c *Backend) Get(ctx context.Context, prefix string) (*backend.GetResponse, error) {
+	if c.isClosed() {
+		return nil, ErrClosed
+	}
+
+	kvs, rev, _, err := c.load(prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &backend.GetResponse{Revision: rev}
+	for _, kv := range kvs {
+		resp.Kvs = append(resp.Kvs, kv)
+	}
+	sort.Slice(resp.Kvs, func(i, j int) bool {
+		return string(resp.Kvs[i].Key) < string(resp.Kvs[j].Key)
+	})
+	return resp, nil
+}
+
+// Watch 通过inotify监听文件变化，并在记录过期时重新加载，与上一次结果对比后生成PUT/DELETE事件。
+// 监听基准在返回前同步获取，rev大于0且基准已晚于rev时，基准中的记录会先以PUT事件推送
+func (c *Backend) Watch(ctx context.Context, prefix string, rev int64) <-chan *backend.WatchResponse {
+	// 无法使用inotify或部分目录无法监听（如目录尚未创建）时同时定时轮询
+	var notify chan fsnotify.Event
+	var errs chan error
+	poll := true
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		added := 0
+		for _, dir := range c.watchDirs() {
+			if watcher.Add(dir) == nil {
+				added++
+			}
+		}
+		if added > 0 {
+			notify, errs = watcher.Events, watcher.Errors
+			poll = added < len(c.watchDirs())
+		} else {
+			_ = watcher.Close()
+			watcher = nil
+		}
+	}
+
+	// wait 等待文件变化、下一条记录过期或轮询时间到达
+	wait := func(ctx context.Context, next time.Time) bool {
+		for {
+			d := defaultPollInterval
+			if !poll {
+				d = time.Hour
+			}
+			if !next.IsZero() && time.Until(next) < d {
+				d = time.Until(next)
+			}
+
+			timer := time.NewTimer(d)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return false
+			case ev, ok := <-notify:
+				timer.Stop()
+				if !ok {
+					notify, errs, poll = nil, nil, true
+					continue
+				}
+				if !c.isWatched(ev.Name) {
+					continue
+				}
+				// 一次写文件会产生多个事件，等待事件平静后再加载，避免读到写了一半的文件
+				return debounce(ctx, notify)
+			case _, ok := <-errs:
+				// 事件队列溢出等错误可能丢失事件，立即重新加载，之后改为定时轮询
+				timer.Stop()
+				if !ok {
+					notify, errs = nil, nil
+				}
+				poll = true
+				return true
+			case <-timer.C:
+				return true
+			}
+		}
+	}
+
+	p := &backend.Poller{
+		Load: func(ctx context.Context) (map[string]*backend.KeyValue, int64, func(ctx context.Context) bool, error) {
+			kvs, rev, next, err := c.load(prefix)
+			if err != nil {
+				return nil, 0, nil, err
+			}
+			return kvs, rev, func(ctx context.Context) bool {
+				return wait(ctx, next)
+			}, nil
+		},
+		Retry: defaultPollInterval,
+		Done:  c.done,
+	}
+	if watcher != nil {
+		p.Close = func() {
+			_ = watcher.Close()
+		}
+	}
+	return p.Watch(ctx, rev)
+}
+
+// debounce 持续丢弃文件事件，直到defaultDebounce时间内没有新事件，ctx取消时返回false
+func debounce(ctx context.Context, notify chan fsnotify.Event) bool {
+	timer := time.NewTimer(defaultDebounce)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-notify:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(defaultDebounce)
+		case <-timer.C:
+			return true
+		}
+	}
+}
+
+// Close 关闭后端，结束所有租约保持与监听，已写入的记录按TTL过期
+func (c *Backend) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+
+	for _, l := range c.leases {
+		for _, one := range l.keeper {
+			close(one)
+		}
+		l.keeper = nil
+	}
+	return nil
+}
+
+func (c *Backend) isClosed() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.closed
+}
+
+// files 获取需要读取的所有服务信息文件
+func (c *Backend) files() ([]string, error) {
+	var files []string
+	if c.dir {
+		infos, err := ioutil.ReadDir(c.cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+		for _, one := range infos {
+			if !one.IsDir() && isServiceFile(one.Name()) {
+				files = append(files, filepath.Join(c.cfg.Path, one.Name()))
+			}
+		}
+	} else {
+		files = append(files, c.cfg.Path)
+	}
+
+	for _, one := range files {
+		if one == c.writeFile {
+			return files, nil
+		}
+	}
+	return append(files, c.writeFile), nil
+}
+
+func (c *Backend) watchDirs() []string {
+	dirs := []string{filepath.Dir(c.writeFile)}
+	if c.dir {
+		dirs = append(dirs, c.cfg.Path)
+	} else {
+		dirs = append(dirs, filepath.Dir(c.cfg.Path))
+	}
+
+	if filepath.Clean(dirs[0]) == filepath.Clean(dirs[1]) {
+		return dirs[:1]
+	}
+	return dirs
+}
+
+func (c *Backend) isWatched(name string) bool {
+	name = filepath.Clean(name)
+	if name == filepath.Clean(c.writeFile) || name == filepath.Clean(c.cfg.Path) {
+		return true
+	}
+	return c.dir && filepath.Dir(name) == filepath.Clean(c.cfg.Path) && isServiceFile(name)
+}
+
+// load 读取所有文件中前缀匹配且未过期的记录，同时返回最后修改时间与最近的过期时间
+func (c *Backend) load(prefix string) (map[string]*backend.KeyValue, int64, time.Time, error) {
+	files, err := c.files()
+	if err != nil {
+		return nil, 0, time.Time{}, err
+	}
+
+	var rev int64
+	if c.dir {
+		if info, err := os.Stat(c.cfg.Path); err == nil {
+			rev = info.ModTime().UnixNano()
+		}
+	}
+
+	now := time.Now()
+	var next time.Time
+	ret := make(map[string]*backend.KeyValue)
+	for _, one := range files {
+		list, modTime, err := readFile(one)
+		if err != nil {
+			return nil, 0, time.Time{}, err
+		}
+
+		if modTime.UnixNano() > rev {
+			rev = modTime.UnixNano()
+		}
+
+		for _, e := range list {
+			if e.expired(now) {
+				continue
+			}
+
+			if e.ExpireAt != nil && (next.IsZero() || e.ExpireAt.Before(next)) {
+				next = *e.ExpireAt
+			}
+
+			key := c.entryKey(e)
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+
+			val, err := json.Marshal(&e.Service)
+			if err != nil {
+				return nil, 0, time.Time{}, err
+			}
+			ret[key] = &backend.KeyValue{
+				Key:         []byte(key),
+				Value:       val,
+				ModRevision: modTime.UnixNano(),
+			}
+		}
+	}
+	return ret, rev, next, nil
+}
+
+func (c *Backend) entryKey(e *entry) string {
+	return c.cfg.Prefix + e.Name + "/" + e.ID
+}
+
+func (c *Backend) parseKey(key string) (string, string, error) {
+	key = strings.TrimPrefix(key, c.cfg.Prefix)
+	index := strings.LastIndex(key, "/")
+	if index <= 0 || index == len(key)-1 {
+		return "", "", ErrInvalidKey
+	}
+	return key[:index], key[index+1:], nil
+}
@@ -0,0 +1,269 @@
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuanzhangcai/srsd/backend"
+	"github.com/yuanzhangcai/srsd/discovery"
+	"github.com/yuanzhangcai/srsd/registry"
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+var testJSON = `[
+	{"id": "1", "name": "zacyuan.com", "host": "127.0.0.1:4001", "version": "v1"},
+	{"id": "2", "name": "zacyuan.com", "host": "127.0.0.1:4002", "metadata": {"zone": "sh"}}
+]`
+
+var testYAML = `
+id: "3"
+name: other.com
+host: 127.0.0.1:4003
+metadata:
+  zone: bj
+`
+
+func newTestDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "srsd-file")
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "a.json"), []byte(testJSON), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "b.yaml"), []byte(testYAML), 0644))
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "c.txt"), []byte("ignore"), 0644))
+	return dir
+}
+
+func newTestValue(name, id, host string) string {
+	srv := service.NewService()
+	srv.ID = id
+	srv.Name = name
+	srv.Host = host
+	val, _ := json.Marshal(srv)
+	return string(val)
+}
+
+func TestNewBackend(t *testing.T) {
+	_, err := NewBackend(Config{})
+	assert.NotNil(t, err)
+
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := NewBackend(Config{Path: dir, Prefix: "/zacyuan/test"})
+	assert.Nil(t, err)
+	assert.True(t, b.dir)
+	assert.Equal(t, filepath.Join(dir, defaultWriteFile), b.writeFile)
+	assert.Equal(t, "/zacyuan/test/", b.cfg.Prefix)
+
+	b, err = NewBackend(Config{Path: filepath.Join(dir, "a.json")})
+	assert.Nil(t, err)
+	assert.False(t, b.dir)
+	assert.Equal(t, filepath.Join(dir, "a.json"), b.writeFile)
+}
+
+func TestGet(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := NewBackend(Config{Path: dir})
+	assert.Nil(t, err)
+	defer b.Close()
+
+	resp, err := b.Get(context.Background(), "/srsd/services/")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(resp.Kvs))
+	assert.Less(t, int64(0), resp.Revision)
+
+	resp, err = b.Get(context.Background(), "/srsd/services/other.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(resp.Kvs))
+	assert.Equal(t, "/srsd/services/other.com/3", string(resp.Kvs[0].Key))
+
+	srv := &service.Service{}
+	assert.Nil(t, json.Unmarshal(resp.Kvs[0].Value, srv))
+	assert.Equal(t, "127.0.0.1:4003", srv.Host)
+	assert.Equal(t, "bj", srv.Metadata["zone"])
+}
+
+func TestPutDelete(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := NewBackend(Config{Path: dir})
+	assert.Nil(t, err)
+	defer b.Close()
+	ctx := context.Background()
+
+	err = b.Put(ctx, "/srsd/services/zacyuan.com", "{}", backend.NoLease)
+	assert.Equal(t, ErrInvalidKey, err)
+
+	err = b.Put(ctx, "/srsd/services/zacyuan.com/4", newTestValue("zacyuan.com", "4", "127.0.0.1:4004"), backend.NoLease)
+	assert.Nil(t, err)
+	resp, err := b.Get(ctx, "/srsd/services/zacyuan.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(resp.Kvs))
+
+	list, _, err := readFile(filepath.Join(dir, defaultWriteFile))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(list))
+	assert.Nil(t, list[0].ExpireAt)
+
+	assert.Nil(t, b.Delete(ctx, "/srsd/services/zacyuan.com/4"))
+	resp, err = b.Get(ctx, "/srsd/services/zacyuan.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(resp.Kvs))
+}
+
+func TestLease(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := NewBackend(Config{Path: dir})
+	assert.Nil(t, err)
+	defer b.Close()
+	ctx := context.Background()
+
+	t.Run("ttl expire", func(t *testing.T) {
+		id, err := b.Grant(ctx, 1)
+		assert.Nil(t, err)
+		err = b.Put(ctx, "/srsd/services/zacyuan.com/4", newTestValue("zacyuan.com", "4", "127.0.0.1:4004"), id)
+		assert.Nil(t, err)
+
+		time.Sleep(1100 * time.Millisecond)
+		resp, err := b.Get(ctx, "/srsd/services/zacyuan.com")
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(resp.Kvs))
+	})
+
+	t.Run("keepalive", func(t *testing.T) {
+		id, err := b.Grant(ctx, 1)
+		assert.Nil(t, err)
+		err = b.Put(ctx, "/srsd/services/zacyuan.com/5", newTestValue("zacyuan.com", "5", "127.0.0.1:4005"), id)
+		assert.Nil(t, err)
+		ch, err := b.KeepAlive(ctx, id)
+		assert.Nil(t, err)
+
+		time.Sleep(1500 * time.Millisecond)
+		resp, err := b.Get(ctx, "/srsd/services/zacyuan.com")
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(resp.Kvs))
+
+		// 记录被其他进程删除后，租约过期
+		assert.Nil(t, writeFile(b.writeFile, nil))
+		select {
+		case _, ok := <-ch:
+			assert.False(t, ok)
+		case <-time.After(2 * time.Second):
+			t.Fatal("keepalive channel not closed")
+		}
+	})
+
+	t.Run("revoke", func(t *testing.T) {
+		id, err := b.Grant(ctx, 10)
+		assert.Nil(t, err)
+		err = b.Put(ctx, "/srsd/services/zacyuan.com/6", newTestValue("zacyuan.com", "6", "127.0.0.1:4006"), id)
+		assert.Nil(t, err)
+		assert.Nil(t, b.Revoke(ctx, id))
+		assert.Equal(t, ErrLeaseNotFound, b.Revoke(ctx, id))
+		resp, err := b.Get(ctx, "/srsd/services/zacyuan.com")
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(resp.Kvs))
+	})
+}
+
+func TestWatch(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := NewBackend(Config{Path: dir})
+	assert.Nil(t, err)
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := b.Watch(ctx, "/srsd/services/other.com", 0)
+
+	data := `[{"id": "3", "name": "other.com", "host": "127.0.0.1:4003"}, {"id": "4", "name": "other.com", "host": "127.0.0.1:4004"}]`
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "b.yaml"), []byte(data), 0644))
+	resp := <-ch
+	assert.Equal(t, 2, len(resp.Events))
+	assert.Equal(t, backend.EventPut, resp.Events[0].Type)
+	assert.Equal(t, "/srsd/services/other.com/3", string(resp.Events[0].Kv.Key))
+
+	assert.Nil(t, os.Remove(filepath.Join(dir, "b.yaml")))
+	resp = <-ch
+	assert.Equal(t, 2, len(resp.Events))
+	assert.Equal(t, backend.EventDelete, resp.Events[0].Type)
+
+	// 记录过期时产生DELETE事件
+	id, err := b.Grant(ctx, 1)
+	assert.Nil(t, err)
+	err = b.Put(ctx, "/srsd/services/other.com/5", newTestValue("other.com", "5", "127.0.0.1:4005"), id)
+	assert.Nil(t, err)
+	resp = <-ch
+	assert.Equal(t, backend.EventPut, resp.Events[0].Type)
+	resp = <-ch
+	assert.Equal(t, backend.EventDelete, resp.Events[0].Type)
+	assert.Equal(t, "/srsd/services/other.com/5", string(resp.Events[0].Kv.Key))
+}
+
+func TestWatchMissingDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srsd-file")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// 目录不存在时无法使用inotify，定时轮询
+	path := filepath.Join(dir, "sub", "a.json")
+	b, err := NewBackend(Config{Path: path})
+	assert.Nil(t, err)
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := b.Watch(ctx, "/srsd/services/zacyuan.com", 0)
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	assert.Nil(t, ioutil.WriteFile(path, []byte(testJSON), 0644))
+
+	select {
+	case resp := <-ch:
+		assert.Equal(t, 2, len(resp.Events))
+		assert.Equal(t, backend.EventPut, resp.Events[0].Type)
+	case <-time.After(3 * time.Second):
+		t.Fatal("no event after directory created")
+	}
+}
+
+func TestRegistryDiscovery(t *testing.T) {
+	dir := newTestDir(t)
+	defer os.RemoveAll(dir)
+
+	b, err := NewBackend(Config{Path: dir})
+	assert.Nil(t, err)
+	defer b.Close()
+
+	dis := discovery.NewDiscovery(discovery.Backend(b))
+	err = dis.Start("")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(dis.GetAll("zacyuan.com")))
+	assert.NotNil(t, dis.Select("other.com"))
+
+	info := service.NewService()
+	info.Name = "zacyuan.com"
+	info.Host = "127.0.0.1:4009"
+	reg := registry.NewRegistry(info, registry.Backend(b), registry.TTL(2*time.Second))
+	err = reg.Start()
+	assert.Nil(t, err)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 3, len(dis.GetAll("zacyuan.com")))
+
+	err = reg.Stop()
+	assert.Nil(t, err)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 2, len(dis.GetAll("zacyuan.com")))
+	_ = dis.Stop()
+}
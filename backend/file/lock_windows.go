@@ -0,0 +1,19 @@
+// +build windows
+
+package file
+
+import (
+	"os"
+)
+
+// lockFile windows下只创建锁文件，跨进程互斥由调用方保证，进程内互斥由Backend的锁保证
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		_ = f.Close()
+	}, nil
+}
@@ -0,0 +1,139 @@
+package file
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/yuanzhangcai/srsd/service"
+	"gopkg.in/yaml.v3"
+)
+
+// entry 文件中的一条服务信息，字段与service.Service一致，
+// 通过registry写入的记录额外带有过期时间，过期后视为已删除
+type entry struct {
+	service.Service
+	ExpireAt *time.Time `json:"expire_at,omitempty"`
+}
+
+func (c *entry) expired(now time.Time) bool {
+	return c.ExpireAt != nil && !now.Before(*c.ExpireAt)
+}
+
+// isServiceFile 是否为服务信息文件，隐藏文件(锁文件、临时文件)被忽略
+func isServiceFile(name string) bool {
+	if strings.HasPrefix(filepath.Base(name), ".") {
+		return false
+	}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// readFile 读取服务信息文件，文件内容可以是单个服务或服务列表，格式为JSON或YAML
+func readFile(path string) ([]*entry, time.Time, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, info.ModTime(), nil
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".yaml" || ext == ".yml" {
+		data, err = yamlToJSON(data)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+
+	var list []*entry
+	if data[0] == '[' {
+		err = json.Unmarshal(data, &list)
+	} else {
+		one := &entry{}
+		err = json.Unmarshal(data, one)
+		list = append(list, one)
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return list, info.ModTime(), nil
+}
+
+// writeFile 原子写入服务信息文件，先写临时文件再重命名
+func writeFile(path string, list []*entry) error {
+	if list == nil {
+		list = []*entry{}
+	}
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func yamlToJSON(data []byte) ([]byte, error) {
+	var v interface{}
+	err := yaml.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(convertYAML(v))
+}
+
+// convertYAML 将YAML解析结果中的map[interface{}]interface{}转换为可JSON序列化的类型
+func convertYAML(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k, one := range val {
+			val[k] = convertYAML(one)
+		}
+		return val
+	case map[interface{}]interface{}:
+		ret := make(map[string]interface{}, len(val))
+		for k, one := range val {
+			ret[toString(k)] = convertYAML(one)
+		}
+		return ret
+	case []interface{}:
+		for i, one := range val {
+			val[i] = convertYAML(one)
+		}
+		return val
+	}
+	return v
+}
+
+func toString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
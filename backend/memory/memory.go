@@ -0,0 +1,397 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuanzhangcai/srsd/backend"
+)
+
+var (
+	// ErrClosed 后端已关闭
+	ErrClosed = errors.New("memory: backend closed")
+	// ErrLeaseNotFound 租约不存在或已过期
+	ErrLeaseNotFound = errors.New("memory: lease not found")
+	// ErrWatchDropped 监听被主动断开
+	ErrWatchDropped = errors.New("memory: watch stream dropped")
+)
+
+// Backend 进程内存储后端，模拟etcd的租约、TTL过期、前缀监听与版本号，主要用于测试
+type Backend struct {
+	m         sync.Mutex
+	rev       int64
+	nextLease backend.LeaseID
+	kvs       map[string]*backend.KeyValue
+	leases    map[backend.LeaseID]*lease
+	watchers  map[*watcher]struct{}
+	history   []*backend.Event
+	compacted int64
+	closed    bool
+}
+
+type lease struct {
+	id     backend.LeaseID
+	ttl    time.Duration
+	timer  *time.Timer
+	keys   map[string]struct{}
+	keeper []chan struct{}
+}
+
+// NewBackend 创建进程内存储后端
+func NewBackend() *Backend {
+	return &Backend{
+		kvs:      make(map[string]*backend.KeyValue),
+		leases:   make(map[backend.LeaseID]*lease),
+		watchers: make(map[*watcher]struct{}),
+	}
+}
+
+// Grant 创建租约
+func (c *Backend) Grant(ctx context.Context, ttl int64) (backend.LeaseID, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return backend.NoLease, ErrClosed
+	}
+
+	c.nextLease++
+	l := &lease{
+		id:   c.nextLease,
+		ttl:  time.Duration(ttl) * time.Second,
+		keys: make(map[string]struct{}),
+	}
+	l.timer = time.AfterFunc(l.ttl, func() {
+		_ = c.ExpireLease(l.id)
+	})
+	c.leases[l.id] = l
+	return l.id, nil
+}
+
+// KeepAlive 保持租约，每隔TTL的三分之一续约一次
+func (c *Backend) KeepAlive(ctx context.Context, id backend.LeaseID) (<-chan struct{}, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	l, ok := c.leases[id]
+	if !ok {
+		return nil, ErrLeaseNotFound
+	}
+
+	done := make(chan struct{})
+	l.keeper = append(l.keeper, done)
+
+	interval := l.ttl / 3
+	if interval <= 0 {
+		interval = time.Millisecond
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				c.stopKeeper(id, done)
+				return
+			case <-ticker.C:
+				c.refresh(id)
+			}
+		}
+	}()
+	return done, nil
+}
+
+func (c *Backend) refresh(id backend.LeaseID) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if l, ok := c.leases[id]; ok {
+		l.timer.Reset(l.ttl)
+	}
+}
+
+func (c *Backend) stopKeeper(id backend.LeaseID, done chan struct{}) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	l, ok := c.leases[id]
+	if !ok {
+		return
+	}
+
+	for i, one := range l.keeper {
+		if one == done {
+			l.keeper = append(l.keeper[:i], l.keeper[i+1:]...)
+			close(done)
+			return
+		}
+	}
+}
+
+// Revoke 撤销租约
+func (c *Backend) Revoke(ctx context.Context, id backend.LeaseID) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	if _, ok := c.leases[id]; !ok {
+		return ErrLeaseNotFound
+	}
+	c.removeLease(id)
+	return nil
+}
+
+// ExpireLease 立即让租约过期，租约下的键值被删除，KeepAlive返回的channel被关闭
+func (c *Backend) ExpireLease(id backend.LeaseID) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if _, ok := c.leases[id]; !ok {
+		return ErrLeaseNotFound
+	}
+	c.removeLease(id)
+	return nil
+}
+
+func (c *Backend) removeLease(id backend.LeaseID) {
+	l := c.leases[id]
+	delete(c.leases, id)
+	l.timer.Stop()
+
+	keys := make([]string, 0, len(l.keys))
+	for key := range l.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		c.delete(key)
+	}
+
+	for _, one := range l.keeper {
+		close(one)
+	}
+	l.keeper = nil
+}
+
+// Leases 获取所有未过期的租约
+func (c *Backend) Leases() []backend.LeaseID {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	list := make([]backend.LeaseID, 0, len(c.leases))
+	for id := range c.leases {
+		list = append(list, id)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list
+}
+
+// Revision 获取当前存储版本
+func (c *Backend) Revision() int64 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.rev
+}
+
+// Put 写入键值
+func (c *Backend) Put(ctx context.Context, key, value string, id backend.LeaseID) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	var l *lease
+	if id != backend.NoLease {
+		var ok bool
+		l, ok = c.leases[id]
+		if !ok {
+			return ErrLeaseNotFound
+		}
+	}
+
+	if old, ok := c.kvs[key]; ok && old.Lease != id {
+		if one, ok := c.leases[old.Lease]; ok {
+			delete(one.keys, key)
+		}
+	}
+
+	c.rev++
+	kv := &backend.KeyValue{
+		Key:         []byte(key),
+		Value:       []byte(value),
+		Lease:       id,
+		ModRevision: c.rev,
+	}
+	c.kvs[key] = kv
+	if l != nil {
+		l.keys[key] = struct{}{}
+	}
+
+	c.notify(&backend.Event{Type: backend.EventPut, Kv: kv})
+	return nil
+}
+
+// Delete 删除键值
+func (c *Backend) Delete(ctx context.Context, key string) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	c.delete(key)
+	return nil
+}
+
+func (c *Backend) delete(key string) {
+	old, ok := c.kvs[key]
+	if !ok {
+		return
+	}
+
+	delete(c.kvs, key)
+	if l, ok := c.leases[old.Lease]; ok {
+		delete(l.keys, key)
+	}
+
+	c.rev++
+	c.notify(&backend.Event{
+		Type: backend.EventDelete,
+		Kv:   &backend.KeyValue{Key: old.Key, ModRevision: c.rev},
+	})
+}
+
+// Get 按前缀查询键值
+func (c *Backend) Get(ctx context.Context, prefix string) (*backend.GetResponse, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	resp := &backend.GetResponse{Revision: c.rev}
+	for key, kv := range c.kvs {
+		if strings.HasPrefix(key, prefix) {
+			resp.Kvs = append(resp.Kvs, kv)
+		}
+	}
+	sort.Slice(resp.Kvs, func(i, j int) bool {
+		return string(resp.Kvs[i].Key) < string(resp.Kvs[j].Key)
+	})
+	return resp, nil
+}
+
+// Watch 按前缀监听键值变化
+func (c *Backend) Watch(ctx context.Context, prefix string, rev int64) <-chan *backend.WatchResponse {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	w := newWatcher(ctx, prefix)
+	if c.closed {
+		w.drop(&backend.WatchResponse{Revision: c.rev, Canceled: true, Err: ErrClosed})
+		return w.ch
+	}
+
+	if rev > 0 && rev < c.compacted {
+		w.drop(&backend.WatchResponse{Revision: c.rev, Canceled: true, CompactRevision: c.compacted, Err: backend.ErrCompacted})
+		return w.ch
+	}
+
+	c.watchers[w] = struct{}{}
+	if rev > 0 {
+		for _, ev := range c.history {
+			if ev.Kv.ModRevision >= rev {
+				w.push(ev)
+			}
+		}
+	}
+
+	go func() {
+		<-w.done
+		c.m.Lock()
+		delete(c.watchers, w)
+		c.m.Unlock()
+	}()
+	return w.ch
+}
+
+// Compact 压缩历史版本，之后从小于rev的版本开始监听会收到ErrCompacted
+func (c *Backend) Compact(rev int64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if rev > c.rev+1 {
+		rev = c.rev + 1
+	}
+	if rev <= c.compacted {
+		return
+	}
+	c.compacted = rev
+
+	i := 0
+	for i < len(c.history) && c.history[i].Kv.ModRevision < rev {
+		i++
+	}
+	c.history = append([]*backend.Event{}, c.history[i:]...)
+}
+
+// DropWatches 断开所有监听，监听方会收到一个带ErrWatchDropped的响应，随后channel被关闭
+func (c *Backend) DropWatches() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for w := range c.watchers {
+		w.drop(&backend.WatchResponse{Revision: c.rev, Canceled: true, Err: ErrWatchDropped})
+		delete(c.watchers, w)
+	}
+}
+
+func (c *Backend) notify(ev *backend.Event) {
+	c.history = append(c.history, ev)
+	for w := range c.watchers {
+		w.push(ev)
+	}
+}
+
+// Close 关闭后端，所有租约保持和监听都会结束
+func (c *Backend) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+
+	for _, l := range c.leases {
+		l.timer.Stop()
+		for _, one := range l.keeper {
+			close(one)
+		}
+		l.keeper = nil
+	}
+
+	for w := range c.watchers {
+		w.drop(&backend.WatchResponse{Revision: c.rev, Canceled: true, Err: ErrClosed})
+		delete(c.watchers, w)
+	}
+	return nil
+}
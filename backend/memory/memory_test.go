@@ -0,0 +1,189 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuanzhangcai/srsd/backend"
+)
+
+func TestPutGetDelete(t *testing.T) {
+	b := NewBackend()
+	defer b.Close()
+	ctx := context.Background()
+
+	assert.Nil(t, b.Put(ctx, "/srsd/a/1", "a1", backend.NoLease))
+	assert.Nil(t, b.Put(ctx, "/srsd/a/2", "a2", backend.NoLease))
+	assert.Nil(t, b.Put(ctx, "/srsd/b/1", "b1", backend.NoLease))
+
+	resp, err := b.Get(ctx, "/srsd/a")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(resp.Kvs))
+	assert.Equal(t, "/srsd/a/1", string(resp.Kvs[0].Key))
+	assert.Equal(t, int64(3), resp.Revision)
+
+	assert.Nil(t, b.Delete(ctx, "/srsd/a/1"))
+	resp, err = b.Get(ctx, "/srsd/a")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(resp.Kvs))
+	assert.Equal(t, int64(4), b.Revision())
+}
+
+func TestLease(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("put with unknown lease", func(t *testing.T) {
+		b := NewBackend()
+		defer b.Close()
+		err := b.Put(ctx, "/srsd/a/1", "a1", 100)
+		assert.Equal(t, ErrLeaseNotFound, err)
+	})
+
+	t.Run("ttl expire", func(t *testing.T) {
+		b := NewBackend()
+		defer b.Close()
+		id, err := b.Grant(ctx, 1)
+		assert.Nil(t, err)
+		assert.Nil(t, b.Put(ctx, "/srsd/a/1", "a1", id))
+
+		time.Sleep(1500 * time.Millisecond)
+		resp, err := b.Get(ctx, "/srsd/a")
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(resp.Kvs))
+		assert.Equal(t, 0, len(b.Leases()))
+	})
+
+	t.Run("keepalive", func(t *testing.T) {
+		b := NewBackend()
+		defer b.Close()
+		id, err := b.Grant(ctx, 1)
+		assert.Nil(t, err)
+		assert.Nil(t, b.Put(ctx, "/srsd/a/1", "a1", id))
+		ch, err := b.KeepAlive(ctx, id)
+		assert.Nil(t, err)
+
+		time.Sleep(1500 * time.Millisecond)
+		resp, err := b.Get(ctx, "/srsd/a")
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(resp.Kvs))
+
+		assert.Nil(t, b.ExpireLease(id))
+		_, ok := <-ch
+		assert.False(t, ok)
+		resp, err = b.Get(ctx, "/srsd/a")
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(resp.Kvs))
+	})
+
+	t.Run("keepalive cancel", func(t *testing.T) {
+		b := NewBackend()
+		defer b.Close()
+		id, err := b.Grant(ctx, 10)
+		assert.Nil(t, err)
+		kCtx, cancel := context.WithCancel(ctx)
+		ch, err := b.KeepAlive(kCtx, id)
+		assert.Nil(t, err)
+		cancel()
+		_, ok := <-ch
+		assert.False(t, ok)
+	})
+
+	t.Run("revoke", func(t *testing.T) {
+		b := NewBackend()
+		defer b.Close()
+		id, err := b.Grant(ctx, 10)
+		assert.Nil(t, err)
+		assert.Nil(t, b.Put(ctx, "/srsd/a/1", "a1", id))
+		assert.Nil(t, b.Revoke(ctx, id))
+		assert.Equal(t, ErrLeaseNotFound, b.Revoke(ctx, id))
+		resp, err := b.Get(ctx, "/srsd/a")
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(resp.Kvs))
+	})
+}
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Run("prefix", func(t *testing.T) {
+		b := NewBackend()
+		defer b.Close()
+		ch := b.Watch(ctx, "/srsd/a", 0)
+		assert.Nil(t, b.Put(ctx, "/srsd/b/1", "b1", backend.NoLease))
+		assert.Nil(t, b.Put(ctx, "/srsd/a/1", "a1", backend.NoLease))
+		assert.Nil(t, b.Delete(ctx, "/srsd/a/1"))
+
+		resp := <-ch
+		assert.Equal(t, backend.EventPut, resp.Events[0].Type)
+		assert.Equal(t, "a1", string(resp.Events[0].Kv.Value))
+		assert.Equal(t, int64(2), resp.Revision)
+
+		resp = <-ch
+		assert.Equal(t, backend.EventDelete, resp.Events[0].Type)
+		assert.Equal(t, "/srsd/a/1", string(resp.Events[0].Kv.Key))
+	})
+
+	t.Run("from revision", func(t *testing.T) {
+		b := NewBackend()
+		defer b.Close()
+		assert.Nil(t, b.Put(ctx, "/srsd/a/1", "a1", backend.NoLease))
+		assert.Nil(t, b.Put(ctx, "/srsd/a/2", "a2", backend.NoLease))
+		ch := b.Watch(ctx, "/srsd/a", 2)
+		resp := <-ch
+		assert.Equal(t, "a2", string(resp.Events[0].Kv.Value))
+	})
+
+	t.Run("compacted", func(t *testing.T) {
+		b := NewBackend()
+		defer b.Close()
+		assert.Nil(t, b.Put(ctx, "/srsd/a/1", "a1", backend.NoLease))
+		assert.Nil(t, b.Put(ctx, "/srsd/a/2", "a2", backend.NoLease))
+		assert.Nil(t, b.Put(ctx, "/srsd/a/3", "a3", backend.NoLease))
+		b.Compact(3)
+
+		ch := b.Watch(ctx, "/srsd/a", 2)
+		resp := <-ch
+		assert.Equal(t, backend.ErrCompacted, resp.Err)
+		assert.Equal(t, int64(3), resp.CompactRevision)
+		_, ok := <-ch
+		assert.False(t, ok)
+
+		ch = b.Watch(ctx, "/srsd/a", 3)
+		resp = <-ch
+		assert.Nil(t, resp.Err)
+		assert.Equal(t, "a3", string(resp.Events[0].Kv.Value))
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		b := NewBackend()
+		defer b.Close()
+		ch := b.Watch(ctx, "/srsd/a", 0)
+		b.DropWatches()
+		resp := <-ch
+		assert.Equal(t, ErrWatchDropped, resp.Err)
+		_, ok := <-ch
+		assert.False(t, ok)
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		b := NewBackend()
+		defer b.Close()
+		wCtx, wCancel := context.WithCancel(ctx)
+		ch := b.Watch(wCtx, "/srsd/a", 0)
+		wCancel()
+		_, ok := <-ch
+		assert.False(t, ok)
+	})
+
+	t.Run("close", func(t *testing.T) {
+		b := NewBackend()
+		ch := b.Watch(ctx, "/srsd/a", 0)
+		assert.Nil(t, b.Close())
+		resp := <-ch
+		assert.Equal(t, ErrClosed, resp.Err)
+		assert.Equal(t, ErrClosed, b.Put(ctx, "/srsd/a/1", "a1", backend.NoLease))
+	})
+}
@@ -0,0 +1,114 @@
+package memory
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/yuanzhangcai/srsd/backend"
+)
+
+// watcher 单个前缀监听，事件先进入无界队列再由独立协程投递，避免阻塞写入方
+type watcher struct {
+	ctx    context.Context
+	prefix string
+	ch     chan *backend.WatchResponse
+	signal chan struct{}
+	done   chan struct{}
+
+	m       sync.Mutex
+	queue   []*backend.WatchResponse
+	final   *backend.WatchResponse
+	dropped bool
+}
+
+func newWatcher(ctx context.Context, prefix string) *watcher {
+	w := &watcher{
+		ctx:    ctx,
+		prefix: prefix,
+		ch:     make(chan *backend.WatchResponse),
+		signal: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (c *watcher) push(ev *backend.Event) {
+	if !strings.HasPrefix(string(ev.Kv.Key), c.prefix) {
+		return
+	}
+
+	c.m.Lock()
+	if !c.dropped {
+		c.queue = append(c.queue, &backend.WatchResponse{
+			Revision: ev.Kv.ModRevision,
+			Events:   []*backend.Event{ev},
+		})
+	}
+	c.m.Unlock()
+	c.wakeup()
+}
+
+func (c *watcher) drop(resp *backend.WatchResponse) {
+	c.m.Lock()
+	if !c.dropped {
+		c.dropped = true
+		c.final = resp
+	}
+	c.m.Unlock()
+	c.wakeup()
+}
+
+func (c *watcher) wakeup() {
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (c *watcher) run() {
+	defer close(c.done)
+	defer close(c.ch)
+
+	for {
+		c.m.Lock()
+		queue := c.queue
+		c.queue = nil
+		dropped := c.dropped
+		final := c.final
+		c.m.Unlock()
+
+		for _, resp := range queue {
+			if !c.send(resp) {
+				return
+			}
+		}
+
+		if len(queue) > 0 {
+			continue
+		}
+
+		if dropped {
+			if final != nil {
+				c.send(final)
+			}
+			return
+		}
+
+		select {
+		case <-c.signal:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *watcher) send(resp *backend.WatchResponse) bool {
+	select {
+	case c.ch <- resp:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
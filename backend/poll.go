@@ -0,0 +1,107 @@
+package backend
+
+import (
+	"context"
+	"time"
+)
+
+// Poller 轮询式监听，供不支持原生监听的后端实现Watch。
+// 每次查询全量记录，与上一次结果对比后生成PUT/DELETE事件，各后端只需提供查询与等待变化的方法
+type Poller struct {
+	// Load 查询当前的全部记录与版本，同时返回等待下一次变化的方法，该方法在可能发生变化时返回true，ctx取消时返回false
+	Load  func(ctx context.Context) (kvs map[string]*KeyValue, rev int64, next func(ctx context.Context) bool, err error)
+	Retry time.Duration   // Load失败后的重试间隔
+	Done  <-chan struct{} // 后端关闭时结束监听
+	Close func()          // 监听结束时调用，释放监听使用的资源，可以为空
+}
+
+// Watch 开始轮询监听。监听基准在返回前同步获取，rev大于0且基准版本不小于rev时，基准中的记录会先以PUT事件推送；
+// 基准获取失败时，之后第一次查询到的记录全部作为PUT事件推送。ctx取消或Done关闭时结束监听并关闭返回的channel
+func (c *Poller) Watch(ctx context.Context, rev int64) <-chan *WatchResponse {
+	ch := make(chan *WatchResponse)
+
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-c.Done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	last, index, next, err := c.Load(ctx)
+	if err != nil {
+		last = nil
+	}
+
+	var pending []*Event
+	if last != nil && rev > 0 && index >= rev {
+		pending = Diff(map[string]*KeyValue{}, last)
+	}
+
+	go func() {
+		defer close(ch)
+		defer cancel()
+		if c.Close != nil {
+			defer c.Close()
+		}
+
+		if len(pending) > 0 {
+			select {
+			case ch <- &WatchResponse{Revision: index, Events: pending}:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		for {
+			if err != nil {
+				if !sleep(ctx, c.Retry) {
+					return
+				}
+			} else if !next(ctx) {
+				return
+			}
+
+			var kvs map[string]*KeyValue
+			var n func(ctx context.Context) bool
+			kvs, index, n, err = c.Load(ctx)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				continue
+			}
+			next = n
+
+			if last == nil {
+				last = map[string]*KeyValue{}
+			}
+
+			events := Diff(last, kvs)
+			last = kvs
+			if len(events) == 0 {
+				continue
+			}
+
+			select {
+			case ch <- &WatchResponse{Revision: index, Events: events}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// sleep 等待d时间，ctx取消时返回false
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,97 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoller(t *testing.T) {
+	loads := make(chan map[string]*KeyValue, 10)
+	changes := make(chan struct{}, 10)
+	var closed int
+	done := make(chan struct{})
+
+	next := func(ctx context.Context) bool {
+		select {
+		case <-changes:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+	p := &Poller{
+		Load: func(ctx context.Context) (map[string]*KeyValue, int64, func(ctx context.Context) bool, error) {
+			kvs := <-loads
+			if kvs == nil {
+				return nil, 0, nil, errors.New("load failed")
+			}
+			return kvs, int64(len(kvs)), next, nil
+		},
+		Retry: 10 * time.Millisecond,
+		Done:  done,
+		Close: func() { closed++ },
+	}
+
+	// 基准版本不小于rev时先推送基准
+	loads <- map[string]*KeyValue{"/a/1": {Key: []byte("/a/1"), Value: []byte("1")}}
+	ch := p.Watch(context.Background(), 1)
+	resp := <-ch
+	assert.Equal(t, int64(1), resp.Revision)
+	assert.Equal(t, 1, len(resp.Events))
+	assert.Equal(t, EventPut, resp.Events[0].Type)
+
+	// 发生变化后推送差异
+	loads <- map[string]*KeyValue{"/a/2": {Key: []byte("/a/2"), Value: []byte("2")}}
+	changes <- struct{}{}
+	resp = <-ch
+	assert.Equal(t, 2, len(resp.Events))
+	assert.Equal(t, EventDelete, resp.Events[0].Type)
+	assert.Equal(t, "/a/1", string(resp.Events[0].Kv.Key))
+	assert.Equal(t, EventPut, resp.Events[1].Type)
+	assert.Equal(t, "/a/2", string(resp.Events[1].Kv.Key))
+
+	// 查询失败后按Retry重试，无需等待变化
+	loads <- nil
+	loads <- map[string]*KeyValue{}
+	changes <- struct{}{}
+	resp = <-ch
+	assert.Equal(t, 1, len(resp.Events))
+	assert.Equal(t, EventDelete, resp.Events[0].Type)
+
+	// 后端关闭时结束监听
+	close(done)
+	_, ok := <-ch
+	assert.False(t, ok)
+	assert.Equal(t, 1, closed)
+}
+
+func TestPollerBaselineError(t *testing.T) {
+	loads := make(chan map[string]*KeyValue, 10)
+	p := &Poller{
+		Load: func(ctx context.Context) (map[string]*KeyValue, int64, func(ctx context.Context) bool, error) {
+			kvs := <-loads
+			if kvs == nil {
+				return nil, 0, nil, errors.New("load failed")
+			}
+			return kvs, 1, func(ctx context.Context) bool { <-ctx.Done(); return false }, nil
+		},
+		Retry: 10 * time.Millisecond,
+	}
+
+	// 基准获取失败时，之后查询到的记录全部作为PUT推送
+	loads <- nil
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := p.Watch(ctx, 0)
+	loads <- map[string]*KeyValue{"/a/1": {Key: []byte("/a/1"), Value: []byte("1")}}
+	resp := <-ch
+	assert.Equal(t, 1, len(resp.Events))
+	assert.Equal(t, EventPut, resp.Events[0].Type)
+
+	cancel()
+	_, ok := <-ch
+	assert.False(t, ok)
+}
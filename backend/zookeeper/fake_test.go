@@ -0,0 +1,197 @@
+package zookeeper
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/go-zookeeper/zk"
+)
+
+// fakeConn 进程内模拟的zookeeper连接，支持临时节点、顺序节点、watch与会话过期
+type fakeConn struct {
+	m       sync.Mutex
+	zxid    int64
+	session int64
+	nodes   map[string]*fakeNode
+	childW  map[string][]chan zk.Event
+	dataW   map[string][]chan zk.Event
+	events  chan zk.Event
+}
+
+type fakeNode struct {
+	data     []byte
+	owner    int64
+	seq      int32
+	children map[string]struct{}
+	stat     zk.Stat
+}
+
+func newFakeConn() *fakeConn {
+	return &fakeConn{
+		session: 1,
+		nodes:   map[string]*fakeNode{"/": {children: make(map[string]struct{})}},
+		childW:  make(map[string][]chan zk.Event),
+		dataW:   make(map[string][]chan zk.Event),
+		events:  make(chan zk.Event, 16),
+	}
+}
+
+func (f *fakeConn) fire(watches map[string][]chan zk.Event, p string, typ zk.EventType) {
+	for _, ch := range watches[p] {
+		ch <- zk.Event{Type: typ, Path: p}
+		close(ch)
+	}
+	delete(watches, p)
+}
+
+func (f *fakeConn) Create(p string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	parent, ok := f.nodes[path.Dir(p)]
+	if !ok {
+		return "", zk.ErrNoNode
+	}
+
+	if flags&zk.FlagSequence != 0 {
+		p = fmt.Sprintf("%s%010d", p, parent.seq)
+		parent.seq++
+	}
+	if _, ok := f.nodes[p]; ok {
+		return "", zk.ErrNodeExists
+	}
+
+	f.zxid++
+	one := &fakeNode{data: data, children: make(map[string]struct{})}
+	one.stat.Czxid = f.zxid
+	one.stat.Mzxid = f.zxid
+	if flags&zk.FlagEphemeral != 0 {
+		one.owner = f.session
+	}
+	f.nodes[p] = one
+	parent.children[path.Base(p)] = struct{}{}
+	parent.stat.Pzxid = f.zxid
+	f.fire(f.childW, path.Dir(p), zk.EventNodeChildrenChanged)
+	return p, nil
+}
+
+func (f *fakeConn) Set(p string, data []byte, version int32) (*zk.Stat, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	one, ok := f.nodes[p]
+	if !ok {
+		return nil, zk.ErrNoNode
+	}
+
+	f.zxid++
+	one.data = data
+	one.stat.Mzxid = f.zxid
+	stat := one.stat
+	f.fire(f.dataW, p, zk.EventNodeDataChanged)
+	return &stat, nil
+}
+
+func (f *fakeConn) Delete(p string, version int32) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.delete(p)
+}
+
+func (f *fakeConn) delete(p string) error {
+	one, ok := f.nodes[p]
+	if !ok {
+		return zk.ErrNoNode
+	}
+	if len(one.children) > 0 {
+		return zk.ErrNotEmpty
+	}
+
+	f.zxid++
+	delete(f.nodes, p)
+	parent := f.nodes[path.Dir(p)]
+	delete(parent.children, path.Base(p))
+	parent.stat.Pzxid = f.zxid
+	f.fire(f.dataW, p, zk.EventNodeDeleted)
+	f.fire(f.childW, path.Dir(p), zk.EventNodeChildrenChanged)
+	return nil
+}
+
+func (f *fakeConn) Get(p string) ([]byte, *zk.Stat, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	one, ok := f.nodes[p]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	stat := one.stat
+	return one.data, &stat, nil
+}
+
+func (f *fakeConn) GetW(p string) ([]byte, *zk.Stat, <-chan zk.Event, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	one, ok := f.nodes[p]
+	if !ok {
+		return nil, nil, nil, zk.ErrNoNode
+	}
+	ch := make(chan zk.Event, 1)
+	f.dataW[p] = append(f.dataW[p], ch)
+	stat := one.stat
+	return one.data, &stat, ch, nil
+}
+
+func (f *fakeConn) Children(p string) ([]string, *zk.Stat, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	one, ok := f.nodes[p]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	var children []string
+	for child := range one.children {
+		children = append(children, child)
+	}
+	sort.Strings(children)
+	stat := one.stat
+	return children, &stat, nil
+}
+
+func (f *fakeConn) ChildrenW(p string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	children, stat, err := f.Children(p)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+	ch := make(chan zk.Event, 1)
+	f.childW[p] = append(f.childW[p], ch)
+	return children, stat, ch, nil
+}
+
+func (f *fakeConn) Close() {}
+
+// expireSession 模拟会话过期：删除当前会话的临时节点，通知会话过期并建立新会话
+func (f *fakeConn) expireSession() {
+	f.m.Lock()
+	for p, one := range f.nodes {
+		if one.owner == f.session {
+			_ = f.delete(p)
+		}
+	}
+	f.session++
+	f.m.Unlock()
+
+	f.events <- zk.Event{Type: zk.EventSession, State: zk.StateExpired}
+}
+
+func (f *fakeConn) children(p string) []string {
+	children, _, _ := f.Children(p)
+	return children
+}
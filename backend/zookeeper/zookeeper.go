@@ -0,0 +1,623 @@
+package zookeeper
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+	"github.com/yuanzhangcai/srsd/backend"
+)
+
+var (
+	defaultServers        = []string{"127.0.0.1:2181"}
+	defaultPrefix         = "/srsd/services/"
+	defaultSessionTimeout = 10 * time.Second
+	defaultRetryInterval  = time.Second
+
+	// ErrClosed 后端已关闭
+	ErrClosed = errors.New("zookeeper: backend closed")
+	// ErrLeaseNotFound 租约不存在或所属会话已过期
+	ErrLeaseNotFound = errors.New("zookeeper: lease not found")
+	// ErrInvalidKey key格式不是 前缀+服务名/服务ID
+	ErrInvalidKey = errors.New("zookeeper: invalid service key")
+
+	// 临时顺序节点名称为 服务ID-10位序号
+	sequenceNode = regexp.MustCompile(`^(.+)-\d{10}$`)
+)
+
+// conn zookeeper连接，*zk.Conn实现了该接口
+type conn interface {
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Set(path string, data []byte, version int32) (*zk.Stat, error)
+	Delete(path string, version int32) error
+	Get(path string) ([]byte, *zk.Stat, error)
+	GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error)
+	Children(path string) ([]string, *zk.Stat, error)
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+	Close()
+}
+
+// Config zookeeper连接参数
+type Config struct {
+	Servers        []string      // zookeeper地址
+	Prefix         string        // 服务注册前缀，需与registry、discovery的Prefix一致
+	SessionTimeout time.Duration // 会话超时时间
+}
+
+// Backend 基于zookeeper的存储后端。带租约的key写为 前缀+服务名 下的临时顺序节点，
+// 租约与会话绑定，会话过期时租约失效；监听通过子节点与数据watch实现
+type Backend struct {
+	cfg  Config
+	conn conn
+	done chan struct{}
+
+	m         sync.Mutex
+	session   int64
+	nextLease backend.LeaseID
+	leases    map[backend.LeaseID]*lease
+	nodes     map[string]*node
+	closed    bool
+}
+
+type lease struct {
+	session int64
+	keys    map[string]struct{}
+	keeper  []chan struct{}
+}
+
+// node 本进程创建的节点
+type node struct {
+	path  string
+	lease backend.LeaseID
+}
+
+// NewBackend 创建zookeeper存储后端
+func NewBackend(cfg Config) (*Backend, error) {
+	if len(cfg.Servers) == 0 {
+		cfg.Servers = defaultServers
+	}
+
+	if cfg.SessionTimeout <= 0 {
+		cfg.SessionTimeout = defaultSessionTimeout
+	}
+
+	cli, events, err := zk.Connect(cfg.Servers, cfg.SessionTimeout, zk.WithLogInfo(false))
+	if err != nil {
+		return nil, err
+	}
+	return newBackend(cfg, cli, events), nil
+}
+
+func newBackend(cfg Config, cli conn, events <-chan zk.Event) *Backend {
+	if cfg.Prefix == "" {
+		cfg.Prefix = defaultPrefix
+	}
+	if cfg.Prefix[len(cfg.Prefix)-1] != '/' {
+		cfg.Prefix += "/"
+	}
+
+	c := &Backend{
+		cfg:    cfg,
+		conn:   cli,
+		done:   make(chan struct{}),
+		leases: make(map[backend.LeaseID]*lease),
+		nodes:  make(map[string]*node),
+	}
+	go c.handleEvents(events)
+	return c
+}
+
+func (c *Backend) handleEvents(events <-chan zk.Event) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			if ev.Type == zk.EventSession && ev.State == zk.StateExpired {
+				c.expireSession()
+			}
+		}
+	}
+}
+
+// expireSession 会话过期，临时节点已被zookeeper删除，当前会话下的租约全部失效
+func (c *Backend) expireSession() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	for id, l := range c.leases {
+		if l.session != c.session {
+			continue
+		}
+
+		for key := range l.keys {
+			delete(c.nodes, key)
+		}
+		for _, one := range l.keeper {
+			close(one)
+		}
+		delete(c.leases, id)
+	}
+	c.session++
+}
+
+// Grant 创建租约，租约绑定当前会话，ttl由会话超时时间代替
+func (c *Backend) Grant(ctx context.Context, ttl int64) (backend.LeaseID, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return backend.NoLease, ErrClosed
+	}
+
+	c.nextLease++
+	c.leases[c.nextLease] = &lease{
+		session: c.session,
+		keys:    make(map[string]struct{}),
+	}
+	return c.nextLease, nil
+}
+
+// KeepAlive 会话由zookeeper客户端保持，返回的channel在会话过期、ctx取消或后端关闭时被关闭
+func (c *Backend) KeepAlive(ctx context.Context, id backend.LeaseID) (<-chan struct{}, error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	l, ok := c.leases[id]
+	if !ok {
+		return nil, ErrLeaseNotFound
+	}
+
+	done := make(chan struct{})
+	l.keeper = append(l.keeper, done)
+
+	go func() {
+		select {
+		case <-done:
+		case <-c.done:
+			c.stopKeeper(id, done)
+		case <-ctx.Done():
+			c.stopKeeper(id, done)
+		}
+	}()
+	return done, nil
+}
+
+func (c *Backend) stopKeeper(id backend.LeaseID, done chan struct{}) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	l, ok := c.leases[id]
+	if !ok {
+		return
+	}
+
+	for i, one := range l.keeper {
+		if one == done {
+			l.keeper = append(l.keeper[:i], l.keeper[i+1:]...)
+			close(done)
+			return
+		}
+	}
+}
+
+// Revoke 撤销租约，删除租约下的所有节点
+func (c *Backend) Revoke(ctx context.Context, id backend.LeaseID) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	l, ok := c.leases[id]
+	if !ok {
+		return ErrLeaseNotFound
+	}
+
+	delete(c.leases, id)
+	for _, one := range l.keeper {
+		close(one)
+	}
+
+	for key := range l.keys {
+		err := c.delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put 写入节点，带租约时为临时顺序节点，否则为持久节点
+func (c *Backend) Put(ctx context.Context, key, value string, id backend.LeaseID) error {
+	name, srvID, err := c.parseKey(key)
+	if err != nil {
+		return err
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	var l *lease
+	if id != backend.NoLease {
+		var ok bool
+		l, ok = c.leases[id]
+		if !ok || l.session != c.session {
+			return ErrLeaseNotFound
+		}
+	}
+
+	// 租约未变化时直接更新节点数据
+	if one, ok := c.nodes[key]; ok {
+		if one.lease == id {
+			_, err = c.conn.Set(one.path, []byte(value), -1)
+			if err == nil {
+				return nil
+			}
+			if err != zk.ErrNoNode {
+				return err
+			}
+		}
+
+		err = c.delete(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	parent := c.parentPath(name)
+	err = c.createParents(parent)
+	if err != nil {
+		return err
+	}
+
+	var path string
+	if l != nil {
+		path, err = c.conn.Create(parent+"/"+srvID+"-", []byte(value), zk.FlagEphemeral|zk.FlagSequence, zk.WorldACL(zk.PermAll))
+	} else {
+		path, err = c.conn.Create(parent+"/"+srvID, []byte(value), 0, zk.WorldACL(zk.PermAll))
+		if err == zk.ErrNodeExists {
+			path = parent + "/" + srvID
+			_, err = c.conn.Set(path, []byte(value), -1)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	c.nodes[key] = &node{path: path, lease: id}
+	if l != nil {
+		l.keys[key] = struct{}{}
+	}
+	return nil
+}
+
+// Delete 删除key对应的节点
+func (c *Backend) Delete(ctx context.Context, key string) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+	return c.delete(key)
+}
+
+func (c *Backend) delete(key string) error {
+	if one, ok := c.nodes[key]; ok {
+		delete(c.nodes, key)
+		if l, ok := c.leases[one.lease]; ok {
+			delete(l.keys, key)
+		}
+
+		err := c.conn.Delete(one.path, -1)
+		if err != nil && err != zk.ErrNoNode {
+			return err
+		}
+		return nil
+	}
+
+	// 非本进程创建的节点，按服务ID查找
+	name, srvID, err := c.parseKey(key)
+	if err != nil {
+		return err
+	}
+
+	parent := c.parentPath(name)
+	children, _, err := c.conn.Children(parent)
+	if err == zk.ErrNoNode {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+		if nodeID(child) != srvID {
+			continue
+		}
+		err = c.conn.Delete(parent+"/"+child, -1)
+		if err != nil && err != zk.ErrNoNode {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get 查询前缀下的所有服务节点，Revision为查询到的最大zxid
+func (c *Backend) Get(ctx context.Context, prefix string) (*backend.GetResponse, error) {
+	if c.isClosed() {
+		return nil, ErrClosed
+	}
+
+	kvs, rev, err := c.list(c.parseName(prefix), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &backend.GetResponse{Revision: rev}
+	for _, kv := range kvs {
+		resp.Kvs = append(resp.Kvs, kv)
+	}
+	sort.Slice(resp.Kvs, func(i, j int) bool {
+		return string(resp.Kvs[i].Key) < string(resp.Kvs[j].Key)
+	})
+	return resp, nil
+}
+
+// Watch 通过子节点watch与数据watch监听服务节点变化，与上一次结果对比后生成PUT/DELETE事件。
+// 监听基准在返回前同步获取，rev大于0且基准已晚于rev时，基准中的节点会先以PUT事件推送
+func (c *Backend) Watch(ctx context.Context, prefix string, rev int64) <-chan *backend.WatchResponse {
+	name := c.parseName(prefix)
+
+	// 服务节点不存在时无法设置子节点watch，先创建持久父节点
+	_ = c.createParents(c.parentPath(name))
+
+	w := make(watches)
+	p := &backend.Poller{
+		Load: func(ctx context.Context) (map[string]*backend.KeyValue, int64, func(ctx context.Context) bool, error) {
+			kvs, rev, err := c.list(name, w)
+			return kvs, rev, w.wait, err
+		},
+		Retry: defaultRetryInterval,
+		Done:  c.done,
+	}
+	return p.Watch(ctx, rev)
+}
+
+// watches 已设置的watch，key为节点路径：服务父节点为子节点watch，服务节点为数据watch。
+// zookeeper的watch只触发一次，触发后通道关闭，未触发的watch不重复设置，避免同一节点上的watch不断累积
+type watches map[string]<-chan zk.Event
+
+// armed 判断节点上是否有未触发的watch
+func (w watches) armed(path string) bool {
+	ch, ok := w[path]
+	if !ok {
+		return false
+	}
+	select {
+	case <-ch:
+		return false
+	default:
+		return true
+	}
+}
+
+// wait 等待任意一个watch触发，ctx取消时返回false
+func (w watches) wait(ctx context.Context) bool {
+	fired := make(chan struct{}, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	for _, one := range w {
+		go func(w <-chan zk.Event) {
+			select {
+			case <-w:
+				select {
+				case fired <- struct{}{}:
+				default:
+				}
+			case <-stop:
+			}
+		}(one)
+	}
+
+	// 没有设置任何watch时（如服务节点不存在）定时重新查询，否则节点创建后无法恢复监听
+	var poll <-chan time.Time
+	if len(w) == 0 {
+		timer := time.NewTimer(defaultRetryInterval)
+		defer timer.Stop()
+		poll = timer.C
+	}
+
+	select {
+	case <-fired:
+		return true
+	case <-poll:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Close 关闭zookeeper连接，会话结束后临时节点由zookeeper删除
+func (c *Backend) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+
+	for _, l := range c.leases {
+		for _, one := range l.keeper {
+			close(one)
+		}
+		l.keeper = nil
+	}
+	c.conn.Close()
+	return nil
+}
+
+func (c *Backend) isClosed() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.closed
+}
+
+// list 查询服务节点，name为空时查询所有服务；w不为nil时为没有未触发watch的节点设置watch，并删除已不存在节点的记录
+func (c *Backend) list(name string, w watches) (map[string]*backend.KeyValue, int64, error) {
+	names := []string{name}
+	var rev int64
+	seen := make(map[string]bool)
+	defer func() {
+		for path := range w {
+			if !seen[path] {
+				delete(w, path)
+			}
+		}
+	}()
+
+	if name == "" {
+		root := c.parentPath("")
+		seen[root] = true
+		children, stat, err := c.children(root, w)
+		if err == zk.ErrNoNode {
+			return map[string]*backend.KeyValue{}, 0, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		rev = stat.Pzxid
+		names = children
+	}
+
+	ret := make(map[string]*backend.KeyValue)
+	for _, one := range names {
+		parent := c.parentPath(one)
+		seen[parent] = true
+		children, stat, err := c.children(parent, w)
+		if err == zk.ErrNoNode {
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if stat.Pzxid > rev {
+			rev = stat.Pzxid
+		}
+
+		for _, child := range children {
+			path := parent + "/" + child
+			seen[path] = true
+			data, cStat, err := c.get(path, w)
+			if err == zk.ErrNoNode {
+				continue
+			}
+			if err != nil {
+				return nil, 0, err
+			}
+
+			if cStat.Mzxid > rev {
+				rev = cStat.Mzxid
+			}
+
+			key := c.cfg.Prefix + one + "/" + nodeID(child)
+			ret[key] = &backend.KeyValue{
+				Key:         []byte(key),
+				Value:       data,
+				ModRevision: cStat.Mzxid,
+			}
+		}
+	}
+	return ret, rev, nil
+}
+
+// children 查询子节点，w不为nil且节点上没有未触发的watch时设置子节点watch
+func (c *Backend) children(path string, w watches) ([]string, *zk.Stat, error) {
+	if w == nil || w.armed(path) {
+		return c.conn.Children(path)
+	}
+
+	children, stat, ch, err := c.conn.ChildrenW(path)
+	if err == nil {
+		w[path] = ch
+	}
+	return children, stat, err
+}
+
+// get 查询节点数据，w不为nil且节点上没有未触发的watch时设置数据watch
+func (c *Backend) get(path string, w watches) ([]byte, *zk.Stat, error) {
+	if w == nil || w.armed(path) {
+		return c.conn.Get(path)
+	}
+
+	data, stat, ch, err := c.conn.GetW(path)
+	if err == nil {
+		w[path] = ch
+	}
+	return data, stat, err
+}
+
+func (c *Backend) createParents(path string) error {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	cur := ""
+	for _, one := range parts {
+		if one == "" {
+			continue
+		}
+		cur += "/" + one
+		_, err := c.conn.Create(cur, nil, 0, zk.WorldACL(zk.PermAll))
+		if err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Backend) parentPath(name string) string {
+	return strings.TrimRight(c.cfg.Prefix+name, "/")
+}
+
+func (c *Backend) parseName(prefix string) string {
+	name := strings.TrimPrefix(prefix, c.cfg.Prefix)
+	return strings.Trim(name, "/")
+}
+
+func (c *Backend) parseKey(key string) (string, string, error) {
+	key = strings.TrimPrefix(key, c.cfg.Prefix)
+	index := strings.LastIndex(key, "/")
+	if index <= 0 || index == len(key)-1 {
+		return "", "", ErrInvalidKey
+	}
+	return key[:index], key[index+1:], nil
+}
+
+// nodeID 从节点名称中获取服务ID，去掉顺序节点的序号
+func nodeID(child string) string {
+	if m := sequenceNode.FindStringSubmatch(child); m != nil {
+		return m[1]
+	}
+	return child
+}
@@ -0,0 +1,225 @@
+package zookeeper
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-zookeeper/zk"
+	"github.com/stretchr/testify/assert"
+	"github.com/yuanzhangcai/srsd/backend"
+	"github.com/yuanzhangcai/srsd/discovery"
+	"github.com/yuanzhangcai/srsd/registry"
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+func newTestBackend() (*Backend, *fakeConn) {
+	f := newFakeConn()
+	return newBackend(Config{}, f, f.events), f
+}
+
+func TestNewBackend(t *testing.T) {
+	b, err := NewBackend(Config{Servers: []string{}})
+	assert.Nil(t, err)
+	assert.Equal(t, defaultServers, b.cfg.Servers)
+	assert.Equal(t, defaultPrefix, b.cfg.Prefix)
+	assert.Nil(t, b.Close())
+}
+
+func TestNodeID(t *testing.T) {
+	assert.Equal(t, "aaaa", nodeID("aaaa-0000000012"))
+	assert.Equal(t, "aaaa", nodeID("aaaa"))
+	assert.Equal(t, "aaaa-12", nodeID("aaaa-12"))
+}
+
+func TestPutGetDelete(t *testing.T) {
+	b, f := newTestBackend()
+	defer b.Close()
+	ctx := context.Background()
+
+	err := b.Put(ctx, "/srsd/services/zacyuan.com", "1", backend.NoLease)
+	assert.Equal(t, ErrInvalidKey, err)
+
+	id, err := b.Grant(ctx, 10)
+	assert.Nil(t, err)
+	assert.Nil(t, b.Put(ctx, "/srsd/services/zacyuan.com/1", "1", id))
+	assert.Nil(t, b.Put(ctx, "/srsd/services/zacyuan.com/2", "2", id))
+	assert.Nil(t, b.Put(ctx, "/srsd/services/other.com/3", "3", backend.NoLease))
+
+	assert.Equal(t, []string{"1-0000000000"}, f.children("/srsd/services/zacyuan.com")[:1])
+
+	resp, err := b.Get(ctx, "/srsd/services/zacyuan.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(resp.Kvs))
+	assert.Equal(t, "/srsd/services/zacyuan.com/1", string(resp.Kvs[0].Key))
+	assert.Equal(t, "1", string(resp.Kvs[0].Value))
+	assert.Less(t, int64(0), resp.Revision)
+
+	// 相同租约下再次写入只更新数据
+	assert.Nil(t, b.Put(ctx, "/srsd/services/zacyuan.com/1", "11", id))
+	assert.Equal(t, 2, len(f.children("/srsd/services/zacyuan.com")))
+
+	resp, err = b.Get(ctx, "/srsd/services/")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(resp.Kvs))
+
+	assert.Nil(t, b.Delete(ctx, "/srsd/services/zacyuan.com/1"))
+	assert.Nil(t, b.Delete(ctx, "/srsd/services/other.com/3"))
+	resp, err = b.Get(ctx, "/srsd/services/")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(resp.Kvs))
+
+	assert.Nil(t, b.Revoke(ctx, id))
+	resp, err = b.Get(ctx, "/srsd/services/")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(resp.Kvs))
+}
+
+func TestSessionExpire(t *testing.T) {
+	b, f := newTestBackend()
+	defer b.Close()
+	ctx := context.Background()
+
+	id, err := b.Grant(ctx, 10)
+	assert.Nil(t, err)
+	assert.Nil(t, b.Put(ctx, "/srsd/services/zacyuan.com/1", "1", id))
+	ch, err := b.KeepAlive(ctx, id)
+	assert.Nil(t, err)
+
+	f.expireSession()
+	select {
+	case _, ok := <-ch:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("keepalive channel not closed")
+	}
+
+	assert.Equal(t, ErrLeaseNotFound, b.Put(ctx, "/srsd/services/zacyuan.com/1", "1", id))
+	resp, err := b.Get(ctx, "/srsd/services/zacyuan.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(resp.Kvs))
+
+	id, err = b.Grant(ctx, 10)
+	assert.Nil(t, err)
+	assert.Nil(t, b.Put(ctx, "/srsd/services/zacyuan.com/1", "1", id))
+}
+
+func TestWatch(t *testing.T) {
+	b, _ := newTestBackend()
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := b.Watch(ctx, "/srsd/services/zacyuan.com", 0)
+
+	id, err := b.Grant(ctx, 10)
+	assert.Nil(t, err)
+	assert.Nil(t, b.Put(ctx, "/srsd/services/zacyuan.com/1", "1", id))
+	resp := <-ch
+	assert.Equal(t, 1, len(resp.Events))
+	assert.Equal(t, backend.EventPut, resp.Events[0].Type)
+	assert.Equal(t, "/srsd/services/zacyuan.com/1", string(resp.Events[0].Kv.Key))
+
+	assert.Nil(t, b.Put(ctx, "/srsd/services/zacyuan.com/1", "11", id))
+	resp = <-ch
+	assert.Equal(t, backend.EventPut, resp.Events[0].Type)
+	assert.Equal(t, "11", string(resp.Events[0].Kv.Value))
+
+	assert.Nil(t, b.Delete(ctx, "/srsd/services/zacyuan.com/1"))
+	resp = <-ch
+	assert.Equal(t, backend.EventDelete, resp.Events[0].Type)
+
+	cancel()
+	for range ch {
+	}
+}
+
+func TestWatchNotAccumulate(t *testing.T) {
+	b, f := newTestBackend()
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	id, err := b.Grant(ctx, 10)
+	assert.Nil(t, err)
+	assert.Nil(t, b.Put(ctx, "/srsd/services/zacyuan.com/1", "1", id))
+	assert.Nil(t, b.Put(ctx, "/srsd/services/zacyuan.com/2", "2", id))
+	ch := b.Watch(ctx, "/srsd/services/zacyuan.com", 0)
+
+	// 只为触发过的节点重新设置watch，每个节点上最多一个watch
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, b.Put(ctx, "/srsd/services/zacyuan.com/1", strconv.Itoa(i), id))
+		resp := <-ch
+		assert.Equal(t, strconv.Itoa(i), string(resp.Events[0].Kv.Value))
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	f.m.Lock()
+	assert.Equal(t, 1, len(f.childW["/srsd/services/zacyuan.com"]))
+	assert.Equal(t, 2, len(f.dataW))
+	for path, ws := range f.dataW {
+		assert.Equal(t, 1, len(ws), path)
+	}
+	f.m.Unlock()
+
+	cancel()
+	for range ch {
+	}
+}
+
+func TestWatchesWait(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// 没有watch时定时返回
+	start := time.Now()
+	assert.True(t, watches{}.wait(ctx))
+	assert.InDelta(t, int64(defaultRetryInterval), int64(time.Since(start)), float64(500*time.Millisecond))
+
+	// watch触发时返回，ctx取消时返回false
+	ch := make(chan zk.Event, 1)
+	ch <- zk.Event{Type: zk.EventNodeDataChanged}
+	assert.True(t, watches{"/a": ch}.wait(ctx))
+	cancel()
+	assert.False(t, watches{"/a": make(chan zk.Event)}.wait(ctx))
+}
+
+func TestRegistryDiscovery(t *testing.T) {
+	b, f := newTestBackend()
+	defer b.Close()
+
+	dis := discovery.NewDiscovery(discovery.Backend(b))
+	err := dis.Start("")
+	assert.Nil(t, err)
+
+	info := service.NewService()
+	info.Name = "zacyuan.com"
+	info.Host = "127.0.0.1:4001"
+	reg := registry.NewRegistry(info, registry.Backend(b))
+	err = reg.Start()
+	assert.Nil(t, err)
+
+	time.Sleep(200 * time.Millisecond)
+	srv := dis.Select("zacyuan.com")
+	assert.NotNil(t, srv)
+	assert.Equal(t, info.ID, srv.ID)
+
+	// 会话过期后registry重新注册
+	f.expireSession()
+	time.Sleep(500 * time.Millisecond)
+	children := f.children("/srsd/services/zacyuan.com")
+	assert.Equal(t, 1, len(children))
+	data, _, err := f.Get("/srsd/services/zacyuan.com/" + children[0])
+	assert.Nil(t, err)
+	srv = &service.Service{}
+	assert.Nil(t, json.Unmarshal(data, srv))
+	assert.Equal(t, info.ID, srv.ID)
+	assert.Equal(t, 1, len(dis.GetAll("zacyuan.com")))
+
+	err = reg.Stop()
+	assert.Nil(t, err)
+	time.Sleep(200 * time.Millisecond)
+	assert.Nil(t, dis.Select("zacyuan.com"))
+	_ = dis.Stop()
+}
@@ -0,0 +1,108 @@
+package backoff
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DefaultPolicy 默认退避策略，从1秒开始每次翻倍，最长30秒，上下浮动20%，不限重试次数
+var DefaultPolicy = Policy{
+	Initial:    time.Second,
+	Max:        30 * time.Second,
+	Multiplier: 2,
+	Jitter:     0.2,
+}
+
+// Policy 指数退避策略
+type Policy struct {
+	Initial     time.Duration // 第一次重试前的等待时间
+	Max         time.Duration // 最长等待时间，为0时不限制
+	Multiplier  float64       // 每次重试等待时间的倍数，小于1时按1处理
+	Jitter      float64       // 随机浮动比例，取值[0, 1]，等待时间在 delay*(1±Jitter) 之间
+	MaxAttempts int           // 最大重试次数，为0时不限制
+}
+
+var (
+	rm  sync.Mutex
+	rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Delay 第attempt次重试前的等待时间，attempt从1开始
+func (c Policy) Delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	multiplier := c.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	delay := float64(c.Initial) * math.Pow(multiplier, float64(attempt-1))
+	if c.Max > 0 && delay > float64(c.Max) {
+		delay = float64(c.Max)
+	}
+
+	if c.Jitter > 0 {
+		jitter := math.Min(c.Jitter, 1)
+		rm.Lock()
+		delay *= 1 + jitter*(rnd.Float64()*2-1)
+		rm.Unlock()
+	}
+
+	if delay > math.MaxInt64 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(delay)
+}
+
+// Backoff 按退避策略计算每次重试的等待时间，非并发安全
+type Backoff struct {
+	policy  Policy
+	attempt int
+}
+
+// New 创建退避计算器
+func New(policy Policy) *Backoff {
+	return &Backoff{policy: policy}
+}
+
+// Next 返回下一次重试前的等待时间，超过最大重试次数时返回false
+func (c *Backoff) Next() (time.Duration, bool) {
+	if c.policy.MaxAttempts > 0 && c.attempt >= c.policy.MaxAttempts {
+		return 0, false
+	}
+
+	c.attempt++
+	return c.policy.Delay(c.attempt), true
+}
+
+// Attempt 已经重试的次数
+func (c *Backoff) Attempt() int {
+	return c.attempt
+}
+
+// Reset 重置重试次数
+func (c *Backoff) Reset() {
+	c.attempt = 0
+}
+
+// Wait 等待下一次重试，超过最大重试次数或ctx结束时返回false
+func (c *Backoff) Wait(ctx context.Context) bool {
+	delay, ok := c.Next()
+	if !ok {
+		return false
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,73 @@
+package backoff
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelay(t *testing.T) {
+	p := Policy{Initial: 100 * time.Millisecond, Max: time.Second, Multiplier: 2}
+	assert.Equal(t, 100*time.Millisecond, p.Delay(0))
+	assert.Equal(t, 100*time.Millisecond, p.Delay(1))
+	assert.Equal(t, 200*time.Millisecond, p.Delay(2))
+	assert.Equal(t, 800*time.Millisecond, p.Delay(4))
+	assert.Equal(t, time.Second, p.Delay(5))
+	assert.Equal(t, time.Second, p.Delay(1000))
+
+	// 倍数小于1时固定间隔
+	p = Policy{Initial: 100 * time.Millisecond}
+	assert.Equal(t, 100*time.Millisecond, p.Delay(10))
+
+	// 不限制最长时间时不溢出
+	p = Policy{Initial: time.Second, Multiplier: 10}
+	assert.Equal(t, time.Duration(1<<63-1), p.Delay(100))
+}
+
+func TestJitter(t *testing.T) {
+	p := Policy{Initial: time.Second, Max: time.Second, Multiplier: 2, Jitter: 0.5}
+	diff := false
+	for i := 0; i < 100; i++ {
+		delay := p.Delay(3)
+		assert.GreaterOrEqual(t, int64(delay), int64(500*time.Millisecond))
+		assert.LessOrEqual(t, int64(delay), int64(1500*time.Millisecond))
+		if delay != time.Second {
+			diff = true
+		}
+	}
+	assert.True(t, diff)
+}
+
+func TestBackoff(t *testing.T) {
+	b := New(Policy{Initial: 10 * time.Millisecond, Multiplier: 2, MaxAttempts: 3})
+	for i := 1; i <= 3; i++ {
+		delay, ok := b.Next()
+		assert.True(t, ok)
+		assert.Equal(t, i, b.Attempt())
+		assert.Equal(t, time.Duration(10<<(i-1))*time.Millisecond, delay)
+	}
+	_, ok := b.Next()
+	assert.False(t, ok)
+	assert.Equal(t, 3, b.Attempt())
+
+	b.Reset()
+	assert.Equal(t, 0, b.Attempt())
+	delay, ok := b.Next()
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Millisecond, delay)
+}
+
+func TestWait(t *testing.T) {
+	b := New(Policy{Initial: 20 * time.Millisecond, MaxAttempts: 1})
+	start := time.Now()
+	assert.True(t, b.Wait(context.Background()))
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(20*time.Millisecond))
+	assert.False(t, b.Wait(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	b = New(Policy{Initial: time.Hour})
+	assert.False(t, b.Wait(ctx))
+}
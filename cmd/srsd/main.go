@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/yuanzhangcai/srsd/backend/etcd"
+	"github.com/yuanzhangcai/srsd/discovery"
+	"github.com/yuanzhangcai/srsd/dnsserver"
+	"github.com/yuanzhangcai/srsd/selector"
+)
+
+const usage = `usage: srsd <command> [flags]
+
+commands:
+  dns    启动DNS服务，应答 <服务名>.srsd. 的A/AAAA/SRV查询
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "dns":
+		err = runDNS(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// runDNS 启动服务发现并对外提供DNS查询
+func runDNS(args []string) error {
+	fs := flag.NewFlagSet("dns", flag.ExitOnError)
+	addr := fs.String("addr", ":5353", "DNS监听地址")
+	domain := fs.String("domain", "srsd.", "服务域名后缀")
+	ttl := fs.Duration("ttl", 5*time.Second, "应答记录TTL")
+	endpoints := fs.String("etcd", "127.0.0.1:2379", "etcd地址，多个地址以逗号分隔")
+	username := fs.String("username", "", "etcd用户名")
+	password := fs.String("password", "", "etcd密码")
+	caFile := fs.String("cacert", "", "etcd CA证书文件")
+	certFile := fs.String("cert", "", "etcd客户端证书文件")
+	keyFile := fs.String("key", "", "etcd客户端私钥文件")
+	serverName := fs.String("server-name", "", "校验etcd证书使用的域名或IP，使用-ca且etcd地址为IP时必须设置")
+	insecure := fs.Bool("insecure-skip-verify", false, "不校验etcd证书")
+	prefix := fs.String("prefix", "/srsd/services/", "服务注册前缀")
+	sel := fs.String("selector", "round", "服务选择器: round、random、weighted")
+	filter := fs.String("filter", "", "实例过滤表达式，如: version>=1.2 && metadata.zone in (sh,bj)")
+	fallback := fs.Bool("filter-fallback", false, "过滤后没有实例时忽略过滤表达式")
+	_ = fs.Parse(args)
+
+	var selectors []selector.Selector
+	if *filter != "" {
+		match, err := selector.ParseExpr(*filter)
+		if err != nil {
+			return err
+		}
+		if *fallback {
+			match.Fallback(selector.NewAll())
+		}
+		selectors = append(selectors, match)
+	}
+
+	switch *sel {
+	case "round":
+		selectors = append(selectors, selector.NewRound())
+	case "random":
+		selectors = append(selectors, selector.NewRandom())
+	case "weighted":
+		selectors = append(selectors, selector.NewWeightedRound())
+	default:
+		return fmt.Errorf("unknown selector: %s", *sel)
+	}
+
+	opts := []discovery.Option{
+		discovery.Addresses(strings.Split(*endpoints, ",")),
+		discovery.Username(*username),
+		discovery.Password(*password),
+		discovery.Prefix(*prefix),
+		discovery.Selectors(selectors...),
+	}
+	if *caFile != "" || *certFile != "" || *keyFile != "" || *serverName != "" || *insecure {
+		opts = append(opts, discovery.TLS(etcd.TLSConfig{
+			CAFile:             *caFile,
+			CertFile:           *certFile,
+			KeyFile:            *keyFile,
+			ServerName:         *serverName,
+			InsecureSkipVerify: *insecure,
+		}))
+	}
+
+	dis := discovery.NewDiscovery(opts...)
+	err := dis.Start("")
+	if err != nil {
+		return err
+	}
+	defer dis.Stop()
+
+	srv := dnsserver.NewServer(dis,
+		dnsserver.Addr(*addr),
+		dnsserver.Domain(*domain),
+		dnsserver.TTL(*ttl),
+	)
+	err = srv.Start()
+	if err != nil {
+		return err
+	}
+	fmt.Println("dns server listening on", srv.Addr())
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	<-ch
+
+	return srv.Stop()
+}
@@ -0,0 +1,132 @@
+package discovery
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+// Status 服务信息状态
+type Status int32
+
+const (
+	// StatusNone 尚未加载服务信息
+	StatusNone Status = iota
+	// StatusCached 存储后端不可用，服务信息来自本地缓存文件，可能已过期
+	StatusCached
+	// StatusLive 服务信息与存储后端保持同步
+	StatusLive
+)
+
+// String 状态名称
+func (c Status) String() string {
+	switch c {
+	case StatusNone:
+		return "NONE"
+	case StatusCached:
+		return "CACHED"
+	case StatusLive:
+		return "LIVE"
+	}
+	return "UNKNOWN"
+}
+
+// cacheData 本地缓存文件内容
+type cacheData struct {
+	UpdateTime string                        `json:"update_time"`
+	Services   map[string][]*service.Service `json:"services"`
+}
+
+// Status 获取服务信息状态，存储后端不可用而使用本地缓存时返回StatusCached
+func (c *Discovery) Status() Status {
+	c.m.RLock()
+	defer c.m.RUnlock()
+
+	if len(c.stale) > 0 {
+		return StatusCached
+	}
+
+	if c.live {
+		return StatusLive
+	}
+	return StatusNone
+}
+
+// loadCache 从本地缓存文件加载前缀下的服务信息，返回加载的服务名，需持有c.m
+func (c *Discovery) loadCache(key string) []string {
+	if c.opts.CacheFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(c.opts.CacheFile)
+	if err != nil {
+		return nil
+	}
+
+	cache := &cacheData{}
+	err = json.Unmarshal(data, cache)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	prefix := c.opts.Prefix + key
+	for name, list := range cache.Services {
+		has := false
+		for _, srv := range list {
+			if srv == nil || !strings.HasPrefix(c.opts.Prefix+name+"/"+srv.ID, prefix) {
+				continue
+			}
+
+			if old := c.putSrv(name, srv); old == nil {
+				c.dispatch(&Event{Type: EventAdded, Name: name, New: srv})
+			}
+			has = true
+		}
+
+		if has {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// saveCache 将服务信息写入本地缓存文件，先写临时文件再重命名
+func (c *Discovery) saveCache() {
+	if c.opts.CacheFile == "" {
+		return
+	}
+
+	c.m.RLock()
+	cache := &cacheData{
+		UpdateTime: time.Now().Format("2006-01-02 15:04:05"),
+		Services:   make(map[string][]*service.Service, len(c.srvList)),
+	}
+	for name, list := range c.srvList {
+		if len(list) > 0 {
+			cache.Services[name] = list
+		}
+	}
+	data, err := json.MarshalIndent(cache, "", "  ")
+	c.m.RUnlock()
+	if err != nil {
+		return
+	}
+
+	c.cm.Lock()
+	defer c.cm.Unlock()
+
+	dir := filepath.Dir(c.opts.CacheFile)
+	_ = os.MkdirAll(dir, 0755)
+	tmp := filepath.Join(dir, "."+filepath.Base(c.opts.CacheFile)+".tmp")
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return
+	}
+	_ = os.Rename(tmp, c.opts.CacheFile)
+}
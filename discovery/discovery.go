@@ -3,47 +3,76 @@ package discovery
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"reflect"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/coreos/etcd/clientv3"
-	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/yuanzhangcai/srsd/backend"
+	"github.com/yuanzhangcai/srsd/backend/etcd"
+	"github.com/yuanzhangcai/srsd/backoff"
 	"github.com/yuanzhangcai/srsd/selector"
 	"github.com/yuanzhangcai/srsd/service"
 )
 
-// Event 监听事件
-type Event = clientv3.Event
+// errWatchClosed 存储后端关闭了监听
+var errWatchClosed = errors.New("discovery: watch closed")
 
 // Discovery 服务发现组件
 type Discovery struct {
 	opts    *Options
-	cli     *clientv3.Client
+	cli     backend.Backend
 	m       sync.RWMutex
 	cancel  map[string]context.CancelFunc
 	srvList map[string][]*service.Service
+	sm      sync.Mutex
+	subID   int
+	subs    map[int]func(name string)
+	wID     int
+	watches map[int]*watcher
+	cm      sync.Mutex      // 本地缓存文件写锁
+	stale   map[string]bool // 使用本地缓存、等待重新连接存储后端的服务前缀
+	live    bool
+	wg      sync.WaitGroup // 后台协程，Close时等待退出
+	outlier *outlier       // 异常实例检测，未开启时为空
 }
 
 // NewDiscovery 创建服务发现组件
 func NewDiscovery(opts ...Option) *Discovery {
 	opt := newOptions(opts...)
 
-	return &Discovery{
+	c := &Discovery{
 		opts:    opt,
 		srvList: make(map[string][]*service.Service),
 		cancel:  make(map[string]context.CancelFunc),
+		subs:    make(map[int]func(name string)),
+		watches: make(map[int]*watcher),
+		stale:   make(map[string]bool),
 	}
+	if opt.Outlier != nil {
+		c.outlier = newOutlier(*opt.Outlier, func(name string) int {
+			return len(c.GetAll(name))
+		})
+	}
+	return c
 }
 
-// Start 开启服务发现
+// Start 开启服务发现。存储后端不可用且配置了本地缓存文件时，使用缓存中的服务信息并在后台重试连接，
+// 此时返回nil，Status()为StatusCached
 func (c *Discovery) Start(key string) error {
+	var names []string
+	defer func() {
+		c.changed(names)
+	}()
+
 	c.m.Lock()
 	defer c.m.Unlock()
 
 	if c.cli == nil {
-		cli, err := c.createEtcdClient()
+		cli, err := c.createBackend()
 		if err != nil {
+			names, err = c.startCached(key, err)
 			return err
 		}
 
@@ -54,29 +83,106 @@ func (c *Discovery) Start(key string) error {
 		return nil
 	}
 
-	err := c.loadAll(key)
+	resp, err := c.loadAll(c.cli, key)
 	if err != nil {
+		names, err = c.startCached(key, err)
 		return err
 	}
 
-	err = c.startWatch(key)
+	// 从加载时的版本之后开始监听，避免遗漏加载与监听之间的变化
+	names = c.apply(c.diff(key, resp))
+	delete(c.stale, key)
+	c.live = true
+	c.startWatch(key, resp.Revision)
+	return nil
+}
+
+// startCached 存储后端不可用时从本地缓存加载服务信息，并在后台重试连接，需持有c.m
+func (c *Discovery) startCached(key string, cause error) ([]string, error) {
+	if _, ok := c.cancel[key]; ok {
+		return nil, nil
+	}
+
+	names := c.loadCache(key)
+	if len(names) == 0 {
+		return nil, cause
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel[key] = cancel
+	c.stale[key] = true
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		b := backoff.New(c.opts.Backoff)
+		err := cause
+		for {
+			if !c.retryWait(ctx, key, b, err) {
+				return
+			}
+
+			err = c.reconnect(ctx, key)
+			if err == nil {
+				return
+			}
+		}
+	}()
+	return names, nil
+}
+
+// reconnect 重新连接存储后端，加载成功后用最新数据替换缓存并开始监听
+func (c *Discovery) reconnect(ctx context.Context, key string) error {
+	c.m.Lock()
+	if c.cli == nil {
+		cli, err := c.createBackend()
+		if err != nil {
+			c.m.Unlock()
+			return err
+		}
+		c.cli = cli
+	}
+	cli := c.cli
+	c.m.Unlock()
+
+	// 加载时不持有锁，避免存储后端不可用时阻塞Select
+	resp, err := c.loadAll(cli, key)
 	if err != nil {
 		return err
 	}
 
+	var names []string
+	defer func() {
+		c.changed(names)
+	}()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if ctx.Err() != nil || c.cli != cli {
+		return nil // 服务发现已停止
+	}
+
+	names = c.apply(c.diff(key, resp))
+	delete(c.stale, key)
+	c.live = true
+
+	cancel := c.cancel[key]
+	c.startWatch(key, resp.Revision)
+	cancel()
 	return nil
 }
 
-func (c *Discovery) createEtcdClient() (*clientv3.Client, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
-	defer cancel()
+func (c *Discovery) createBackend() (backend.Backend, error) {
+	if c.opts.Backend != nil {
+		return c.opts.Backend, nil
+	}
 
-	return clientv3.New(clientv3.Config{
-		Context:     ctx,
-		Endpoints:   c.opts.Addresses,
-		DialTimeout: c.opts.Timeout,
-		Username:    c.opts.Username,
-		Password:    c.opts.Password,
+	return etcd.NewBackend(etcd.Config{
+		Addresses: c.opts.Addresses,
+		Username:  c.opts.Username,
+		Password:  c.opts.Password,
+		Timeout:   c.opts.Timeout,
+		TLS:       c.opts.TLS,
 	})
 }
 
@@ -98,133 +204,480 @@ func (c *Discovery) getServiceID(key string) string {
 	return id
 }
 
-func (c *Discovery) loadAll(key string) error {
+// loadAll 加载前缀下的所有服务信息
+func (c *Discovery) loadAll(cli backend.Backend, key string) (*backend.GetResponse, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
 	defer cancel()
-	key = c.opts.Prefix + key
-	resp, err := c.cli.Get(ctx, key, clientv3.WithPrefix())
-	if err != nil {
-		return err
-	}
+	return cli.Get(ctx, c.opts.Prefix+key)
+}
 
+// diff 对比加载结果与缓存，生成写入事件与已下线实例的删除事件，需持有c.m
+func (c *Discovery) diff(key string, resp *backend.GetResponse) *backend.WatchResponse {
+	ret := &backend.WatchResponse{Revision: resp.Revision}
+	has := make(map[string]bool, len(resp.Kvs))
 	for _, kv := range resp.Kvs {
-		srv := &service.Service{}
-		err := json.Unmarshal(kv.Value, srv)
-		if err != nil {
-			continue
-		}
+		has[string(kv.Key)] = true
+		ret.Events = append(ret.Events, &backend.Event{Type: backend.EventPut, Kv: kv})
+	}
 
-		key := c.getServiceName(string(kv.Key))
-		c.putSrv(key, srv)
+	prefix := c.opts.Prefix + key
+	for name, list := range c.srvList {
+		for _, srv := range list {
+			k := c.opts.Prefix + name + "/" + srv.ID
+			if strings.HasPrefix(k, prefix) && !has[k] {
+				ret.Events = append(ret.Events, &backend.Event{Type: backend.EventDelete, Kv: &backend.KeyValue{Key: []byte(k)}})
+			}
+		}
 	}
-	return nil
+	return ret
 }
 
-func (c *Discovery) putSrv(key string, srv *service.Service) {
+// putSrv 新增或更新服务实例，返回更新前的服务信息
+func (c *Discovery) putSrv(key string, srv *service.Service) *service.Service {
 	list, ok := c.srvList[key]
 	if !ok {
 		list = []*service.Service{}
 	}
 
-	has := false
+	var old *service.Service
 	for i, one := range list {
 		if one.ID == srv.ID {
+			old = one
+			// 复制列表，避免修改GetAll已返回给调用方的切片
+			list = append([]*service.Service{}, list...)
 			list[i] = srv
-			has = true
 			break
 		}
 	}
 
-	if !has {
+	if old == nil {
 		list = append(list, srv)
 	}
 
 	c.srvList[key] = list
+	return old
 }
 
-func (c *Discovery) delSrv(key, id string) {
+// delSrv 删除服务实例，返回被删除的服务信息
+func (c *Discovery) delSrv(key, id string) *service.Service {
 	list, ok := c.srvList[key]
 	if !ok {
-		return
+		return nil
 	}
 
 	if len(list) == 0 {
-		return
+		return nil
 	}
 
+	var old *service.Service
 	for i, one := range list {
 		if one.ID == id {
-			list = append(list[0:i], list[i+1:]...)
+			old = one
+			// 复制列表，避免修改GetAll已返回给调用方的切片
+			list = append(append([]*service.Service{}, list[0:i]...), list[i+1:]...)
+			break
 		}
 	}
 	c.srvList[key] = list
+	return old
 }
 
-func (c *Discovery) startWatch(key string) error {
+// startWatch 从rev之后开始监听，监听中断时从最后处理的版本继续监听，
+// 版本已被压缩时重新加载全量数据并删除已下线的实例
+func (c *Discovery) startWatch(key string, rev int64) {
 	ctx, cancel := context.WithCancel(context.Background())
 	c.cancel[key] = cancel
 	watchKey := c.opts.Prefix + key
-	ch := c.cli.Watch(ctx, watchKey, clientv3.WithPrefix())
+	ch := c.cli.Watch(ctx, watchKey, rev+1)
+	c.wg.Add(1)
 	go func() {
-		for resp := range ch {
-			if resp.Err() != nil {
-				// watch异常，停止服务发现，然后再重启服服务发现
-				err := c.Stop()
-				if err == nil {
-					err := c.Start(key)
-					if err == nil {
-						return // 重启服务发现成功后，协程退出
+		defer c.wg.Done()
+		b := backoff.New(c.opts.Backoff)
+		for {
+			compacted := false
+			err := errWatchClosed
+			for resp := range ch {
+				if resp.Err == backend.ErrCompacted {
+					compacted = true
+					break
+				}
+
+				if resp.Err != nil || resp.Canceled {
+					if resp.Err != nil {
+						err = resp.Err
 					}
+					break
 				}
-				time.Sleep(c.opts.Timeout * time.Second)
-				continue
+
+				b.Reset()
+				if r := lastRevision(resp); r > rev {
+					rev = r
+				}
+				_ = c.reload(ctx, resp)
 			}
 
-			if resp.Canceled {
+			if ctx.Err() != nil {
 				return
 			}
-			_ = c.reload(&resp)
+
+			// 监听异常时按退避策略等待后再重新监听，版本被压缩时立即重新加载
+			wait := !compacted
+			for {
+				if wait && !c.retryWait(ctx, key, b, err) {
+					return
+				}
+				wait = true
+
+				cli := c.getBackend()
+				if cli == nil || ctx.Err() != nil {
+					return // 服务发现已停止
+				}
+
+				if compacted {
+					r, e := c.resync(ctx, cli, key)
+					if e != nil {
+						err = e
+						continue
+					}
+					rev = r
+				}
+
+				ch = cli.Watch(ctx, watchKey, rev+1)
+				break
+			}
 		}
 	}()
+}
 
-	return nil
+// lastRevision 返回响应中已送达事件的最大ModRevision，重新监听时从该版本之后开始，
+// 响应版本可能晚于尚未送达的事件；没有事件的进度通知或事件不带版本时使用响应版本
+func lastRevision(resp *backend.WatchResponse) int64 {
+	var rev int64
+	for _, one := range resp.Events {
+		if one.Kv != nil && one.Kv.ModRevision > rev {
+			rev = one.Kv.ModRevision
+		}
+	}
+	if rev == 0 {
+		return resp.Revision
+	}
+	return rev
+}
+
+// retryWait 回调OnRetry后按退避策略等待，达到最大重试次数时放弃监听，返回false时需退出重试
+func (c *Discovery) retryWait(ctx context.Context, key string, b *backoff.Backoff, err error) bool {
+	delay, ok := b.Next()
+	if !ok {
+		c.giveUp(ctx, key)
+		return false
+	}
+
+	if c.opts.OnRetry != nil {
+		c.opts.OnRetry(key, b.Attempt(), err)
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// giveUp 放弃监听前缀，之后可以重新Start，已加载的服务信息保留
+func (c *Discovery) giveUp(ctx context.Context, key string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if ctx.Err() != nil {
+		return // 已停止监听
+	}
+
+	c.cancel[key]()
+	delete(c.cancel, key)
+	delete(c.stale, key)
+	c.refreshLive()
+}
+
+// refreshLive 按剩余的监听重新计算状态，使用缓存的前缀不算作实时监听，需持有c.m
+func (c *Discovery) refreshLive() {
+	c.live = len(c.cancel) > len(c.stale)
 }
 
-func (c *Discovery) reload(resp *clientv3.WatchResponse) error {
+func (c *Discovery) getBackend() backend.Backend {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.cli
+}
+
+// resync 重新加载全量数据，与缓存对比后更新服务列表，返回加载时的版本。ctx结束后不再更新服务列表
+func (c *Discovery) resync(ctx context.Context, cli backend.Backend, key string) (int64, error) {
+	resp, err := c.loadAll(cli, key)
+	if err != nil {
+		return 0, err
+	}
+
+	var names []string
+	defer func() {
+		c.changed(names)
+	}()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if ctx.Err() != nil {
+		return resp.Revision, nil // 已停止监听
+	}
+	names = c.apply(c.diff(key, resp))
+	return resp.Revision, nil
+}
+
+// reload 应用监听到的变化，ctx结束后不再更新服务列表
+func (c *Discovery) reload(ctx context.Context, resp *backend.WatchResponse) error {
 	if resp == nil {
 		return nil
 	}
 
+	var names []string
+	defer func() {
+		c.changed(names)
+	}()
+
 	c.m.Lock()
 	defer c.m.Unlock()
+	if ctx.Err() != nil {
+		return nil // 已停止监听
+	}
+	names = c.apply(resp)
+	return nil
+}
 
+// apply 将存储事件应用到服务列表并分发服务事件，返回发生变化的服务名，需持有c.m
+func (c *Discovery) apply(resp *backend.WatchResponse) []string {
+	var names []string
+	has := make(map[string]bool)
 	for _, one := range resp.Events {
 		key := string(one.Kv.Key)
 		name := c.getServiceName(key)
 		id := c.getServiceID(key)
 
+		var ev *Event
 		switch one.Type {
-		case mvccpb.DELETE:
-			c.delSrv(name, id)
-		case mvccpb.PUT:
+		case backend.EventDelete:
+			old := c.delSrv(name, id)
+			if old == nil {
+				continue
+			}
+			ev = &Event{Type: EventRemoved, Name: name, Old: old}
+		case backend.EventPut:
 			srv := &service.Service{}
 			err := json.Unmarshal(one.Kv.Value, srv)
 			if err != nil {
 				continue
 			}
-			c.putSrv(name, srv)
+
+			old := c.putSrv(name, srv)
+			if reflect.DeepEqual(old, srv) {
+				continue // 重新加载时服务信息没有变化
+			}
+
+			ev = &Event{Type: EventAdded, Name: name, New: srv}
+			if old != nil {
+				ev.Type = EventUpdated
+				ev.Old = old
+			}
+		default:
+			continue
 		}
 
-		if c.opts.Watch != nil {
-			c.opts.Watch(one)
+		if !has[name] {
+			has[name] = true
+			names = append(names, name)
 		}
+
+		c.dispatch(ev)
 	}
+	return names
+}
 
-	return nil
+// dispatch 将事件发送给回调函数与所有监听者，需持有c.m
+func (c *Discovery) dispatch(ev *Event) {
+	if c.opts.Watch != nil {
+		c.opts.Watch(ev)
+	}
+
+	for _, w := range c.watches {
+		w.push(ev)
+	}
+}
+
+// Watch 监听服务变化，name为空时监听所有服务。
+// 第一个事件为当前服务快照，之后为Added、Updated、Removed事件，ctx结束后通道关闭
+func (c *Discovery) Watch(ctx context.Context, name string) <-chan *Event {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	snapshot := &Event{Type: EventSnapshot, Name: name}
+	if name != "" {
+		snapshot.Services = append(snapshot.Services, c.srvList[name]...)
+	} else {
+		for _, one := range c.srvList {
+			snapshot.Services = append(snapshot.Services, one...)
+		}
+	}
+
+	c.wID++
+	id := c.wID
+	w := newWatcher(ctx, name, snapshot)
+	c.watches[id] = w
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		w.run()
+
+		c.m.Lock()
+		delete(c.watches, id)
+		c.m.Unlock()
+	}()
+	return w.ch
+}
+
+// Subscribe 订阅服务变化，服务列表发生变化时以服务名回调fn，返回取消订阅函数
+func (c *Discovery) Subscribe(fn func(name string)) func() {
+	c.sm.Lock()
+	defer c.sm.Unlock()
+
+	c.subID++
+	id := c.subID
+	c.subs[id] = fn
+	return func() {
+		c.sm.Lock()
+		defer c.sm.Unlock()
+		delete(c.subs, id)
+	}
+}
+
+// changed 服务列表发生变化后更新本地缓存文件并通知订阅者，需在释放c.m后调用
+func (c *Discovery) changed(names []string) {
+	if len(names) == 0 {
+		return
+	}
+
+	c.saveCache()
+	c.notify(names)
+}
+
+// notify 通知订阅者服务列表发生变化，需在释放c.m后调用
+func (c *Discovery) notify(names []string) {
+	if len(names) == 0 {
+		return
+	}
+
+	c.sm.Lock()
+	subs := make([]func(name string), 0, len(c.subs))
+	for _, fn := range c.subs {
+		subs = append(subs, fn)
+	}
+	c.sm.Unlock()
+
+	for _, name := range names {
+		for _, fn := range subs {
+			fn(name)
+		}
+	}
 }
 
 // Select 获取服务信息
 func (c *Discovery) Select(name string, selectors ...selector.Selector) *service.Service {
+	list := c.Filter(name, selectors...)
+	if len(list) > 0 {
+		return list[0]
+	}
+
+	return nil
+}
+
+// SelectWithKey 按请求key获取服务信息，实现了selector.KeyFilter的选择器按key选择，相同key总是选择同一实例
+func (c *Discovery) SelectWithKey(name, key string, selectors ...selector.Selector) *service.Service {
+	list := c.FilterWithKey(name, key, selectors...)
+	if len(list) > 0 {
+		return list[0]
+	}
+
+	return nil
+}
+
+// Pick 选择服务实例，返回的Handle需在请求结束后调用Done上报结果，
+// 供selector.NewLeastRequest、selector.NewP2C等根据调用结果选择的选择器使用。没有可用实例时返回nil
+func (c *Discovery) Pick(name string, selectors ...selector.Selector) *selector.Handle {
+	srv := c.Select(name, selectors...)
+	if srv == nil {
+		return nil
+	}
+	return c.NewHandle(name, srv, selectors...)
+}
+
+// PickWithKey 按请求key选择服务实例，返回的Handle需在请求结束后调用Done上报结果。没有可用实例时返回nil
+func (c *Discovery) PickWithKey(name, key string, selectors ...selector.Selector) *selector.Handle {
+	srv := c.SelectWithKey(name, key, selectors...)
+	if srv == nil {
+		return nil
+	}
+	return c.NewHandle(name, srv, selectors...)
+}
+
+// NewHandle 为已选择的实例创建Handle，调用结果上报给选择器与异常实例检测，未指定选择器时使用配置的选择器
+func (c *Discovery) NewHandle(name string, srv *service.Service, selectors ...selector.Selector) *selector.Handle {
+	return selector.NewHandle(c.chain(selectors), name, srv)
+}
+
+// Feedback 将调用结果上报给异常实例检测，未开启检测时忽略
+func (c *Discovery) Feedback(name string, srv *service.Service, err error, latency time.Duration) {
+	if c.outlier != nil {
+		c.outlier.Feedback(name, srv, err, latency)
+	}
+}
+
+// Outlier 获取异常实例检测选择器，过滤被摘除的实例并接收调用结果，供不经过Select选择实例的组件使用。未开启检测时返回nil
+func (c *Discovery) Outlier() selector.Selector {
+	if c.outlier == nil {
+		return nil
+	}
+	return c.outlier
+}
+
+// Ejected 获取被异常实例检测摘除的实例，这些实例仍然在GetAll的结果中
+func (c *Discovery) Ejected(name string) []*service.Service {
+	if c.outlier == nil {
+		return nil
+	}
+
+	var list []*service.Service
+	for _, one := range c.GetAll(name) {
+		if c.outlier.ejected(name, one) {
+			list = append(list, one)
+		}
+	}
+	return list
+}
+
+// Filter 获取经选择器过滤后的服务列表，未指定选择器时使用配置的选择器
+func (c *Discovery) Filter(name string, selectors ...selector.Selector) []*service.Service {
+	return c.filter(name, func(sel selector.Selector, list []*service.Service) []*service.Service {
+		return sel.Filter(name, list)
+	}, selectors)
+}
+
+// FilterWithKey 按请求key获取经选择器过滤后的服务列表，未指定选择器时使用配置的选择器
+func (c *Discovery) FilterWithKey(name, key string, selectors ...selector.Selector) []*service.Service {
+	return c.filter(name, func(sel selector.Selector, list []*service.Service) []*service.Service {
+		return selector.FilterWithKey(sel, name, key, list)
+	}, selectors)
+}
+
+func (c *Discovery) filter(name string, fn func(sel selector.Selector, list []*service.Service) []*service.Service, selectors []selector.Selector) []*service.Service {
 	c.m.RLock()
 	defer c.m.RUnlock()
 	var list []*service.Service
@@ -244,19 +697,30 @@ func (c *Discovery) Select(name string, selectors ...selector.Selector) *service
 		return nil
 	}
 
-	if len(selectors) == 0 {
-		selectors = c.opts.Selectors
+	for _, one := range c.chain(selectors) {
+		list = fn(one, list)
+		if len(list) == 0 {
+			return nil
+		}
 	}
 
-	for _, one := range selectors {
-		list = one.Filter(name, list)
-	}
+	return list
+}
 
-	if len(list) > 0 {
-		return list[0]
+// chain 实际使用的选择器：未指定选择器时使用配置的选择器，开启异常实例检测时最先过滤被摘除的实例
+func (c *Discovery) chain(selectors []selector.Selector) []selector.Selector {
+	if len(selectors) == 0 {
+		selectors = c.opts.Selectors
+	}
+	if c.outlier != nil {
+		selectors = append([]selector.Selector{c.outlier}, selectors...)
 	}
+	return selectors
+}
 
-	return nil
+// Selectors 获取配置的服务选择器
+func (c *Discovery) Selectors() []selector.Selector {
+	return c.opts.Selectors
 }
 
 // GetAll 获取所有服务器信
@@ -280,13 +744,81 @@ func (c *Discovery) GetAll(name string) []*service.Service {
 	return list
 }
 
-// Stop 停止服务发现
+// Watching 判断服务是否已被Start开启的前缀监听
+func (c *Discovery) Watching(name string) bool {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.watched(c.opts.Prefix + name + "/")
+}
+
+// Unwatch 停止监听Start(key)开启的服务前缀，并删除不再被其他前缀监听的服务实例
+func (c *Discovery) Unwatch(key string) {
+	var names []string
+	defer func() {
+		c.changed(names)
+	}()
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	cancel, ok := c.cancel[key]
+	if !ok {
+		return
+	}
+	cancel()
+	delete(c.cancel, key)
+	delete(c.stale, key)
+	c.refreshLive()
+
+	prefix := c.opts.Prefix + key
+	for name, list := range c.srvList {
+		removed := false
+		for _, srv := range list {
+			k := c.opts.Prefix + name + "/" + srv.ID
+			if !strings.HasPrefix(k, prefix) || c.watched(k) {
+				continue
+			}
+
+			if old := c.delSrv(name, srv.ID); old != nil {
+				removed = true
+				c.dispatch(&Event{Type: EventRemoved, Name: name, Old: old})
+			}
+		}
+
+		if removed {
+			names = append(names, name)
+		}
+	}
+}
+
+// watched 判断键是否仍在监听的前缀下，需持有c.m
+func (c *Discovery) watched(k string) bool {
+	for key := range c.cancel {
+		if strings.HasPrefix(k, c.opts.Prefix+key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Stop 停止服务发现，取消所有监听，之后可以重新Start
 func (c *Discovery) Stop() error {
 	c.m.Lock()
 	defer c.m.Unlock()
 
+	// 取消监听与后台重新连接
+	for key, cancel := range c.cancel {
+		cancel()
+		delete(c.cancel, key)
+	}
+	c.stale = make(map[string]bool)
+	c.live = false
+
 	if c.cli != nil {
-		_ = c.cli.Close()
+		// 外部传入的存储后端由调用方负责关闭
+		if c.opts.Backend == nil {
+			_ = c.cli.Close()
+		}
 		c.cli = nil
 		// 服务停止后，不清空服务信息缓存
 		// c.srvList = make(map[string][]*service.Service)
@@ -294,3 +826,18 @@ func (c *Discovery) Stop() error {
 
 	return nil
 }
+
+// Close 停止服务发现，关闭所有Watch通道，并等待后台协程全部退出。
+// 不能与Start、Watch并发调用
+func (c *Discovery) Close() error {
+	err := c.Stop()
+
+	c.m.Lock()
+	for _, w := range c.watches {
+		w.cancel()
+	}
+	c.m.Unlock()
+
+	c.wg.Wait()
+	return err
+}
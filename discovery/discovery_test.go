@@ -1,10 +1,22 @@
 package discovery
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/yuanzhangcai/srsd/backend"
+	"github.com/yuanzhangcai/srsd/backend/etcd"
+	"github.com/yuanzhangcai/srsd/backend/memory"
+	"github.com/yuanzhangcai/srsd/backoff"
 	"github.com/yuanzhangcai/srsd/registry"
 	"github.com/yuanzhangcai/srsd/selector"
 	"github.com/yuanzhangcai/srsd/service"
@@ -12,6 +24,9 @@ import (
 
 var testEtcdAddr = []string{"127.0.0.1:2379"}
 
+// testBackoff 测试使用的重试间隔
+var testBackoff = backoff.Policy{Initial: 50 * time.Millisecond}
+
 func TestNewDiscovery(t *testing.T) {
 	dis := NewDiscovery(
 		Addresses(testEtcdAddr),
@@ -20,6 +35,7 @@ func TestNewDiscovery(t *testing.T) {
 		Prefix("/zacyuan/test"),
 		Timeout(3*time.Second),
 		Selectors(selector.NewRandom()),
+		TLS(etcd.TLSConfig{CAFile: "ca.pem"}),
 	)
 	assert.NotNil(t, dis)
 	assert.NotNil(t, dis.srvList)
@@ -29,19 +45,23 @@ func TestNewDiscovery(t *testing.T) {
 	assert.Equal(t, "/zacyuan/test/", dis.opts.Prefix)
 	assert.Equal(t, 3*time.Second, dis.opts.Timeout)
 	assert.Less(t, 0, len(dis.opts.Selectors))
+	assert.Equal(t, "ca.pem", dis.opts.TLS.CAFile)
 }
 
 func TestStart(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+
 	info := service.NewService()
 	info.Name = "zacyuan.com"
 	info.Host = "127.0.0.1:4001"
-	reg1 := registry.NewRegistry(info, registry.Addresses(testEtcdAddr), registry.TTL(10*time.Second))
+	reg1 := registry.NewRegistry(info, registry.Backend(b), registry.TTL(10*time.Second))
 	_ = reg1.Start()
 
 	info = service.NewService()
 	info.Name = "zacyuan.com"
 	info.Host = "127.0.0.1:4002"
-	reg2 := registry.NewRegistry(info, registry.Addresses(testEtcdAddr), registry.TTL(10*time.Second))
+	reg2 := registry.NewRegistry(info, registry.Backend(b), registry.TTL(10*time.Second))
 	_ = reg2.Start()
 
 	t.Run("start etcd error", func(t *testing.T) {
@@ -53,7 +73,7 @@ func TestStart(t *testing.T) {
 		assert.NotNil(t, err)
 	})
 
-	dis := NewDiscovery(Addresses(testEtcdAddr))
+	dis := NewDiscovery(Backend(b))
 
 	t.Run("start success", func(t *testing.T) {
 		err := dis.Start("")
@@ -68,11 +88,13 @@ func TestStart(t *testing.T) {
 	t.Run("start modify svr info", func(t *testing.T) {
 		info.Name = "zacyuan.com"
 		info.Host = "127.0.0.1:4003"
-		reg := registry.NewRegistry(info, registry.Addresses(testEtcdAddr), registry.TTL(10*time.Second))
+		reg := registry.NewRegistry(info, registry.Backend(b), registry.TTL(10*time.Second))
 		_ = reg.Start()
 		time.Sleep(1 * time.Second)
+		assert.Equal(t, 2, len(dis.GetAll("zacyuan.com")))
 		_ = reg.Stop()
 		time.Sleep(1 * time.Second)
+		assert.Equal(t, 1, len(dis.GetAll("zacyuan.com")))
 	})
 
 	t.Run("Select success", func(t *testing.T) {
@@ -90,6 +112,15 @@ func TestStart(t *testing.T) {
 		assert.Nil(t, srv)
 	})
 
+	t.Run("Filter success", func(t *testing.T) {
+		srvs := dis.Filter("zacyuan.com")
+		assert.Equal(t, 1, len(srvs))
+
+		srvs = dis.Filter("zacyuan.com", selector.NewRandom())
+		assert.Equal(t, 1, len(srvs))
+		assert.Nil(t, dis.Filter("zacyuan.com.xyz"))
+	})
+
 	t.Run("GetAll success", func(t *testing.T) {
 		srvs := dis.GetAll("zacyuan.com")
 		assert.Less(t, 0, len(srvs))
@@ -113,6 +144,596 @@ func TestStart(t *testing.T) {
 
 }
 
+func TestLeaseExpire(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+
+	dis := NewDiscovery(Backend(b))
+	err := dis.Start("zacyuan.com")
+	assert.Nil(t, err)
+
+	info := service.NewService()
+	info.Name = "zacyuan.com"
+	info.Host = "127.0.0.1:4001"
+	reg := registry.NewRegistry(info, registry.Backend(b), registry.TTL(10*time.Second))
+	err = reg.Start()
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, len(dis.GetAll("zacyuan.com")))
+
+	// 租约过期后实例被删除，registry重新注册后实例恢复
+	for _, id := range b.Leases() {
+		_ = b.ExpireLease(id)
+	}
+	time.Sleep(500 * time.Millisecond)
+	srvs := dis.GetAll("zacyuan.com")
+	assert.Equal(t, 1, len(srvs))
+	assert.Equal(t, info.ID, srvs[0].ID)
+
+	_ = reg.Stop()
+	_ = dis.Stop()
+}
+
+func TestSubscribe(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+
+	ch := make(chan string, 10)
+	dis := NewDiscovery(Backend(b))
+	cancel := dis.Subscribe(func(name string) {
+		ch <- name
+	})
+
+	err := dis.Start("")
+	assert.Nil(t, err)
+
+	info := service.NewService()
+	info.Name = "zacyuan.com"
+	info.Host = "127.0.0.1:4001"
+	reg := registry.NewRegistry(info, registry.Backend(b), registry.TTL(10*time.Second))
+	err = reg.Start()
+	assert.Nil(t, err)
+
+	select {
+	case name := <-ch:
+		assert.Equal(t, "zacyuan.com", name)
+	case <-time.After(time.Second):
+		t.Fatal("no notify")
+	}
+
+	// 取消订阅后不再通知
+	cancel()
+	_ = reg.Stop()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, len(ch))
+	assert.Equal(t, 0, len(dis.GetAll("zacyuan.com")))
+	_ = dis.Stop()
+}
+
+func nextEvent(t *testing.T, ch <-chan *Event) *Event {
+	select {
+	case ev := <-ch:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("no event")
+	}
+	return nil
+}
+
+func TestWatch(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+
+	info := service.NewService()
+	info.Name = "zacyuan.com"
+	info.Host = "127.0.0.1:4001"
+	_ = b.Put(context.Background(), "/srsd/services/zacyuan.com/"+info.ID, toJSON(info), backend.NoLease)
+
+	var events []*Event
+	var m sync.Mutex
+	dis := NewDiscovery(Backend(b))
+	dis.opts.Watch = func(ev *Event) {
+		m.Lock()
+		defer m.Unlock()
+		events = append(events, ev)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 启动前监听，加载的服务以Added事件推送
+	all := dis.Watch(ctx, "")
+	ev := nextEvent(t, all)
+	assert.Equal(t, EventSnapshot, ev.Type)
+	assert.Equal(t, 0, len(ev.Services))
+
+	err := dis.Start("")
+	assert.Nil(t, err)
+	ev = nextEvent(t, all)
+	assert.Equal(t, EventAdded, ev.Type)
+	assert.Equal(t, "zacyuan.com", ev.Name)
+	assert.Equal(t, info.ID, ev.New.ID)
+
+	// 启动后监听，第一个事件为当前快照
+	ch := dis.Watch(ctx, "zacyuan.com")
+	ev = nextEvent(t, ch)
+	assert.Equal(t, EventSnapshot, ev.Type)
+	assert.Equal(t, "zacyuan.com", ev.Name)
+	assert.Equal(t, 1, len(ev.Services))
+
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	other := dis.Watch(ctx2, "other.com")
+	ev = nextEvent(t, other)
+	assert.Equal(t, EventSnapshot, ev.Type)
+	assert.Equal(t, 0, len(ev.Services))
+
+	info2 := *info
+	info2.Host = "127.0.0.1:4002"
+	_ = b.Put(context.Background(), "/srsd/services/zacyuan.com/"+info.ID, toJSON(&info2), backend.NoLease)
+	ev = nextEvent(t, ch)
+	assert.Equal(t, EventUpdated, ev.Type)
+	assert.Equal(t, "127.0.0.1:4001", ev.Old.Host)
+	assert.Equal(t, "127.0.0.1:4002", ev.New.Host)
+	assert.Equal(t, EventUpdated, nextEvent(t, all).Type)
+
+	_ = b.Delete(context.Background(), "/srsd/services/zacyuan.com/"+info.ID)
+	ev = nextEvent(t, ch)
+	assert.Equal(t, EventRemoved, ev.Type)
+	assert.Equal(t, info.ID, ev.Old.ID)
+	assert.Equal(t, EventRemoved, nextEvent(t, all).Type)
+
+	// 其他服务的监听者不会收到事件，ctx结束后通道关闭
+	cancel2()
+	_, ok := <-other
+	assert.False(t, ok)
+
+	m.Lock()
+	assert.Equal(t, 3, len(events))
+	m.Unlock()
+	_ = dis.Stop()
+}
+
+func putService(t *testing.T, b backend.Backend, name, host string) *service.Service {
+	info := service.NewService()
+	info.Name = name
+	info.Host = host
+	assert.Nil(t, b.Put(context.Background(), "/srsd/services/"+name+"/"+info.ID, toJSON(info), backend.NoLease))
+	return info
+}
+
+func TestWatchResume(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+	ctx := context.Background()
+
+	srv1 := putService(t, b, "zacyuan.com", "127.0.0.1:4001")
+	dis := NewDiscovery(Backend(b), Backoff(testBackoff))
+	assert.Nil(t, dis.Start(""))
+	ch := dis.Watch(ctx, "zacyuan.com")
+	assert.Equal(t, EventSnapshot, nextEvent(t, ch).Type)
+
+	// 监听中断期间的变化在重新监听后按版本补齐
+	b.DropWatches()
+	srv2 := putService(t, b, "zacyuan.com", "127.0.0.1:4002")
+	assert.Nil(t, b.Delete(ctx, "/srsd/services/zacyuan.com/"+srv1.ID))
+
+	time.Sleep(300 * time.Millisecond)
+	srvs := dis.GetAll("zacyuan.com")
+	assert.Equal(t, 1, len(srvs))
+	assert.Equal(t, srv2.ID, srvs[0].ID)
+
+	ev := nextEvent(t, ch)
+	assert.Equal(t, EventAdded, ev.Type)
+	assert.Equal(t, srv2.ID, ev.New.ID)
+	ev = nextEvent(t, ch)
+	assert.Equal(t, EventRemoved, ev.Type)
+	assert.Equal(t, srv1.ID, ev.Old.ID)
+	_ = dis.Stop()
+}
+
+// revBackend 按顺序返回预设的监听响应后关闭监听，并记录每次监听的起始版本
+type revBackend struct {
+	backend.Backend
+	m     sync.Mutex
+	resps [][]*backend.WatchResponse
+	revs  []int64
+}
+
+func (c *revBackend) Watch(ctx context.Context, prefix string, rev int64) <-chan *backend.WatchResponse {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.revs = append(c.revs, rev)
+	if len(c.resps) == 0 {
+		return c.Backend.Watch(ctx, prefix, rev)
+	}
+
+	ch := make(chan *backend.WatchResponse, len(c.resps[0]))
+	for _, one := range c.resps[0] {
+		ch <- one
+	}
+	close(ch)
+	c.resps = c.resps[1:]
+	return ch
+}
+
+func TestWatchResumeRevision(t *testing.T) {
+	mem := memory.NewBackend()
+	defer mem.Close()
+	putService(t, mem, "zacyuan.com", "127.0.0.1:4001")
+	rev := mem.Revision()
+
+	srv := service.NewService()
+	srv.Name = "zacyuan.com"
+	srv.Host = "127.0.0.1:4002"
+	key := "/srsd/services/zacyuan.com/" + srv.ID
+	b := &revBackend{Backend: mem, resps: [][]*backend.WatchResponse{
+		// 响应版本晚于事件版本时，从最后送达的事件版本之后重新监听
+		{{Revision: rev + 5, Events: []*backend.Event{
+			{Type: backend.EventPut, Kv: &backend.KeyValue{Key: []byte(key), Value: []byte(toJSON(srv)), ModRevision: rev + 1}},
+		}}},
+		// 没有事件的进度通知使用响应版本
+		{{Revision: rev + 8}},
+	}}
+
+	dis := NewDiscovery(Backend(b), Backoff(testBackoff))
+	defer dis.Close()
+	assert.Nil(t, dis.Start("zacyuan.com"))
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 2, len(dis.GetAll("zacyuan.com")))
+	b.m.Lock()
+	assert.Equal(t, []int64{rev + 1, rev + 2, rev + 9}, b.revs)
+	b.m.Unlock()
+}
+
+func TestWatchCompacted(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+	ctx := context.Background()
+
+	srv1 := putService(t, b, "zacyuan.com", "127.0.0.1:4001")
+	srv2 := putService(t, b, "zacyuan.com", "127.0.0.1:4002")
+	dis := NewDiscovery(Backend(b), Backoff(testBackoff))
+	assert.Nil(t, dis.Start("zacyuan.com"))
+	assert.Equal(t, 2, len(dis.GetAll("zacyuan.com")))
+
+	// 中断期间的历史版本被压缩，重新加载全量数据并删除已下线的实例
+	b.DropWatches()
+	assert.Nil(t, b.Delete(ctx, "/srsd/services/zacyuan.com/"+srv1.ID))
+	srv3 := putService(t, b, "zacyuan.com", "127.0.0.1:4003")
+	b.Compact(b.Revision() + 1)
+
+	ch := dis.Watch(ctx, "zacyuan.com")
+	assert.Equal(t, EventSnapshot, nextEvent(t, ch).Type)
+
+	time.Sleep(300 * time.Millisecond)
+	ids := make(map[string]bool)
+	for _, one := range dis.GetAll("zacyuan.com") {
+		ids[one.ID] = true
+	}
+	assert.Equal(t, map[string]bool{srv2.ID: true, srv3.ID: true}, ids)
+
+	// 未变化的实例不产生事件
+	types := make(map[EventType]string)
+	for i := 0; i < 2; i++ {
+		ev := nextEvent(t, ch)
+		if ev.New != nil {
+			types[ev.Type] = ev.New.ID
+		} else {
+			types[ev.Type] = ev.Old.ID
+		}
+	}
+	assert.Equal(t, map[EventType]string{EventAdded: srv3.ID, EventRemoved: srv1.ID}, types)
+
+	// 压缩后的监听可以继续收到新事件
+	assert.Nil(t, b.Delete(ctx, "/srsd/services/zacyuan.com/"+srv2.ID))
+	ev := nextEvent(t, ch)
+	assert.Equal(t, EventRemoved, ev.Type)
+	assert.Equal(t, srv2.ID, ev.Old.ID)
+	_ = dis.Stop()
+}
+
+func TestStartRemoveStale(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+
+	srv := putService(t, b, "zacyuan.com", "127.0.0.1:4001")
+	dis := NewDiscovery(Backend(b))
+
+	// 缓存中已下线的实例在加载时被删除
+	stale := service.NewService()
+	stale.Name = "zacyuan.com"
+	dis.srvList["zacyuan.com"] = []*service.Service{stale}
+	dis.srvList["other.com"] = []*service.Service{service.NewService()}
+
+	assert.Nil(t, dis.Start("zacyuan.com"))
+	srvs := dis.GetAll("zacyuan.com")
+	assert.Equal(t, 1, len(srvs))
+	assert.Equal(t, srv.ID, srvs[0].ID)
+	assert.Equal(t, 1, len(dis.GetAll("other.com")))
+	_ = dis.Stop()
+}
+
+// downBackend 可以模拟不可用的存储后端
+type downBackend struct {
+	backend.Backend
+	m    sync.Mutex
+	down bool
+}
+
+func (c *downBackend) setDown(down bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.down = down
+}
+
+func (c *downBackend) Get(ctx context.Context, prefix string) (*backend.GetResponse, error) {
+	c.m.Lock()
+	down := c.down
+	c.m.Unlock()
+	if down {
+		return nil, context.DeadlineExceeded
+	}
+	return c.Backend.Get(ctx, prefix)
+}
+
+func (c *downBackend) Watch(ctx context.Context, prefix string, rev int64) <-chan *backend.WatchResponse {
+	c.m.Lock()
+	down := c.down
+	c.m.Unlock()
+	if down {
+		ch := make(chan *backend.WatchResponse, 1)
+		ch <- &backend.WatchResponse{Canceled: true, Err: context.DeadlineExceeded}
+		close(ch)
+		return ch
+	}
+	return c.Backend.Watch(ctx, prefix, rev)
+}
+
+func TestRetry(t *testing.T) {
+	mem := memory.NewBackend()
+	defer mem.Close()
+	b := &downBackend{Backend: mem}
+	putService(t, b, "zacyuan.com", "127.0.0.1:4001")
+
+	var m sync.Mutex
+	var attempts []int
+	onRetry := func(key string, attempt int, err error) {
+		m.Lock()
+		defer m.Unlock()
+		assert.Equal(t, "zacyuan.com", key)
+		assert.NotNil(t, err)
+		attempts = append(attempts, attempt)
+	}
+	dis := NewDiscovery(Backend(b), OnRetry(onRetry),
+		Backoff(backoff.Policy{Initial: 10 * time.Millisecond, Multiplier: 2, MaxAttempts: 3}))
+	defer dis.Close()
+	assert.Nil(t, dis.Start("zacyuan.com"))
+
+	// 达到最大重试次数后放弃监听，保留已加载的服务信息
+	b.setDown(true)
+	mem.DropWatches()
+	time.Sleep(200 * time.Millisecond)
+	m.Lock()
+	assert.Equal(t, []int{1, 2, 3}, attempts)
+	m.Unlock()
+	assert.Equal(t, StatusNone, dis.Status())
+	assert.NotNil(t, dis.Select("zacyuan.com"))
+
+	// 可以重新开始监听
+	b.setDown(false)
+	assert.Nil(t, dis.Start("zacyuan.com"))
+	assert.Equal(t, StatusLive, dis.Status())
+	putService(t, b, "zacyuan.com", "127.0.0.1:4002")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 2, len(dis.GetAll("zacyuan.com")))
+}
+
+func TestCacheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "srsd-cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache", "services.json")
+
+	mem := memory.NewBackend()
+	defer mem.Close()
+	b := &downBackend{Backend: mem}
+	srv1 := putService(t, b, "zacyuan.com", "127.0.0.1:4001")
+	srv2 := putService(t, b, "zacyuan.com", "127.0.0.1:4002")
+
+	// 正常启动后写入缓存文件
+	dis := NewDiscovery(Backend(b), CacheFile(path))
+	assert.Equal(t, StatusNone, dis.Status())
+	assert.Nil(t, dis.Start(""))
+	assert.Equal(t, StatusLive, dis.Status())
+	data, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), srv1.ID)
+	assert.Contains(t, string(data), srv2.ID)
+	_ = dis.Stop()
+	assert.Equal(t, StatusNone, dis.Status())
+
+	// 没有缓存文件时，存储后端不可用则启动失败
+	b.setDown(true)
+	dis = NewDiscovery(Backend(b), CacheFile(filepath.Join(dir, "none.json")))
+	assert.NotNil(t, dis.Start(""))
+	assert.Nil(t, dis.Select("zacyuan.com"))
+
+	// 存储后端不可用时使用缓存文件
+	dis = NewDiscovery(Backend(b), CacheFile(path), Backoff(testBackoff))
+	assert.Nil(t, dis.Start(""))
+	assert.Equal(t, StatusCached, dis.Status())
+	assert.Equal(t, 2, len(dis.GetAll("zacyuan.com")))
+	assert.NotNil(t, dis.Select("zacyuan.com"))
+
+	// 存储后端恢复后替换为最新数据
+	assert.Nil(t, mem.Delete(context.Background(), "/srsd/services/zacyuan.com/"+srv1.ID))
+	b.setDown(false)
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, StatusLive, dis.Status())
+	srvs := dis.GetAll("zacyuan.com")
+	assert.Equal(t, 1, len(srvs))
+	assert.Equal(t, srv2.ID, srvs[0].ID)
+
+	// 恢复后继续监听变化并更新缓存文件
+	srv3 := putService(t, b, "zacyuan.com", "127.0.0.1:4003")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 2, len(dis.GetAll("zacyuan.com")))
+	data, err = ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(data), srv1.ID)
+	assert.Contains(t, string(data), srv3.ID)
+	_ = dis.Stop()
+
+	// 使用缓存启动后达到最大重试次数时放弃监听，不再是缓存状态，保留已加载的服务信息
+	b.setDown(true)
+	dis = NewDiscovery(Backend(b), CacheFile(path),
+		Backoff(backoff.Policy{Initial: 10 * time.Millisecond, MaxAttempts: 2}))
+	assert.Nil(t, dis.Start(""))
+	assert.Equal(t, StatusCached, dis.Status())
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, StatusNone, dis.Status())
+	assert.Equal(t, 2, len(dis.GetAll("zacyuan.com")))
+	_ = dis.Stop()
+}
+
+func TestStatus(t *testing.T) {
+	assert.Equal(t, "NONE", StatusNone.String())
+	assert.Equal(t, "CACHED", StatusCached.String())
+	assert.Equal(t, "LIVE", StatusLive.String())
+	assert.Equal(t, "UNKNOWN", Status(10).String())
+}
+
+// waitGoroutines 等待协程数量回落到n以内
+func waitGoroutines(t *testing.T, n int) {
+	for i := 0; i < 100 && runtime.NumGoroutine() > n; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), n)
+}
+
+func TestUnwatch(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+	srv1 := putService(t, b, "zacyuan.com", "127.0.0.1:4001")
+	srv2 := putService(t, b, "zacyuan.cn", "127.0.0.1:4002")
+
+	dis := NewDiscovery(Backend(b))
+	defer dis.Close()
+	assert.Nil(t, dis.Start("zacyuan.com"))
+	assert.Nil(t, dis.Start("zacyuan.cn"))
+	ch := dis.Watch(context.Background(), "zacyuan.com")
+	assert.Equal(t, EventSnapshot, nextEvent(t, ch).Type)
+	assert.True(t, dis.Watching("zacyuan.com"))
+	assert.False(t, dis.Watching("zacyuan.net"))
+
+	// 停止监听后删除服务实例，不再接收变化
+	dis.Unwatch("zacyuan.com")
+	assert.False(t, dis.Watching("zacyuan.com"))
+	ev := nextEvent(t, ch)
+	assert.Equal(t, EventRemoved, ev.Type)
+	assert.Equal(t, srv1.ID, ev.Old.ID)
+	assert.Equal(t, 0, len(dis.GetAll("zacyuan.com")))
+	putService(t, b, "zacyuan.com", "127.0.0.1:4003")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 0, len(dis.GetAll("zacyuan.com")))
+
+	// 其他服务不受影响
+	assert.Equal(t, srv2.ID, dis.Select("zacyuan.cn").ID)
+	assert.Equal(t, StatusLive, dis.Status())
+	dis.Unwatch("zacyuan.cn")
+	dis.Unwatch("zacyuan.cn")
+	assert.Equal(t, StatusNone, dis.Status())
+
+	// 仍被其他前缀监听的实例保留
+	assert.Nil(t, dis.Start(""))
+	assert.Nil(t, dis.Start("zacyuan.cn"))
+	dis.Unwatch("zacyuan.cn")
+	assert.Equal(t, srv2.ID, dis.Select("zacyuan.cn").ID)
+
+	// 可以重新监听
+	assert.Nil(t, dis.Start("zacyuan.com"))
+	dis.Unwatch("")
+	assert.Equal(t, 2, len(dis.GetAll("zacyuan.com")))
+}
+
+func TestRestart(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+	srv1 := putService(t, b, "zacyuan.com", "127.0.0.1:4001")
+
+	dis := NewDiscovery(Backend(b))
+	defer dis.Close()
+	assert.Nil(t, dis.Start(""))
+	assert.Nil(t, dis.Stop())
+
+	// 停止期间的变化在重新启动后生效
+	srv2 := putService(t, b, "zacyuan.com", "127.0.0.1:4002")
+	assert.Nil(t, b.Delete(context.Background(), "/srsd/services/zacyuan.com/"+srv1.ID))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, srv1.ID, dis.Select("zacyuan.com").ID)
+
+	assert.Nil(t, dis.Start(""))
+	assert.Equal(t, StatusLive, dis.Status())
+	assert.Equal(t, srv2.ID, dis.Select("zacyuan.com").ID)
+
+	// 重新启动后继续监听变化
+	putService(t, b, "zacyuan.com", "127.0.0.1:4003")
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 2, len(dis.GetAll("zacyuan.com")))
+}
+
+func TestClose(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+	putService(t, b, "zacyuan.com", "127.0.0.1:4001")
+	before := runtime.NumGoroutine()
+
+	dis := NewDiscovery(Backend(b))
+	assert.Nil(t, dis.Start(""))
+	assert.Nil(t, dis.Start("zacyuan.com"))
+	ch := dis.Watch(context.Background(), "")
+	assert.Equal(t, EventSnapshot, nextEvent(t, ch).Type)
+	assert.Nil(t, dis.Stop())
+	assert.Nil(t, dis.Start(""))
+	assert.Less(t, before, runtime.NumGoroutine())
+
+	// Close关闭所有Watch通道并等待后台协程退出
+	assert.Nil(t, dis.Close())
+	_, ok := <-ch
+	assert.False(t, ok)
+	waitGoroutines(t, before)
+
+	// 使用缓存重试连接的协程同样退出
+	dir, err := ioutil.TempDir("", "srsd-cache")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "services.json")
+	dis = NewDiscovery(Backend(b), CacheFile(path))
+	assert.Nil(t, dis.Start(""))
+	assert.Nil(t, dis.Close())
+
+	down := &downBackend{Backend: b, down: true}
+	dis = NewDiscovery(Backend(down), CacheFile(path))
+	assert.Nil(t, dis.Start(""))
+	assert.Equal(t, StatusCached, dis.Status())
+	assert.Nil(t, dis.Close())
+	waitGoroutines(t, before)
+}
+
+func toJSON(srv *service.Service) string {
+	data, _ := json.Marshal(srv)
+	return string(data)
+}
+
+func TestEventType(t *testing.T) {
+	assert.Equal(t, "SNAPSHOT", EventSnapshot.String())
+	assert.Equal(t, "ADDED", EventAdded.String())
+	assert.Equal(t, "UPDATED", EventUpdated.String())
+	assert.Equal(t, "REMOVED", EventRemoved.String())
+	assert.Equal(t, "UNKNOWN", EventType(10).String())
+}
+
 func TestGetServiceName(t *testing.T) {
 	key := "/srsd/services/zacyuan.com/aaaa"
 	dis := NewDiscovery(Addresses(testEtcdAddr))
@@ -134,3 +755,259 @@ func TestGetServiceID(t *testing.T) {
 	id := dis.getServiceID(key)
 	assert.Equal(t, "aaaa", id)
 }
+
+func TestDrain(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+
+	var regs []*registry.Registry
+	for _, host := range []string{"127.0.0.1:4001", "127.0.0.1:4002"} {
+		info := service.NewService()
+		info.Name = "zacyuan.com"
+		info.Host = host
+		reg := registry.NewRegistry(info, registry.Backend(b), registry.DrainGrace(200*time.Millisecond))
+		assert.Nil(t, reg.Start())
+		defer reg.Stop()
+		regs = append(regs, reg)
+	}
+
+	dis := NewDiscovery(Backend(b))
+	assert.Nil(t, dis.Start(""))
+	defer dis.Close()
+
+	// 下线中的实例仍在服务列表中，但默认选择器不再选择
+	go func() {
+		_ = regs[0].Drain(context.Background())
+	}()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 2, len(dis.GetAll("zacyuan.com")))
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "127.0.0.1:4002", dis.Select("zacyuan.com").Host)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 1, len(dis.GetAll("zacyuan.com")))
+}
+
+func TestSelectWithKey(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+
+	for _, host := range []string{"127.0.0.1:4001", "127.0.0.1:4002", "127.0.0.1:4003"} {
+		info := service.NewService()
+		info.Name = "zacyuan.com"
+		info.Host = host
+		reg := registry.NewRegistry(info, registry.Backend(b))
+		assert.Nil(t, reg.Start())
+		defer reg.Stop()
+	}
+
+	dis := NewDiscovery(Backend(b))
+	assert.Nil(t, dis.Start(""))
+	defer dis.Close()
+
+	// 相同key总是选择同一实例
+	hash := selector.NewHash(0)
+	info := dis.SelectWithKey("zacyuan.com", "user-1", hash)
+	assert.NotNil(t, info)
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, info.ID, dis.SelectWithKey("zacyuan.com", "user-1", hash).ID)
+	}
+	assert.Equal(t, 1, len(dis.FilterWithKey("zacyuan.com", "user-1", hash)))
+	assert.Nil(t, dis.SelectWithKey("other.com", "user-1", hash))
+
+	// 默认轮询选择器忽略key
+	hosts := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		hosts[dis.SelectWithKey("zacyuan.com", "user-1").Host] = true
+	}
+	assert.Equal(t, 3, len(hosts))
+}
+
+func TestPick(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+
+	for _, host := range []string{"127.0.0.1:4001", "127.0.0.1:4002"} {
+		info := service.NewService()
+		info.Name = "zacyuan.com"
+		info.Host = host
+		reg := registry.NewRegistry(info, registry.Backend(b))
+		assert.Nil(t, reg.Start())
+		defer reg.Stop()
+	}
+
+	sel := selector.NewLeastRequest()
+	dis := NewDiscovery(Backend(b), Selectors(sel))
+	assert.Nil(t, dis.Start(""))
+	defer dis.Close()
+
+	// 未结束的请求使实例的活跃请求数增加，下一次选择另一个实例
+	h1 := dis.Pick("zacyuan.com")
+	assert.NotNil(t, h1)
+	h2 := dis.Pick("zacyuan.com")
+	assert.NotEqual(t, h1.Service.ID, h2.Service.ID)
+
+	h1.Done(nil, time.Millisecond)
+	h3 := dis.Pick("zacyuan.com")
+	assert.Equal(t, h1.Service.ID, h3.Service.ID)
+	h3.Done(nil, time.Millisecond)
+	assert.Equal(t, h1.Service.ID, dis.PickWithKey("zacyuan.com", "key").Service.ID)
+
+	assert.Nil(t, dis.Pick("other.com"))
+	assert.Nil(t, dis.PickWithKey("other.com", "key"))
+}
+
+func TestOutlier(t *testing.T) {
+	counts := map[string]int{"zacyuan.com": 4, "other.com": 1}
+	c := newOutlier(Outlier{Consecutive: 3, ErrorRate: 0.5, BaseEjection: time.Minute, MaxEjection: 150 * time.Second},
+		func(name string) int { return counts[name] })
+	assert.Equal(t, defaultMinRequests, c.cfg.MinRequests)
+	assert.Equal(t, defaultOutlierInterval, c.cfg.Interval)
+	assert.Equal(t, defaultMaxEjectionPercent, c.cfg.MaxEjectionPercent)
+	assert.Equal(t, defaultBaseEjection, newOutlier(Outlier{}, nil).cfg.BaseEjection)
+	assert.Equal(t, defaultMaxEjection, newOutlier(Outlier{}, nil).cfg.MaxEjection)
+
+	var srvs []*service.Service
+	for i := 0; i < 4; i++ {
+		srvs = append(srvs, service.NewService())
+	}
+	assert.Equal(t, srvs, c.Filter("zacyuan.com", srvs))
+	failed := errors.New("failed")
+
+	// 连续失败达到阈值时摘除，成功会重置连续失败次数
+	c.Feedback("zacyuan.com", srvs[0], failed, time.Millisecond)
+	c.Feedback("zacyuan.com", srvs[0], failed, time.Millisecond)
+	c.Feedback("zacyuan.com", srvs[0], nil, time.Millisecond)
+	c.Feedback("zacyuan.com", srvs[0], failed, time.Millisecond)
+	c.Feedback("zacyuan.com", srvs[0], failed, time.Millisecond)
+	assert.False(t, c.ejected("zacyuan.com", srvs[0]))
+	c.Feedback("zacyuan.com", srvs[0], failed, time.Millisecond)
+	assert.True(t, c.ejected("zacyuan.com", srvs[0]))
+	assert.Equal(t, srvs[1:], c.Filter("zacyuan.com", srvs))
+
+	// 摘除时间随摘除次数增加，不超过MaxEjection
+	st := c.hosts["zacyuan.com"].stats[srvs[0].ID]
+	assert.InDelta(t, int64(time.Minute), int64(time.Until(st.until)), float64(time.Second))
+	for _, d := range []time.Duration{2 * time.Minute, 150 * time.Second} {
+		st.until = time.Now()
+		for i := 0; i < 3; i++ {
+			c.Feedback("zacyuan.com", srvs[0], failed, time.Millisecond)
+		}
+		assert.InDelta(t, int64(d), int64(time.Until(st.until)), float64(time.Second))
+	}
+
+	// 摘除数量达到上限时不再摘除
+	for i := 0; i < 3; i++ {
+		c.Feedback("zacyuan.com", srvs[1], failed, time.Millisecond)
+	}
+	assert.False(t, c.ejected("zacyuan.com", srvs[1]))
+
+	// 错误率达到阈值时摘除
+	st.until = time.Now()
+	for i := 0; i < 10; i++ {
+		var err error
+		if i%2 == 1 {
+			err = failed
+		}
+		c.Feedback("zacyuan.com", srvs[2], err, time.Millisecond)
+	}
+	assert.True(t, c.ejected("zacyuan.com", srvs[2]))
+
+	// 摘除结束后恢复选择，统计周期内没有摘除时摘除次数减一
+	st = c.hosts["zacyuan.com"].stats[srvs[2].ID]
+	st.until = time.Now().Add(-c.cfg.Interval)
+	assert.Equal(t, 4, len(c.Filter("zacyuan.com", srvs)))
+	c.Feedback("zacyuan.com", srvs[2], nil, time.Millisecond)
+	assert.Equal(t, 0, st.ejections)
+
+	// 只有一个实例时不摘除
+	for i := 0; i < 3; i++ {
+		c.Feedback("other.com", srvs[3], failed, time.Millisecond)
+	}
+	assert.Equal(t, 1, len(c.Filter("other.com", srvs[3:])))
+}
+
+func TestOutlierPrune(t *testing.T) {
+	c := newOutlier(Outlier{Consecutive: 1, MaxEjectionPercent: 50}, func(name string) int { return 4 })
+	c.ttl = 50 * time.Millisecond
+	var srvs []*service.Service
+	for i := 0; i < 4; i++ {
+		srvs = append(srvs, service.NewService())
+	}
+	failed := errors.New("failed")
+
+	// 过滤时只传入部分实例，不影响其他实例的摘除状态与摘除数量上限
+	c.Feedback("zacyuan.com", srvs[0], failed, time.Millisecond)
+	assert.True(t, c.ejected("zacyuan.com", srvs[0]))
+	assert.Equal(t, 1, len(c.Filter("zacyuan.com", srvs[1:2])))
+	assert.True(t, c.ejected("zacyuan.com", srvs[0]))
+	c.Feedback("zacyuan.com", srvs[1], failed, time.Millisecond)
+	assert.True(t, c.ejected("zacyuan.com", srvs[1]))
+	c.Feedback("zacyuan.com", srvs[2], failed, time.Millisecond)
+	assert.False(t, c.ejected("zacyuan.com", srvs[2]))
+
+	// 超过ttl未使用且不在摘除期间的统计被删除
+	time.Sleep(60 * time.Millisecond)
+	c.Filter("zacyuan.com", srvs[3:])
+	assert.Equal(t, 2, len(c.hosts["zacyuan.com"].stats))
+	c.hosts["zacyuan.com"].stats[srvs[0].ID].until = time.Now()
+	time.Sleep(60 * time.Millisecond)
+	c.Filter("zacyuan.com", srvs[3:])
+	assert.Equal(t, 1, len(c.hosts["zacyuan.com"].stats))
+	assert.True(t, c.ejected("zacyuan.com", srvs[1]))
+}
+
+func TestOutlierDetection(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+
+	for _, host := range []string{"127.0.0.1:4001", "127.0.0.1:4002"} {
+		info := service.NewService()
+		info.Name = "zacyuan.com"
+		info.Host = host
+		reg := registry.NewRegistry(info, registry.Backend(b))
+		assert.Nil(t, reg.Start())
+		defer reg.Stop()
+	}
+
+	dis := NewDiscovery(Backend(b), OutlierDetection(Outlier{Consecutive: 2, BaseEjection: 200 * time.Millisecond, MaxEjectionPercent: 50}))
+	assert.Nil(t, dis.Start(""))
+	defer dis.Close()
+	assert.NotNil(t, dis.Outlier())
+	assert.Nil(t, NewDiscovery().Outlier())
+	assert.Nil(t, NewDiscovery().Ejected("zacyuan.com"))
+
+	// 连续失败的实例被摘除，GetAll仍然返回
+	var bad *service.Service
+	for i := 0; i < 4; i++ {
+		h := dis.Pick("zacyuan.com")
+		if h.Service.Host == "127.0.0.1:4001" {
+			bad = h.Service
+			h.Done(errors.New("failed"), 0)
+		} else {
+			h.Done(nil, 0)
+		}
+	}
+	assert.Equal(t, []*service.Service{bad}, dis.Ejected("zacyuan.com"))
+	assert.Equal(t, 2, len(dis.GetAll("zacyuan.com")))
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, "127.0.0.1:4002", dis.Select("zacyuan.com").Host)
+		assert.Equal(t, "127.0.0.1:4002", dis.SelectWithKey("zacyuan.com", "key", selector.NewHash(0)).Host)
+	}
+
+	// 同时最多摘除一半实例
+	for i := 0; i < 2; i++ {
+		dis.Feedback("zacyuan.com", dis.Select("zacyuan.com"), errors.New("failed"), time.Millisecond)
+	}
+	assert.Equal(t, 1, len(dis.Ejected("zacyuan.com")))
+
+	// 摘除时间结束后恢复选择
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, 0, len(dis.Ejected("zacyuan.com")))
+	hosts := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		hosts[dis.Select("zacyuan.com").Host] = true
+	}
+	assert.Equal(t, 2, len(hosts))
+}
@@ -0,0 +1,115 @@
+package discovery
+
+import (
+	"context"
+	"sync"
+
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+// EventType 服务事件类型
+type EventType int32
+
+const (
+	// EventSnapshot 开始监听时的服务快照
+	EventSnapshot EventType = iota
+	// EventAdded 新增服务实例
+	EventAdded
+	// EventUpdated 服务实例信息变化
+	EventUpdated
+	// EventRemoved 服务实例下线
+	EventRemoved
+)
+
+// String 事件类型名称
+func (c EventType) String() string {
+	switch c {
+	case EventSnapshot:
+		return "SNAPSHOT"
+	case EventAdded:
+		return "ADDED"
+	case EventUpdated:
+		return "UPDATED"
+	case EventRemoved:
+		return "REMOVED"
+	}
+	return "UNKNOWN"
+}
+
+// Event 服务变化事件
+type Event struct {
+	Type     EventType
+	Name     string             // 服务名，监听所有服务的快照事件中为空
+	Old      *service.Service   // 变化前的服务信息，Updated、Removed事件有效
+	New      *service.Service   // 变化后的服务信息，Added、Updated事件有效
+	Services []*service.Service // 当前所有实例，Snapshot事件有效
+}
+
+// watcher 单个服务的监听，事件先进入无界队列再由独立协程投递，避免阻塞服务发现
+type watcher struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	name   string
+	ch     chan *Event
+	signal chan struct{}
+
+	m     sync.Mutex
+	queue []*Event
+}
+
+func newWatcher(ctx context.Context, name string, snapshot *Event) *watcher {
+	ctx, cancel := context.WithCancel(ctx)
+	return &watcher{
+		ctx:    ctx,
+		cancel: cancel,
+		name:   name,
+		ch:     make(chan *Event),
+		signal: make(chan struct{}, 1),
+		queue:  []*Event{snapshot},
+	}
+}
+
+func (c *watcher) push(ev *Event) {
+	if c.name != "" && c.name != ev.Name {
+		return
+	}
+
+	c.m.Lock()
+	c.queue = append(c.queue, ev)
+	c.m.Unlock()
+
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (c *watcher) run() {
+	defer c.cancel()
+	defer close(c.ch)
+
+	for {
+		c.m.Lock()
+		queue := c.queue
+		c.queue = nil
+		c.m.Unlock()
+
+		for _, ev := range queue {
+			select {
+			case c.ch <- ev:
+			case <-c.ctx.Done():
+				return
+			}
+		}
+
+		if len(queue) > 0 {
+			continue
+		}
+
+		select {
+		case <-c.signal:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
@@ -3,6 +3,9 @@ package discovery
 import (
 	"time"
 
+	"github.com/yuanzhangcai/srsd/backend"
+	"github.com/yuanzhangcai/srsd/backend/etcd"
+	"github.com/yuanzhangcai/srsd/backoff"
 	"github.com/yuanzhangcai/srsd/selector"
 )
 
@@ -21,13 +24,19 @@ type Watch func(event int32, host string)
 
 // Options 服务注册参数
 type Options struct {
-	Addresses []string            // etcd地址
-	Username  string              // etcd用户名
-	Password  string              // etcd密码
-	Prefix    string              //服务注册前缀
-	Timeout   time.Duration       // etcd超时时间
-	Watch     func(event *Event)  // 服务发生变化时回调函数
-	Selectors []selector.Selector // 服务发现
+	Addresses []string                                 // etcd地址
+	Username  string                                   // etcd用户名
+	Password  string                                   // etcd密码
+	TLS       *etcd.TLSConfig                          // etcd TLS连接参数，为空时不使用TLS
+	Prefix    string                                   //服务注册前缀
+	Timeout   time.Duration                            // etcd超时时间
+	Watch     func(event *Event)                       // 服务发生变化时回调函数
+	Selectors []selector.Selector                      // 服务发现
+	Backend   backend.Backend                          // 存储后端，为空时使用etcd
+	CacheFile string                                   // 本地缓存文件，服务列表变化时写入，存储后端不可用时从该文件加载
+	Backoff   backoff.Policy                           // 重新监听、重新连接存储后端的退避策略
+	OnRetry   func(key string, attempt int, err error) // 监听或连接失败、等待下一次重试时回调，key为Start的参数，attempt从1开始
+	Outlier   *Outlier                                 // 异常实例检测参数，为空时不检测
 }
 
 // newOptions 创建服务注册参数对象
@@ -37,6 +46,7 @@ func newOptions(opts ...Option) *Options {
 		Prefix:    defaultPrefix,
 		Timeout:   defaultTimeout,
 		Selectors: defaultSelectors,
+		Backoff:   backoff.DefaultPolicy,
 	}
 
 	for _, one := range opts {
@@ -90,3 +100,45 @@ func Selectors(selectors ...selector.Selector) Option {
 		opt.Selectors = selectors
 	}
 }
+
+// Backend 设置存储后端，由调用方负责关闭
+func Backend(b backend.Backend) Option {
+	return func(opt *Options) {
+		opt.Backend = b
+	}
+}
+
+// CacheFile 设置本地缓存文件
+func CacheFile(path string) Option {
+	return func(opt *Options) {
+		opt.CacheFile = path
+	}
+}
+
+// Backoff 设置重新监听、重新连接存储后端的退避策略
+func Backoff(policy backoff.Policy) Option {
+	return func(opt *Options) {
+		opt.Backoff = policy
+	}
+}
+
+// OnRetry 设置监听或连接失败时的回调函数，可用于持续失败时告警
+func OnRetry(fn func(key string, attempt int, err error)) Option {
+	return func(opt *Options) {
+		opt.OnRetry = fn
+	}
+}
+
+// OutlierDetection 开启异常实例检测，调用结果通过Pick返回的Handle或Feedback上报
+func OutlierDetection(cfg Outlier) Option {
+	return func(opt *Options) {
+		opt.Outlier = &cfg
+	}
+}
+
+// TLS 设置etcd TLS连接参数，证书文件更新后自动重新加载
+func TLS(cfg etcd.TLSConfig) Option {
+	return func(opt *Options) {
+		opt.TLS = &cfg
+	}
+}
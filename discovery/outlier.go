@@ -0,0 +1,229 @@
+package discovery
+
+import (
+	"sync"
+	"time"
+
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+const (
+	defaultMinRequests        = 10
+	defaultOutlierInterval    = 10 * time.Second
+	defaultBaseEjection       = 30 * time.Second
+	defaultMaxEjection        = 5 * time.Minute
+	defaultMaxEjectionPercent = 10
+	// outlierTTL 实例统计超过该时间未使用且不在摘除期间时删除。实例可能只是暂时不在过滤的列表中，
+	// 如gRPC只传入已连接的实例，不能因此删除其摘除状态
+	outlierTTL = time.Minute
+)
+
+// Outlier 异常实例检测参数。实例连续失败或错误率过高时暂时摘除，摘除期间Select不选择该实例，GetAll仍然返回。
+// 第n次摘除的时间为 n*BaseEjection，不超过MaxEjection；实例恢复后每个统计周期摘除次数减一
+type Outlier struct {
+	Consecutive        int           // 连续失败次数达到该值时摘除，小于等于0时不按连续失败摘除
+	ErrorRate          float64       // 统计周期内错误率达到该值时摘除，取值(0, 1]，小于等于0时不按错误率摘除
+	MinRequests        int           // 按错误率摘除需要的最少请求数，默认10
+	Interval           time.Duration // 错误率统计周期，默认10秒
+	BaseEjection       time.Duration // 基础摘除时间，默认30秒
+	MaxEjection        time.Duration // 最长摘除时间，默认5分钟
+	MaxEjectionPercent int           // 同一服务最多摘除的实例百分比，默认10；实例数大于1时至少可以摘除一个实例
+}
+
+// outlier 异常实例检测，作为第一个选择器过滤被摘除的实例，并通过Feedback接收调用结果
+type outlier struct {
+	cfg    Outlier
+	count  func(name string) int // 服务的实例数，用于计算最多摘除的实例数
+	ttl    time.Duration
+	m      sync.Mutex
+	pruned time.Time
+	hosts  map[string]*outlierHosts
+}
+
+// outlierHosts 同一服务的实例统计
+type outlierHosts struct {
+	stats map[string]*outlierStat
+}
+
+// outlierStat 实例的调用统计
+type outlierStat struct {
+	consecutive int       // 连续失败次数
+	requests    int       // 统计周期内的请求数
+	failures    int       // 统计周期内的失败数
+	window      time.Time // 统计周期开始时间
+	ejections   int       // 摘除次数
+	until       time.Time // 摘除结束时间
+	seen        time.Time // 上次使用时间
+}
+
+// newOutlier 创建异常实例检测，count返回服务的实例数
+func newOutlier(cfg Outlier, count func(name string) int) *outlier {
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = defaultMinRequests
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultOutlierInterval
+	}
+	if cfg.BaseEjection <= 0 {
+		cfg.BaseEjection = defaultBaseEjection
+	}
+	if cfg.MaxEjection <= 0 {
+		cfg.MaxEjection = defaultMaxEjection
+	}
+	if cfg.MaxEjection < cfg.BaseEjection {
+		cfg.MaxEjection = cfg.BaseEjection
+	}
+	if cfg.MaxEjectionPercent <= 0 {
+		cfg.MaxEjectionPercent = defaultMaxEjectionPercent
+	}
+
+	return &outlier{
+		cfg:   cfg,
+		count: count,
+		ttl:   outlierTTL,
+		hosts: make(map[string]*outlierHosts),
+	}
+}
+
+// Filter 过滤被摘除的实例，并删除超过ttl未使用的实例统计
+func (c *outlier) Filter(name string, srvs []*service.Service) []*service.Service {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	now := time.Now()
+	c.prune(now)
+	hosts, ok := c.hosts[name]
+	if !ok {
+		return srvs
+	}
+
+	list := make([]*service.Service, 0, len(srvs))
+	for _, one := range srvs {
+		st, ok := hosts.stats[one.ID]
+		if ok {
+			st.seen = now
+			if now.Before(st.until) {
+				continue
+			}
+		}
+		list = append(list, one)
+	}
+	return list
+}
+
+// Feedback 记录调用结果，连续失败次数或错误率达到阈值时摘除实例。摘除期间的调用结果不计入统计
+func (c *outlier) Feedback(name string, srv *service.Service, err error, latency time.Duration) {
+	// 在加锁前获取实例数，count可能需要获取Discovery的锁
+	total := 0
+	if err != nil && c.count != nil {
+		total = c.count(name)
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	hosts := c.service(name)
+	st, ok := hosts.stats[srv.ID]
+	if !ok {
+		st = &outlierStat{}
+		hosts.stats[srv.ID] = st
+	}
+
+	now := time.Now()
+	st.seen = now
+	if now.Before(st.until) {
+		return
+	}
+
+	// 进入新的统计周期，未被摘除的实例摘除次数减一
+	if now.Sub(st.window) >= c.cfg.Interval {
+		if st.ejections > 0 && now.Sub(st.until) >= c.cfg.Interval {
+			st.ejections--
+		}
+		st.requests, st.failures, st.window = 0, 0, now
+	}
+
+	st.requests++
+	if err == nil {
+		st.consecutive = 0
+		return
+	}
+	st.consecutive++
+	st.failures++
+
+	if (c.cfg.Consecutive > 0 && st.consecutive >= c.cfg.Consecutive) ||
+		(c.cfg.ErrorRate > 0 && st.requests >= c.cfg.MinRequests && float64(st.failures) >= c.cfg.ErrorRate*float64(st.requests)) {
+		c.eject(hosts, st, total, now)
+	}
+}
+
+// eject 摘除实例，被摘除的实例数达到上限时不摘除，total为服务的实例数，为0时按有统计的实例数计算，需持有c.m
+func (c *outlier) eject(hosts *outlierHosts, st *outlierStat, total int, now time.Time) {
+	ejected := 0
+	for _, one := range hosts.stats {
+		if now.Before(one.until) {
+			ejected++
+		}
+	}
+
+	if total == 0 {
+		total = len(hosts.stats)
+	}
+	limit := total * c.cfg.MaxEjectionPercent / 100
+	if limit == 0 && total > 1 {
+		limit = 1
+	}
+	if ejected >= limit {
+		return
+	}
+
+	st.ejections++
+	d := c.cfg.BaseEjection * time.Duration(st.ejections)
+	if d > c.cfg.MaxEjection || d <= 0 {
+		d = c.cfg.MaxEjection
+	}
+	st.until = now.Add(d)
+	st.consecutive, st.requests, st.failures, st.window = 0, 0, 0, time.Time{}
+}
+
+// ejected 判断实例是否被摘除
+func (c *outlier) ejected(name string, srv *service.Service) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	hosts, ok := c.hosts[name]
+	if !ok {
+		return false
+	}
+	st, ok := hosts.stats[srv.ID]
+	return ok && time.Now().Before(st.until)
+}
+
+// service 获取服务的实例统计，需持有c.m
+func (c *outlier) service(name string) *outlierHosts {
+	hosts, ok := c.hosts[name]
+	if !ok {
+		hosts = &outlierHosts{stats: make(map[string]*outlierStat)}
+		c.hosts[name] = hosts
+	}
+	return hosts
+}
+
+// prune 删除超过ttl未使用且不在摘除期间的实例统计，每个ttl最多执行一次，需持有c.m
+func (c *outlier) prune(now time.Time) {
+	if now.Sub(c.pruned) < c.ttl {
+		return
+	}
+	c.pruned = now
+
+	for name, hosts := range c.hosts {
+		for id, st := range hosts.stats {
+			if !now.Before(st.until) && now.Sub(st.seen) >= c.ttl {
+				delete(hosts.stats, id)
+			}
+		}
+		if len(hosts.stats) == 0 {
+			delete(c.hosts, name)
+		}
+	}
+}
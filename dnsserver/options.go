@@ -0,0 +1,82 @@
+package dnsserver
+
+import (
+	"strings"
+	"time"
+
+	"github.com/yuanzhangcai/srsd/selector"
+)
+
+var (
+	defaultAddr    = ":5353"
+	defaultDomain  = "srsd."
+	defaultTTL     = 5 * time.Second
+	defaultTimeout = 5 * time.Second
+)
+
+// Option 设置DNS服务参数
+type Option func(*Options)
+
+// Options DNS服务参数
+type Options struct {
+	Addr      string              // 监听地址，同时监听UDP与TCP
+	Domain    string              // 服务域名后缀，查询 <服务名>.Domain
+	TTL       time.Duration       // 应答记录TTL
+	Timeout   time.Duration       // TCP连接读写超时时间
+	Selectors []selector.Selector // 服务选择器，为空时使用discovery配置的选择器
+}
+
+// newOptions 创建DNS服务参数对象
+func newOptions(opts ...Option) *Options {
+	opt := &Options{
+		Addr:    defaultAddr,
+		Domain:  defaultDomain,
+		TTL:     defaultTTL,
+		Timeout: defaultTimeout,
+	}
+
+	for _, one := range opts {
+		one(opt)
+	}
+	return opt
+}
+
+// Addr 设置监听地址
+func Addr(addr string) Option {
+	return func(opt *Options) {
+		opt.Addr = addr
+	}
+}
+
+// Domain 设置服务域名后缀
+func Domain(domain string) Option {
+	domain = strings.ToLower(strings.Trim(domain, "."))
+	if domain != "" {
+		domain += "."
+	}
+
+	return func(opt *Options) {
+		opt.Domain = domain
+	}
+}
+
+// TTL 设置应答记录TTL
+func TTL(ttl time.Duration) Option {
+	return func(opt *Options) {
+		opt.TTL = ttl
+	}
+}
+
+// Timeout 设置TCP连接读写超时时间
+func Timeout(timeout time.Duration) Option {
+	return func(opt *Options) {
+		opt.Timeout = timeout
+	}
+}
+
+// Selectors 设置服务选择器
+func Selectors(selectors ...selector.Selector) Option {
+	return func(opt *Options) {
+		opt.Selectors = selectors
+	}
+}
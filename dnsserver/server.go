@@ -0,0 +1,452 @@
+package dnsserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuanzhangcai/srsd/discovery"
+	"github.com/yuanzhangcai/srsd/service"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	maxUDPSize  = 512  // 未携带EDNS0时的UDP应答长度上限
+	maxEDNSSize = 4096 // EDNS0协商的UDP应答长度上限
+)
+
+// ErrEmptyDomain 域名后缀为空
+var ErrEmptyDomain = errors.New("dnsserver: empty domain")
+
+// Server 基于服务发现缓存的DNS服务，应答 <服务名>.srsd. 的A/AAAA/SRV查询，
+// 供无法使用discovery包的非Go客户端(nginx、C++程序、脚本等)使用
+type Server struct {
+	opts    *Options
+	dis     *discovery.Discovery
+	m       sync.Mutex
+	wg      sync.WaitGroup
+	udp     net.PacketConn
+	tcp     net.Listener
+	started bool
+}
+
+// NewServer 创建DNS服务，dis需由调用方启动
+func NewServer(dis *discovery.Discovery, opts ...Option) *Server {
+	return &Server{
+		opts: newOptions(opts...),
+		dis:  dis,
+	}
+}
+
+// Start 开始监听UDP与TCP端口
+func (c *Server) Start() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.started {
+		return nil
+	}
+
+	if c.opts.Domain == "" {
+		return ErrEmptyDomain
+	}
+
+	udp, err := net.ListenPacket("udp", c.opts.Addr)
+	if err != nil {
+		return err
+	}
+
+	// 端口为0时TCP使用与UDP相同的端口
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		_ = udp.Close()
+		return err
+	}
+
+	c.udp = udp
+	c.tcp = tcp
+	c.started = true
+
+	c.wg.Add(2)
+	go c.serveUDP(udp)
+	go c.serveTCP(tcp)
+	return nil
+}
+
+// Addr 获取实际监听地址
+func (c *Server) Addr() string {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.udp == nil {
+		return ""
+	}
+	return c.udp.LocalAddr().String()
+}
+
+// Stop 停止DNS服务，等待处理中的请求结束
+func (c *Server) Stop() error {
+	c.m.Lock()
+	if !c.started {
+		c.m.Unlock()
+		return nil
+	}
+
+	_ = c.udp.Close()
+	_ = c.tcp.Close()
+	c.started = false
+	c.m.Unlock()
+
+	c.wg.Wait()
+	return nil
+}
+
+func (c *Server) serveUDP(conn net.PacketConn) {
+	defer c.wg.Done()
+
+	buf := make([]byte, maxEDNSSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if isTemporary(err) {
+				continue
+			}
+			return
+		}
+
+		resp := c.handle(buf[:n], true)
+		if resp != nil {
+			_, _ = conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+func (c *Server) serveTCP(ln net.Listener) {
+	defer c.wg.Done()
+
+	var conns sync.WaitGroup
+	defer conns.Wait()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if isTemporary(err) {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			return
+		}
+
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			c.serveConn(conn)
+		}()
+	}
+}
+
+// serveConn 处理TCP连接，连接上可以连续发送多个查询
+func (c *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		_ = conn.SetDeadline(time.Now().Add(c.opts.Timeout))
+
+		var length uint16
+		err := binary.Read(conn, binary.BigEndian, &length)
+		if err != nil {
+			return
+		}
+
+		req := make([]byte, length)
+		_, err = io.ReadFull(conn, req)
+		if err != nil {
+			return
+		}
+
+		resp := c.handle(req, false)
+		if resp == nil {
+			return
+		}
+
+		data := make([]byte, 2+len(resp))
+		binary.BigEndian.PutUint16(data, uint16(len(resp)))
+		copy(data[2:], resp)
+		_, err = conn.Write(data)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// handle 处理单个查询，返回打包后的应答，请求无法解析时返回nil
+func (c *Server) handle(req []byte, udp bool) []byte {
+	msg := &dnsmessage.Message{}
+	err := msg.Unpack(req)
+	if err != nil || msg.Response {
+		return nil
+	}
+
+	resp := &dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:               msg.ID,
+			Response:         true,
+			OpCode:           msg.OpCode,
+			RecursionDesired: msg.RecursionDesired,
+		},
+		Questions: msg.Questions,
+	}
+
+	size := maxUDPSize
+	var edns []dnsmessage.Resource
+	for _, one := range msg.Additionals {
+		if one.Header.Type != dnsmessage.TypeOPT {
+			continue
+		}
+
+		// 请求携带EDNS0时，应答同样携带并按协商的长度截断
+		if int(one.Header.Class) > size {
+			size = int(one.Header.Class)
+		}
+		if size > maxEDNSSize {
+			size = maxEDNSSize
+		}
+		opt := dnsmessage.Resource{Body: &dnsmessage.OPTResource{}}
+		_ = opt.Header.SetEDNS0(maxEDNSSize, dnsmessage.RCodeSuccess, false)
+		edns = append(edns, opt)
+		resp.Additionals = append(resp.Additionals, opt)
+		break
+	}
+
+	switch {
+	case msg.OpCode != 0:
+		resp.RCode = dnsmessage.RCodeNotImplemented
+	case len(msg.Questions) != 1:
+		resp.RCode = dnsmessage.RCodeFormatError
+	default:
+		c.answer(resp, msg.Questions[0])
+	}
+
+	data, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+
+	if udp && len(data) > size {
+		// 应答过长，设置截断标志，客户端改用TCP重试
+		resp.Truncated = true
+		resp.Answers = nil
+		resp.Authorities = nil
+		resp.Additionals = edns
+		data, err = resp.Pack()
+		if err != nil {
+			return nil
+		}
+	}
+	return data
+}
+
+// answer 根据服务发现缓存填充应答记录
+func (c *Server) answer(resp *dnsmessage.Message, q dnsmessage.Question) {
+	// 服务名只包含ASCII字符，非ASCII域名转小写后长度可能变化，直接拒绝
+	name := q.Name.String()
+	if !isASCII(name) {
+		resp.RCode = dnsmessage.RCodeRefused
+		return
+	}
+
+	qname := strings.ToLower(name)
+	if qname != c.opts.Domain && !strings.HasSuffix(qname, "."+c.opts.Domain) {
+		resp.RCode = dnsmessage.RCodeRefused
+		return
+	}
+	resp.Authoritative = true
+
+	name = strings.TrimSuffix(name[:len(qname)-len(c.opts.Domain)], ".")
+	for strings.HasPrefix(name, "_") && strings.Contains(name, ".") {
+		// 去掉SRV查询中的 _service._proto 前缀
+		name = name[strings.Index(name, ".")+1:]
+	}
+	if name == "" {
+		return
+	}
+
+	srvName, list, ok := c.lookup(name)
+	if !ok {
+		// SRV记录中目标地址的A/AAAA查询
+		ip, ok := c.lookupTarget(name)
+		if !ok {
+			resp.RCode = dnsmessage.RCodeNameError
+			return
+		}
+
+		if rr, ok := c.addrResource(q.Name, q.Type, ip); ok {
+			resp.Answers = append(resp.Answers, rr)
+		}
+		return
+	}
+
+	for _, srv := range list {
+		host, port := splitHost(srv.Host)
+		ip := net.ParseIP(host)
+
+		switch q.Type {
+		case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+			if rr, ok := c.addrResource(q.Name, q.Type, ip); ok {
+				resp.Answers = append(resp.Answers, rr)
+			}
+		case dnsmessage.TypeSRV:
+			if port == 0 {
+				continue
+			}
+
+			target := host
+			if ip != nil {
+				target = encodeIP(ip) + "." + srvName + "." + c.opts.Domain
+			}
+			if !strings.HasSuffix(target, ".") {
+				target += "."
+			}
+			tname, err := dnsmessage.NewName(target)
+			if err != nil {
+				continue
+			}
+
+			weight := srv.GetWeight()
+			if weight > math.MaxUint16 {
+				weight = math.MaxUint16
+			}
+			resp.Answers = append(resp.Answers, dnsmessage.Resource{
+				Header: c.header(q.Name, dnsmessage.TypeSRV),
+				Body:   &dnsmessage.SRVResource{Priority: 0, Weight: uint16(weight), Port: port, Target: tname},
+			})
+
+			if ip == nil {
+				continue
+			}
+			qtype := dnsmessage.TypeA
+			if ip.To4() == nil {
+				qtype = dnsmessage.TypeAAAA
+			}
+			if rr, ok := c.addrResource(tname, qtype, ip); ok {
+				resp.Additionals = append(resp.Additionals, rr)
+			}
+		}
+	}
+}
+
+// lookup 按服务名查找经选择器过滤后的服务列表，服务不存在时返回false
+func (c *Server) lookup(name string) (string, []*service.Service, bool) {
+	// 客户端可能随机改变查询域名的大小写(0x20编码)，原样查找失败时按小写查找
+	for _, one := range []string{name, strings.ToLower(name)} {
+		if len(c.dis.GetAll(one)) == 0 {
+			continue
+		}
+		return one, c.dis.Filter(one, c.opts.Selectors...), true
+	}
+	return "", nil, false
+}
+
+// lookupTarget 解析SRV目标地址 <编码后的IP>.<服务名>，IP需属于该服务
+func (c *Server) lookupTarget(name string) (net.IP, bool) {
+	index := strings.Index(name, ".")
+	if index <= 0 {
+		return nil, false
+	}
+
+	ip := decodeIP(name[:index])
+	if ip == nil {
+		return nil, false
+	}
+
+	srvName := name[index+1:]
+	for _, one := range []string{srvName, strings.ToLower(srvName)} {
+		for _, srv := range c.dis.GetAll(one) {
+			host, _ := splitHost(srv.Host)
+			if addr := net.ParseIP(host); addr != nil && addr.Equal(ip) {
+				return ip, true
+			}
+		}
+	}
+	return nil, false
+}
+
+func (c *Server) header(name dnsmessage.Name, qtype dnsmessage.Type) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{
+		Name:  name,
+		Type:  qtype,
+		Class: dnsmessage.ClassINET,
+		TTL:   uint32(c.opts.TTL / time.Second),
+	}
+}
+
+// addrResource 生成A/AAAA记录，IP类型与查询类型不一致时返回false
+func (c *Server) addrResource(name dnsmessage.Name, qtype dnsmessage.Type, ip net.IP) (dnsmessage.Resource, bool) {
+	if ip == nil {
+		return dnsmessage.Resource{}, false
+	}
+
+	ip4 := ip.To4()
+	switch {
+	case qtype == dnsmessage.TypeA && ip4 != nil:
+		body := &dnsmessage.AResource{}
+		copy(body.A[:], ip4)
+		return dnsmessage.Resource{Header: c.header(name, qtype), Body: body}, true
+	case qtype == dnsmessage.TypeAAAA && ip4 == nil:
+		body := &dnsmessage.AAAAResource{}
+		copy(body.AAAA[:], ip.To16())
+		return dnsmessage.Resource{Header: c.header(name, qtype), Body: body}, true
+	}
+	return dnsmessage.Resource{}, false
+}
+
+// splitHost 拆分服务地址，地址不带端口时端口为0
+func splitHost(addr string) (string, uint16) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return host, 0
+	}
+	return host, uint16(p)
+}
+
+// encodeIP 将IP编码为域名标签，如 10-0-0-1、fe80--1
+func encodeIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strings.Replace(ip4.String(), ".", "-", -1)
+	}
+	return strings.Replace(ip.String(), ":", "-", -1)
+}
+
+// decodeIP 解析encodeIP编码的域名标签
+func decodeIP(label string) net.IP {
+	if ip := net.ParseIP(strings.Replace(label, "-", ".", -1)); ip != nil {
+		return ip
+	}
+	return net.ParseIP(strings.Replace(label, "-", ":", -1))
+}
+
+// isASCII 判断字符串是否只包含ASCII字符
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+func isTemporary(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Temporary()
+}
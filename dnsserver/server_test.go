@@ -0,0 +1,239 @@
+package dnsserver
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuanzhangcai/srsd/backend/memory"
+	"github.com/yuanzhangcai/srsd/discovery"
+	"github.com/yuanzhangcai/srsd/registry"
+	"github.com/yuanzhangcai/srsd/service"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// all 返回全部服务的选择器
+type all struct{}
+
+func (c *all) Filter(name string, srvs []*service.Service) []*service.Service {
+	return srvs
+}
+
+func newTestServer(t *testing.T, hosts []string, opts ...Option) (*Server, func()) {
+	b := memory.NewBackend()
+
+	var regs []*registry.Registry
+	for _, host := range hosts {
+		info := service.NewService()
+		info.Name = "zacyuan.com"
+		info.Host = host
+		reg := registry.NewRegistry(info, registry.Backend(b), registry.TTL(10*time.Second))
+		assert.Nil(t, reg.Start())
+		regs = append(regs, reg)
+	}
+
+	dis := discovery.NewDiscovery(discovery.Backend(b))
+	assert.Nil(t, dis.Start(""))
+
+	srv := NewServer(dis, append([]Option{Addr("127.0.0.1:0")}, opts...)...)
+	assert.Nil(t, srv.Start())
+
+	return srv, func() {
+		_ = srv.Stop()
+		_ = dis.Stop()
+		for _, one := range regs {
+			_ = one.Stop()
+		}
+		_ = b.Close()
+	}
+}
+
+func newQuery(t *testing.T, name string, qtype dnsmessage.Type, edns bool) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1234, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+	if edns {
+		opt := dnsmessage.Resource{Body: &dnsmessage.OPTResource{}}
+		assert.Nil(t, opt.Header.SetEDNS0(4096, dnsmessage.RCodeSuccess, false))
+		msg.Additionals = append(msg.Additionals, opt)
+	}
+
+	req, err := msg.Pack()
+	assert.Nil(t, err)
+	return req
+}
+
+func queryUDP(t *testing.T, addr, name string, qtype dnsmessage.Type, edns bool) *dnsmessage.Message {
+	conn, err := net.Dial("udp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	_, err = conn.Write(newQuery(t, name, qtype, edns))
+	assert.Nil(t, err)
+
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	assert.Nil(t, err)
+
+	msg := &dnsmessage.Message{}
+	assert.Nil(t, msg.Unpack(buf[:n]))
+	assert.Equal(t, uint16(1234), msg.ID)
+	return msg
+}
+
+func queryTCP(t *testing.T, addr, name string, qtype dnsmessage.Type) *dnsmessage.Message {
+	conn, err := net.Dial("tcp", addr)
+	assert.Nil(t, err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	req := newQuery(t, name, qtype, false)
+	data := make([]byte, 2+len(req))
+	binary.BigEndian.PutUint16(data, uint16(len(req)))
+	copy(data[2:], req)
+	_, err = conn.Write(data)
+	assert.Nil(t, err)
+
+	var length uint16
+	assert.Nil(t, binary.Read(conn, binary.BigEndian, &length))
+	resp := make([]byte, length)
+	_, err = io.ReadFull(conn, resp)
+	assert.Nil(t, err)
+
+	msg := &dnsmessage.Message{}
+	assert.Nil(t, msg.Unpack(resp))
+	return msg
+}
+
+func TestNewServer(t *testing.T) {
+	srv := NewServer(nil, Addr(":53"), Domain(".Example.COM."), TTL(time.Second), Timeout(time.Second), Selectors(&all{}))
+	assert.Equal(t, ":53", srv.opts.Addr)
+	assert.Equal(t, "example.com.", srv.opts.Domain)
+	assert.Equal(t, time.Second, srv.opts.TTL)
+	assert.Equal(t, time.Second, srv.opts.Timeout)
+	assert.Equal(t, 1, len(srv.opts.Selectors))
+	assert.Equal(t, "", srv.Addr())
+
+	srv = NewServer(nil, Domain(""))
+	assert.Equal(t, ErrEmptyDomain, srv.Start())
+	assert.Nil(t, srv.Stop())
+}
+
+func TestSelector(t *testing.T) {
+	srv, stop := newTestServer(t, []string{"127.0.0.1:4001", "127.0.0.2:4002"})
+	defer stop()
+	addr := srv.Addr()
+
+	// 默认轮询选择器每次返回一个实例
+	hosts := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		msg := queryUDP(t, addr, "zacyuan.com.srsd.", dnsmessage.TypeA, false)
+		assert.Equal(t, dnsmessage.RCodeSuccess, msg.RCode)
+		assert.True(t, msg.Authoritative)
+		assert.Equal(t, 1, len(msg.Answers))
+		assert.Equal(t, uint32(5), msg.Answers[0].Header.TTL)
+		body := msg.Answers[0].Body.(*dnsmessage.AResource)
+		hosts[net.IP(body.A[:]).String()] = true
+	}
+	assert.Equal(t, 2, len(hosts))
+}
+
+func TestQuery(t *testing.T) {
+	srv, stop := newTestServer(t, []string{"127.0.0.1:4001", "127.0.0.2:4002", "[::1]:4003"}, Selectors(&all{}))
+	defer stop()
+	addr := srv.Addr()
+
+	t.Run("a", func(t *testing.T) {
+		msg := queryUDP(t, addr, "ZacYuan.com.SRSD.", dnsmessage.TypeA, false)
+		assert.Equal(t, dnsmessage.RCodeSuccess, msg.RCode)
+		assert.Equal(t, 2, len(msg.Answers))
+	})
+
+	t.Run("aaaa", func(t *testing.T) {
+		msg := queryTCP(t, addr, "zacyuan.com.srsd.", dnsmessage.TypeAAAA)
+		assert.Equal(t, dnsmessage.RCodeSuccess, msg.RCode)
+		assert.Equal(t, 1, len(msg.Answers))
+		body := msg.Answers[0].Body.(*dnsmessage.AAAAResource)
+		assert.Equal(t, "::1", net.IP(body.AAAA[:]).String())
+	})
+
+	t.Run("srv", func(t *testing.T) {
+		msg := queryUDP(t, addr, "_http._tcp.zacyuan.com.srsd.", dnsmessage.TypeSRV, false)
+		assert.Equal(t, dnsmessage.RCodeSuccess, msg.RCode)
+		assert.Equal(t, 3, len(msg.Answers))
+		assert.Equal(t, 3, len(msg.Additionals))
+
+		ports := make(map[string]string)
+		for _, one := range msg.Answers {
+			body := one.Body.(*dnsmessage.SRVResource)
+			ports[body.Target.String()] = strconv.Itoa(int(body.Port))
+			assert.Equal(t, uint16(1), body.Weight)
+		}
+		assert.Equal(t, "4001", ports["127-0-0-1.zacyuan.com.srsd."])
+		assert.Equal(t, "4003", ports["--1.zacyuan.com.srsd."])
+
+		// SRV目标地址可以单独解析
+		msg = queryUDP(t, addr, "127-0-0-2.zacyuan.com.srsd.", dnsmessage.TypeA, false)
+		assert.Equal(t, dnsmessage.RCodeSuccess, msg.RCode)
+		assert.Equal(t, 1, len(msg.Answers))
+
+		msg = queryUDP(t, addr, "127-0-0-9.zacyuan.com.srsd.", dnsmessage.TypeA, false)
+		assert.Equal(t, dnsmessage.RCodeNameError, msg.RCode)
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		msg := queryUDP(t, addr, "other.com.srsd.", dnsmessage.TypeA, false)
+		assert.Equal(t, dnsmessage.RCodeNameError, msg.RCode)
+		assert.Equal(t, 0, len(msg.Answers))
+
+		msg = queryUDP(t, addr, "srsd.", dnsmessage.TypeA, false)
+		assert.Equal(t, dnsmessage.RCodeSuccess, msg.RCode)
+	})
+
+	t.Run("refused", func(t *testing.T) {
+		msg := queryUDP(t, addr, "zacyuan.com.", dnsmessage.TypeA, false)
+		assert.Equal(t, dnsmessage.RCodeRefused, msg.RCode)
+
+		// 非ASCII或非法UTF-8域名
+		msg = queryUDP(t, addr, "\xff\xff\xff\xff.srsd.", dnsmessage.TypeA, false)
+		assert.Equal(t, dnsmessage.RCodeRefused, msg.RCode)
+		msg = queryUDP(t, addr, "İİ.zacyuan.com.srsd.", dnsmessage.TypeA, false)
+		assert.Equal(t, dnsmessage.RCodeRefused, msg.RCode)
+
+		// 服务仍可正常查询
+		msg = queryUDP(t, addr, "zacyuan.com.srsd.", dnsmessage.TypeA, false)
+		assert.Equal(t, dnsmessage.RCodeSuccess, msg.RCode)
+	})
+}
+
+func TestTruncate(t *testing.T) {
+	var hosts []string
+	for i := 1; i <= 60; i++ {
+		hosts = append(hosts, "10.0.0."+strconv.Itoa(i)+":4000")
+	}
+	srv, stop := newTestServer(t, hosts, Selectors(&all{}))
+	defer stop()
+	time.Sleep(100 * time.Millisecond)
+
+	msg := queryUDP(t, srv.Addr(), "zacyuan.com.srsd.", dnsmessage.TypeSRV, false)
+	assert.True(t, msg.Truncated)
+	assert.Equal(t, 0, len(msg.Answers))
+
+	// 携带EDNS0时可以返回更大的UDP应答
+	msg = queryUDP(t, srv.Addr(), "zacyuan.com.srsd.", dnsmessage.TypeA, true)
+	assert.False(t, msg.Truncated)
+	assert.Equal(t, 60, len(msg.Answers))
+	assert.Equal(t, 1, len(msg.Additionals))
+
+	msg = queryTCP(t, srv.Addr(), "zacyuan.com.srsd.", dnsmessage.TypeSRV)
+	assert.False(t, msg.Truncated)
+	assert.Equal(t, 60, len(msg.Answers))
+}
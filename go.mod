@@ -1,17 +1,21 @@
 module github.com/yuanzhangcai/srsd
 
-go 1.14
+go 1.15
 
 require (
 	github.com/coreos/etcd v3.3.22+incompatible
 	github.com/coreos/go-semver v0.3.0 // indirect
 	github.com/coreos/go-systemd v0.0.0-00010101000000-000000000000 // indirect
 	github.com/coreos/pkg v0.0.0-20180928190104-399ea9e2e55f // indirect
+	github.com/fsnotify/fsnotify v1.4.9
+	github.com/go-zookeeper/zk v1.0.3
 	github.com/gogo/protobuf v1.3.1 // indirect
 	github.com/google/uuid v1.1.1
 	github.com/stretchr/testify v1.6.1
 	go.uber.org/zap v1.15.0 // indirect
+	golang.org/x/net v0.0.0-20190620200207-3b0461eec859
 	google.golang.org/grpc v1.26.0
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
 
 replace github.com/coreos/go-systemd => github.com/coreos/go-systemd/v22 v22.1.0
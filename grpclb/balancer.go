@@ -0,0 +1,88 @@
+package grpclb
+
+import (
+	"github.com/yuanzhangcai/srsd/selector"
+	"github.com/yuanzhangcai/srsd/service"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Name 负载均衡器名称，解析器返回的服务配置默认使用该负载均衡器
+const Name = "srsd"
+
+func init() {
+	balancer.Register(base.NewBalancerBuilderV2(Name, &pickerBuilder{}, base.Config{}))
+}
+
+type pickerBuilder struct{}
+
+// Build 根据可用连接创建选择器，连接地址中带有解析器写入的服务信息
+func (c *pickerBuilder) Build(info base.PickerBuildInfo) balancer.V2Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPickerV2(balancer.ErrNoSubConnAvailable)
+	}
+
+	p := &picker{
+		conns: make(map[*service.Service]balancer.SubConn, len(info.ReadySCs)),
+	}
+	for sc, one := range info.ReadySCs {
+		attr := one.Address.Attributes
+		if attr == nil {
+			continue
+		}
+
+		srv, ok := attr.Value(serviceKey{}).(*service.Service)
+		if !ok {
+			continue
+		}
+
+		p.name, _ = attr.Value(nameKey{}).(string)
+		p.selectors, _ = attr.Value(selectorKey{}).([]selector.Selector)
+		p.srvs = append(p.srvs, srv)
+		p.conns[srv] = sc
+	}
+
+	if len(p.srvs) == 0 {
+		return base.NewErrPickerV2(balancer.ErrNoSubConnAvailable)
+	}
+	return p
+}
+
+// picker 使用服务选择器从可用连接中选择一个
+type picker struct {
+	name      string
+	selectors []selector.Selector
+	srvs      []*service.Service
+	conns     map[*service.Service]balancer.SubConn
+}
+
+// Pick 选择连接，调用结果上报给实现了selector.Feedback的选择器
+func (c *picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	list := c.srvs
+	for _, one := range c.selectors {
+		list = one.Filter(c.name, list)
+		if len(list) == 0 {
+			break
+		}
+	}
+
+	if len(list) == 0 {
+		return balancer.PickResult{}, status.Error(codes.Unavailable, ErrNoInstance.Error())
+	}
+
+	sc, ok := c.conns[list[0]]
+	if !ok {
+		return balancer.PickResult{}, balancer.ErrNoSubConnAvailable
+	}
+
+	// 调用结束时将结果上报给选择器
+	h := selector.NewHandle(c.selectors, c.name, list[0])
+	return balancer.PickResult{
+		SubConn: sc,
+		Done: func(info balancer.DoneInfo) {
+			h.Done(info.Err, 0)
+		},
+	}, nil
+}
@@ -0,0 +1,186 @@
+package grpclb
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuanzhangcai/srsd/backend/memory"
+	"github.com/yuanzhangcai/srsd/discovery"
+	"github.com/yuanzhangcai/srsd/registry"
+	"github.com/yuanzhangcai/srsd/selector"
+	"github.com/yuanzhangcai/srsd/service"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/resolver"
+)
+
+func newTestServer(t *testing.T, b *memory.Backend) (*grpc.Server, *registry.Registry, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	srv := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(srv, health.NewServer())
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+
+	info := service.NewService()
+	info.Name = "zacyuan.com"
+	info.Host = ln.Addr().String()
+	reg := registry.NewRegistry(info, registry.Backend(b), registry.TTL(10*time.Second))
+	assert.Nil(t, reg.Start())
+	return srv, reg, info.Host
+}
+
+// call 发起一次请求，返回实际处理请求的服务地址
+func call(t *testing.T, conn *grpc.ClientConn) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	var p peer.Peer
+	_, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{}, grpc.Peer(&p))
+	assert.Nil(t, err)
+	if p.Addr == nil {
+		return ""
+	}
+	return p.Addr.String()
+}
+
+func TestNewBuilder(t *testing.T) {
+	b := NewBuilder(nil)
+	assert.Equal(t, DefaultScheme, b.Scheme())
+
+	b = NewBuilder(nil, Scheme("zacyuan"), Selectors(selector.NewRandom()))
+	assert.Equal(t, "zacyuan", b.Scheme())
+	assert.Equal(t, 1, len(b.(*builder).opts.Selectors()))
+
+	_, err := b.Build(resolver.Target{Scheme: "zacyuan"}, nil, resolver.BuildOptions{})
+	assert.Equal(t, ErrEmptyService, err)
+}
+
+func TestDial(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+
+	srv1, reg1, host1 := newTestServer(t, b)
+	defer srv1.Stop()
+	srv2, reg2, host2 := newTestServer(t, b)
+	defer srv2.Stop()
+	defer reg2.Stop()
+
+	dis := discovery.NewDiscovery(discovery.Backend(b))
+	assert.Nil(t, dis.Start(""))
+	defer dis.Stop()
+	Register(dis)
+
+	conn, err := grpc.Dial("srsd:///zacyuan.com", grpc.WithInsecure())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// 默认使用轮询选择器，两个实例都连接成功后请求分发到两个实例
+	hosts := make(map[string]int)
+	for i := 0; i < 100 && (hosts[host1] == 0 || hosts[host2] == 0); i++ {
+		hosts[call(t, conn)]++
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Less(t, 0, hosts[host1])
+	assert.Less(t, 0, hosts[host2])
+
+	// 实例下线后，请求只发往剩余实例
+	assert.Nil(t, reg1.Stop())
+	time.Sleep(200 * time.Millisecond)
+	hosts = make(map[string]int)
+	for i := 0; i < 10; i++ {
+		hosts[call(t, conn)]++
+	}
+	assert.Equal(t, 10, hosts[host2])
+
+	// 调用方开启的监听在连接关闭后保留
+	assert.Nil(t, conn.Close())
+	assert.True(t, dis.Watching("zacyuan.com"))
+}
+
+func TestDialWithoutStart(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+
+	srv, reg, host := newTestServer(t, b)
+	defer srv.Stop()
+	defer reg.Stop()
+
+	// 解析器自动开启服务监听
+	dis := discovery.NewDiscovery(discovery.Backend(b))
+	defer dis.Stop()
+	Register(dis, Scheme("nostart"))
+	assert.False(t, dis.Watching("zacyuan.com"))
+
+	conn1, err := grpc.Dial("nostart:///zacyuan.com", grpc.WithInsecure())
+	assert.Nil(t, err)
+	conn2, err := grpc.Dial("nostart:///zacyuan.com", grpc.WithInsecure())
+	assert.Nil(t, err)
+	assert.Equal(t, host, call(t, conn1))
+	assert.Equal(t, host, call(t, conn2))
+	assert.True(t, dis.Watching("zacyuan.com"))
+
+	// 最后一个连接关闭后停止监听
+	assert.Nil(t, conn1.Close())
+	assert.True(t, dis.Watching("zacyuan.com"))
+	assert.Equal(t, host, call(t, conn2))
+	assert.Nil(t, conn2.Close())
+	assert.False(t, dis.Watching("zacyuan.com"))
+	assert.Equal(t, 0, len(dis.GetAll("zacyuan.com")))
+}
+
+// counter 记录请求开始与结束次数的选择器
+type counter struct {
+	*selector.Round
+	m     sync.Mutex
+	begin int
+	done  int
+}
+
+func (c *counter) Begin(name string, srv *service.Service) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.begin++
+}
+
+func (c *counter) Feedback(name string, srv *service.Service, err error, latency time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.done++
+}
+
+func TestFeedback(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+
+	srv, reg, _ := newTestServer(t, b)
+	defer srv.Stop()
+	defer reg.Stop()
+
+	dis := discovery.NewDiscovery(discovery.Backend(b))
+	assert.Nil(t, dis.Start(""))
+	defer dis.Stop()
+
+	sel := &counter{Round: selector.NewRound()}
+	Register(dis, Scheme("feedback"), Selectors(sel))
+	conn, err := grpc.Dial("feedback:///zacyuan.com", grpc.WithInsecure())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// 每次调用结束后上报结果
+	for i := 0; i < 3; i++ {
+		call(t, conn)
+	}
+	sel.m.Lock()
+	defer sel.m.Unlock()
+	assert.Equal(t, 3, sel.begin)
+	assert.Equal(t, 3, sel.done)
+}
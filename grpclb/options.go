@@ -0,0 +1,45 @@
+package grpclb
+
+import (
+	"github.com/yuanzhangcai/srsd/selector"
+)
+
+// Option 设置gRPC解析器参数
+type Option func(*Options)
+
+// Options gRPC解析器参数
+type Options struct {
+	Scheme    string                     // 解析器协议名，默认为srsd
+	Selectors func() []selector.Selector // 为每个连接创建选择器，默认使用循环选择器
+}
+
+// newOptions 创建gRPC解析器参数对象
+func newOptions(opts ...Option) *Options {
+	opt := &Options{
+		Scheme: DefaultScheme,
+		Selectors: func() []selector.Selector {
+			return []selector.Selector{selector.NewRound()}
+		},
+	}
+
+	for _, one := range opts {
+		one(opt)
+	}
+	return opt
+}
+
+// Scheme 设置解析器协议名
+func Scheme(scheme string) Option {
+	return func(opt *Options) {
+		opt.Scheme = scheme
+	}
+}
+
+// Selectors 设置选择器，所有连接共用同一组选择器
+func Selectors(selectors ...selector.Selector) Option {
+	return func(opt *Options) {
+		opt.Selectors = func() []selector.Selector {
+			return selectors
+		}
+	}
+}
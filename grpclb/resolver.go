@@ -0,0 +1,202 @@
+package grpclb
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/yuanzhangcai/srsd/discovery"
+	"github.com/yuanzhangcai/srsd/selector"
+	"github.com/yuanzhangcai/srsd/service"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// DefaultScheme 默认解析器协议名，grpc.Dial("srsd:///服务名")
+const DefaultScheme = "srsd"
+
+var (
+	// ErrEmptyService 目标地址中没有服务名
+	ErrEmptyService = errors.New("grpclb: empty service name")
+	// ErrNoInstance 服务没有可用实例
+	ErrNoInstance = errors.New("grpclb: no available instance")
+)
+
+// serviceConfig 使用srsd负载均衡器
+const serviceConfig = `{"loadBalancingPolicy":"` + Name + `"}`
+
+// attributes中保存的服务信息
+type (
+	nameKey     struct{}
+	serviceKey  struct{}
+	selectorKey struct{}
+)
+
+// Register 注册基于服务发现的gRPC解析器，解析的服务没有被dis监听时自动开启监听
+func Register(dis *discovery.Discovery, opts ...Option) {
+	resolver.Register(NewBuilder(dis, opts...))
+}
+
+// NewBuilder 创建基于服务发现的gRPC解析器
+func NewBuilder(dis *discovery.Discovery, opts ...Option) resolver.Builder {
+	return &builder{
+		dis:  dis,
+		opts: newOptions(opts...),
+		refs: make(map[string]int),
+	}
+}
+
+type builder struct {
+	dis  *discovery.Discovery
+	opts *Options
+	m    sync.Mutex
+	refs map[string]int // 由解析器开启监听的服务及使用该服务的解析器数
+}
+
+// Build 创建解析器，服务没有被监听时调用dis.Start开启监听，服务列表发生变化时更新连接地址
+func (c *builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	if target.Endpoint == "" {
+		return nil, ErrEmptyService
+	}
+
+	if err := c.watch(target.Endpoint); err != nil {
+		return nil, err
+	}
+
+	// 开启异常实例检测时最先过滤被摘除的实例
+	selectors := c.opts.Selectors()
+	if sel := c.dis.Outlier(); sel != nil {
+		selectors = append([]selector.Selector{sel}, selectors...)
+	}
+
+	r := &srsdResolver{
+		name:      target.Endpoint,
+		dis:       c.dis,
+		cc:        cc,
+		selectors: selectors,
+		attrs:     make(map[*service.Service]*attributes.Attributes),
+		release: func() {
+			c.unwatch(target.Endpoint)
+		},
+	}
+
+	sc := cc.ParseServiceConfig(serviceConfig)
+	if sc.Err == nil {
+		r.sc = sc
+	}
+
+	r.unsubscribe = c.dis.Subscribe(func(name string) {
+		if name == r.name {
+			r.update()
+		}
+	})
+	r.update()
+	return r, nil
+}
+
+// Scheme 解析器协议名
+func (c *builder) Scheme() string {
+	return c.opts.Scheme
+}
+
+// watch 服务没有被监听时开启监听，已由解析器开启监听的服务增加引用计数
+func (c *builder) watch(name string) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if n, ok := c.refs[name]; ok {
+		c.refs[name] = n + 1
+		return nil
+	}
+
+	// 调用方开启的监听由调用方负责停止
+	if c.dis.Watching(name) {
+		return nil
+	}
+	if err := c.dis.Start(name); err != nil {
+		return err
+	}
+	c.refs[name] = 1
+	return nil
+}
+
+// unwatch 减少引用计数，最后一个使用该服务的解析器关闭时停止由解析器开启的监听
+func (c *builder) unwatch(name string) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	n, ok := c.refs[name]
+	if !ok {
+		return
+	}
+	if n > 1 {
+		c.refs[name] = n - 1
+		return
+	}
+	delete(c.refs, name)
+	c.dis.Unwatch(name)
+}
+
+type srsdResolver struct {
+	name        string
+	dis         *discovery.Discovery
+	cc          resolver.ClientConn
+	sc          *serviceconfig.ParseResult
+	selectors   []selector.Selector
+	unsubscribe func()
+	release     func()
+	m           sync.Mutex
+	closed      bool
+	attrs       map[*service.Service]*attributes.Attributes
+}
+
+// update 将当前服务列表推送给gRPC连接
+func (c *srsdResolver) update() {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	list := c.dis.GetAll(c.name)
+	if len(list) == 0 {
+		c.cc.ReportError(ErrNoInstance)
+		return
+	}
+
+	// 服务信息不变时复用attributes，避免gRPC重建连接
+	attrs := make(map[*service.Service]*attributes.Attributes, len(list))
+	addrs := make([]resolver.Address, 0, len(list))
+	for _, srv := range list {
+		attr, ok := c.attrs[srv]
+		if !ok {
+			attr = attributes.New(nameKey{}, c.name, serviceKey{}, srv, selectorKey{}, c.selectors)
+		}
+		attrs[srv] = attr
+		addrs = append(addrs, resolver.Address{Addr: srv.Host, Attributes: attr})
+	}
+	c.attrs = attrs
+
+	c.cc.UpdateState(resolver.State{Addresses: addrs, ServiceConfig: c.sc})
+}
+
+// ResolveNow 重新推送服务列表
+func (c *srsdResolver) ResolveNow(resolver.ResolveNowOptions) {
+	c.update()
+}
+
+// Close 关闭解析器
+func (c *srsdResolver) Close() {
+	c.unsubscribe()
+
+	c.m.Lock()
+	if c.closed {
+		c.m.Unlock()
+		return
+	}
+	c.closed = true
+	c.m.Unlock()
+
+	c.release()
+}
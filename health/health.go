@@ -0,0 +1,107 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Checker 健康检查
+type Checker interface {
+	// Check 执行一次检查，返回nil表示健康，ctx带有检查超时时间
+	Check(ctx context.Context) error
+}
+
+// Func 自定义健康检查函数
+type Func func(ctx context.Context) error
+
+// Check 执行检查函数
+func (c Func) Check(ctx context.Context) error {
+	return c(ctx)
+}
+
+// httpChecker HTTP GET检查
+type httpChecker struct {
+	url    string
+	client *http.Client
+}
+
+// HTTP 创建HTTP GET检查，返回2xx、3xx状态码时为健康
+func HTTP(url string) Checker {
+	return &httpChecker{url: url, client: &http.Client{}}
+}
+
+func (c *httpChecker) Check(ctx context.Context) error {
+	req, err := http.NewRequest(http.MethodGet, c.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("health: http status %s", resp.Status)
+	}
+	return nil
+}
+
+// tcpChecker TCP连接检查
+type tcpChecker struct {
+	addr string
+}
+
+// TCP 创建TCP连接检查，能够建立连接时为健康
+func TCP(addr string) Checker {
+	return &tcpChecker{addr: addr}
+}
+
+func (c *tcpChecker) Check(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// grpcChecker gRPC健康检查协议
+type grpcChecker struct {
+	addr    string
+	service string
+	opts    []grpc.DialOption
+}
+
+// GRPC 创建gRPC健康检查，按grpc.health.v1协议查询service的状态，SERVING时为健康。
+// service为空时查询服务器整体状态，未指定opts时使用非加密连接
+func GRPC(addr, service string, opts ...grpc.DialOption) Checker {
+	if len(opts) == 0 {
+		opts = []grpc.DialOption{grpc.WithInsecure()}
+	}
+	return &grpcChecker{addr: addr, service: service, opts: opts}
+}
+
+func (c *grpcChecker) Check(ctx context.Context) error {
+	conn, err := grpc.DialContext(ctx, c.addr, append(c.opts, grpc.WithBlock())...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: c.service})
+	if err != nil {
+		return err
+	}
+
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return fmt.Errorf("health: grpc status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func timeout() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), time.Second)
+}
+
+// deadAddr 返回一个没有监听的地址
+func deadAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	return addr
+}
+
+func TestFunc(t *testing.T) {
+	ctx, cancel := timeout()
+	defer cancel()
+	assert.Nil(t, Func(func(ctx context.Context) error { return nil }).Check(ctx))
+	assert.Equal(t, assert.AnError, Func(func(ctx context.Context) error { return assert.AnError }).Check(ctx))
+}
+
+func TestHTTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := timeout()
+	defer cancel()
+	assert.Nil(t, HTTP(srv.URL+"/health").Check(ctx))
+	assert.NotNil(t, HTTP(srv.URL+"/other").Check(ctx))
+	assert.NotNil(t, HTTP("http://"+deadAddr(t)).Check(ctx))
+	assert.NotNil(t, HTTP(":").Check(ctx))
+
+	// 超时视为不健康
+	block := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer slow.Close()
+	defer close(block)
+	sctx, scancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer scancel()
+	assert.True(t, errors.Is(HTTP(slow.URL).Check(sctx), context.DeadlineExceeded))
+}
+
+func TestTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+
+	ctx, cancel := timeout()
+	defer cancel()
+	assert.Nil(t, TCP(ln.Addr().String()).Check(ctx))
+	assert.NotNil(t, TCP(deadAddr(t)).Check(ctx))
+}
+
+func TestGRPC(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	hs := grpchealth.NewServer()
+	srv := grpc.NewServer()
+	grpc_health_v1.RegisterHealthServer(srv, hs)
+	go func() {
+		_ = srv.Serve(ln)
+	}()
+	defer srv.Stop()
+	addr := ln.Addr().String()
+
+	ctx, cancel := timeout()
+	defer cancel()
+	assert.Nil(t, GRPC(addr, "").Check(ctx))
+
+	hs.SetServingStatus("zacyuan.com", grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	assert.NotNil(t, GRPC(addr, "zacyuan.com").Check(ctx))
+	hs.SetServingStatus("zacyuan.com", grpc_health_v1.HealthCheckResponse_SERVING)
+	assert.Nil(t, GRPC(addr, "zacyuan.com", grpc.WithInsecure()).Check(ctx))
+	assert.NotNil(t, GRPC(addr, "other.com").Check(ctx))
+
+	sctx, scancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer scancel()
+	assert.NotNil(t, GRPC(deadAddr(t), "").Check(sctx))
+}
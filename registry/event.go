@@ -0,0 +1,65 @@
+package registry
+
+import (
+	"errors"
+
+	"github.com/yuanzhangcai/srsd/backend"
+)
+
+// ErrLeaseLost 租约保持异常结束，服务可能已从服务发现中下线
+var ErrLeaseLost = errors.New("registry: lease lost")
+
+// EventType 服务注册事件类型
+type EventType int32
+
+const (
+	// EventRegistered Start注册成功
+	EventRegistered EventType = iota
+	// EventLeaseLost 租约保持异常结束，之后将自动重新注册
+	EventLeaseLost
+	// EventReregistering 开始一次重新注册，Err为上一次重新注册失败的原因
+	EventReregistering
+	// EventReregistered 重新注册成功，Lease为新的租约
+	EventReregistered
+	// EventDeregistered Stop注销成功
+	EventDeregistered
+	// EventUnhealthy 健康检查连续失败，实例已标记为DOWN或注销，Err为最后一次检查失败的原因
+	EventUnhealthy
+	// EventHealthy 健康检查恢复，实例已恢复为UP或重新注册
+	EventHealthy
+)
+
+// String 事件类型名称
+func (c EventType) String() string {
+	switch c {
+	case EventRegistered:
+		return "REGISTERED"
+	case EventLeaseLost:
+		return "LEASE_LOST"
+	case EventReregistering:
+		return "REREGISTERING"
+	case EventReregistered:
+		return "REREGISTERED"
+	case EventDeregistered:
+		return "DEREGISTERED"
+	case EventUnhealthy:
+		return "UNHEALTHY"
+	case EventHealthy:
+		return "HEALTHY"
+	}
+	return "UNKNOWN"
+}
+
+// Event 服务注册生命周期事件
+type Event struct {
+	Type  EventType
+	Lease backend.LeaseID // 事件对应的租约
+	Err   error           // 失败原因，LeaseLost、Reregistering、Unhealthy事件有效
+}
+
+// emit 回调事件函数，需在释放c.m后调用
+func (c *Registry) emit(ev *Event) {
+	if c.opts.OnEvent != nil {
+		c.opts.OnEvent(ev)
+	}
+}
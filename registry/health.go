@@ -0,0 +1,156 @@
+package registry
+
+import (
+	"context"
+	"time"
+
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+// startHealth 开启健康检查，需持有c.m
+func (c *Registry) startHealth() {
+	if c.opts.HealthCheck == nil || c.health != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.health = cancel
+	go c.healthLoop(ctx)
+}
+
+// healthLoop 按间隔执行健康检查，连续失败HealthThreshold次后标记为DOWN或注销，检查恢复后重新标记为UP或重新注册
+func (c *Registry) healthLoop(ctx context.Context) {
+	ticker := time.NewTicker(c.opts.HealthInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		cctx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+		err := c.opts.HealthCheck.Check(cctx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			failures++
+			if failures >= c.opts.HealthThreshold && c.markable(true) {
+				_ = c.unhealthy(ctx, err)
+			}
+			continue
+		}
+
+		failures = 0
+		if c.markable(false) {
+			_ = c.healthy(ctx)
+		}
+	}
+}
+
+// markable 健康检查状态是否需要改变，按实际注册状态判断：down为true时判断是否还有需要注销或标记为DOWN的服务，
+// 为false时判断是否有已注销或标记为DOWN、需要恢复的服务
+func (c *Registry) markable(down bool) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.opts.HealthWithdraw {
+		return c.started == down
+	}
+
+	for _, srv := range c.srvs {
+		if (down && srv.IsUp()) || (!down && srv.Status == service.StatusDown) {
+			return true
+		}
+	}
+	return false
+}
+
+// unhealthy 健康检查连续失败，注销服务或将状态标记为DOWN
+func (c *Registry) unhealthy(ctx context.Context, cause error) error {
+	c.m.Lock()
+	lease := c.lease
+	c.m.Unlock()
+
+	var err error
+	if c.opts.HealthWithdraw {
+		c.m.Lock()
+		if ctx.Err() != nil {
+			c.m.Unlock()
+			return nil
+		}
+
+		// 停止租约失效后的重新注册
+		if c.retry != nil {
+			c.retry()
+			c.retry = nil
+		}
+		lease = c.lease
+		err = c.stop()
+		c.m.Unlock()
+	} else {
+		c.m.Lock()
+		if ctx.Err() != nil {
+			c.m.Unlock()
+			return nil
+		}
+
+		// 下线中的实例保持DRAINING
+		err = c.update(func(srv *service.Service) {
+			if srv.IsUp() {
+				srv.Status = service.StatusDown
+			}
+		})
+		c.m.Unlock()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	c.emit(&Event{Type: EventUnhealthy, Lease: lease, Err: cause})
+	return nil
+}
+
+// healthy 健康检查恢复，重新注册服务或将状态恢复为UP
+func (c *Registry) healthy(ctx context.Context) error {
+	var err error
+	if c.opts.HealthWithdraw {
+		c.m.Lock()
+		if ctx.Err() != nil {
+			c.m.Unlock()
+			return nil
+		}
+
+		err = c.start()
+		c.m.Unlock()
+	} else {
+		c.m.Lock()
+		if ctx.Err() != nil {
+			c.m.Unlock()
+			return nil
+		}
+
+		err = c.update(func(srv *service.Service) {
+			if srv.Status == service.StatusDown {
+				srv.Status = service.StatusUp
+			}
+		})
+		c.m.Unlock()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	c.m.Lock()
+	lease := c.lease
+	c.m.Unlock()
+	c.emit(&Event{Type: EventHealthy, Lease: lease})
+	return nil
+}
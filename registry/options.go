@@ -3,6 +3,10 @@ package registry
 import (
 	"time"
 
+	"github.com/yuanzhangcai/srsd/backend"
+	"github.com/yuanzhangcai/srsd/backend/etcd"
+	"github.com/yuanzhangcai/srsd/backoff"
+	"github.com/yuanzhangcai/srsd/health"
 	"github.com/yuanzhangcai/srsd/service"
 )
 
@@ -11,6 +15,9 @@ var (
 	defaultAddresses = []string{"127.0.0.1:2379"}
 	defaultTimeout   = 5 * time.Second
 	defaultTTL       = 10 * time.Second
+	defaultGrace     = 10 * time.Second
+	defaultInterval  = 10 * time.Second
+	defaultThreshold = 3
 )
 
 // Option 设置服务注册参数
@@ -18,21 +25,37 @@ type Option func(*Options)
 
 // Options 服务注册参数
 type Options struct {
-	Addresses []string      // etcd地址
-	Username  string        // etcd用户名
-	Password  string        // etcd密码
-	Prefix    string        //服务注册前缀
-	Timeout   time.Duration // etcd超时时间
-	TTL       time.Duration // 服务存活时间
+	Addresses  []string                     // etcd地址
+	Username   string                       // etcd用户名
+	Password   string                       // etcd密码
+	TLS        *etcd.TLSConfig              // etcd TLS连接参数，为空时不使用TLS
+	Prefix     string                       //服务注册前缀
+	Timeout    time.Duration                // etcd超时时间
+	TTL        time.Duration                // 服务存活时间
+	Backend    backend.Backend              // 存储后端，为空时使用etcd
+	Backoff    backoff.Policy               // 租约失效后重新注册的退避策略
+	OnRetry    func(attempt int, err error) // 重新注册失败、等待下一次重试时回调，attempt从1开始
+	OnEvent    func(event *Event)           // 注册、租约丢失、重新注册、注销时回调
+	DrainGrace time.Duration                // Drain标记下线后等待处理中请求完成的时间
+
+	HealthCheck     health.Checker // 健康检查，为空时不检查
+	HealthInterval  time.Duration  // 健康检查间隔，每次检查的超时时间为Timeout
+	HealthThreshold int            // 连续失败多少次后判定为不健康
+	HealthWithdraw  bool           // 不健康时注销服务，为false时将状态标记为DOWN
 }
 
 // NewOptions 那建服务注册参数对象
 func newOptions(opts ...Option) *Options {
 	opt := &Options{
-		Addresses: defaultAddresses,
-		Prefix:    defaultPrefix,
-		Timeout:   defaultTimeout,
-		TTL:       defaultTTL,
+		Addresses:  defaultAddresses,
+		Prefix:     defaultPrefix,
+		Timeout:    defaultTimeout,
+		TTL:        defaultTTL,
+		Backoff:    backoff.DefaultPolicy,
+		DrainGrace: defaultGrace,
+
+		HealthInterval:  defaultInterval,
+		HealthThreshold: defaultThreshold,
 	}
 
 	for _, one := range opts {
@@ -93,3 +116,65 @@ func TTL(ttl time.Duration) Option {
 		opt.TTL = ttl
 	}
 }
+
+// Backend 设置存储后端，由调用方负责关闭
+func Backend(b backend.Backend) Option {
+	return func(opt *Options) {
+		opt.Backend = b
+	}
+}
+
+// Backoff 设置重新注册的退避策略
+func Backoff(policy backoff.Policy) Option {
+	return func(opt *Options) {
+		opt.Backoff = policy
+	}
+}
+
+// OnRetry 设置重新注册失败时的回调函数，可用于持续失败时告警
+func OnRetry(fn func(attempt int, err error)) Option {
+	return func(opt *Options) {
+		opt.OnRetry = fn
+	}
+}
+
+// OnEvent 设置服务注册生命周期事件回调函数，可用于切换就绪探针状态或记录日志
+func OnEvent(fn func(event *Event)) Option {
+	return func(opt *Options) {
+		opt.OnEvent = fn
+	}
+}
+
+// DrainGrace 设置Drain标记下线后等待处理中请求完成的时间
+func DrainGrace(grace time.Duration) Option {
+	return func(opt *Options) {
+		opt.DrainGrace = grace
+	}
+}
+
+// HealthCheck 设置健康检查，注册成功后按interval执行，连续失败threshold次后判定为不健康
+func HealthCheck(checker health.Checker, interval time.Duration, threshold int) Option {
+	return func(opt *Options) {
+		opt.HealthCheck = checker
+		if interval > 0 {
+			opt.HealthInterval = interval
+		}
+		if threshold > 0 {
+			opt.HealthThreshold = threshold
+		}
+	}
+}
+
+// HealthWithdraw 设置不健康时注销服务，默认只将状态标记为DOWN
+func HealthWithdraw(withdraw bool) Option {
+	return func(opt *Options) {
+		opt.HealthWithdraw = withdraw
+	}
+}
+
+// TLS 设置etcd TLS连接参数，证书文件更新后自动重新加载
+func TLS(cfg etcd.TLSConfig) Option {
+	return func(opt *Options) {
+		opt.TLS = &cfg
+	}
+}
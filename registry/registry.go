@@ -3,49 +3,86 @@ package registry
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"sync"
 	"time"
 
-	"github.com/coreos/etcd/clientv3"
+	"github.com/yuanzhangcai/srsd/backend"
+	"github.com/yuanzhangcai/srsd/backend/etcd"
+	"github.com/yuanzhangcai/srsd/backoff"
 	"github.com/yuanzhangcai/srsd/service"
 )
 
-// Registry 服务注册主件
+var (
+	// ErrKeyChanged Update不能修改服务名称与ID
+	ErrKeyChanged = errors.New("registry: service name and id can not be updated")
+	// ErrServiceExists 服务已经添加
+	ErrServiceExists = errors.New("registry: service already exists")
+	// ErrServiceNotFound 服务没有添加
+	ErrServiceNotFound = errors.New("registry: service not found")
+)
+
+// Registry 服务注册主件，同一进程的多个服务共用一个存储后端连接与租约
 type Registry struct {
 	opts    *Options
-	srv     *service.Service
+	srvs    []*service.Service
 	m       sync.Mutex
-	cli     *clientv3.Client
-	key     string
+	cli     backend.Backend
+	cancel  context.CancelFunc
+	retry   context.CancelFunc // 取消重新注册
+	health  context.CancelFunc // 取消健康检查
+	lease   backend.LeaseID
 	started bool
 }
 
-// NewRegistry 创建服务注册组件
+// NewRegistry 创建服务注册组件，srv为空时可以之后通过Add添加服务
 func NewRegistry(srv *service.Service, opts ...Option) *Registry {
-	opt := newOptions(opts...)
-	return &Registry{
-		opts: opt,
-		srv:  srv,
-		key:  opt.CreateServiceKey(srv),
+	c := &Registry{
+		opts: newOptions(opts...),
+	}
+	if srv != nil {
+		c.srvs = append(c.srvs, srv)
 	}
+	return c
 }
 
 // Start 开启服务注册
 func (c *Registry) Start() error {
 	c.m.Lock()
-	defer c.m.Unlock()
-
 	if c.started {
+		c.m.Unlock()
 		return nil
 	}
 
-	err := c.srv.GetRealIP()
+	err := c.start()
+	if err == nil {
+		c.startHealth()
+	}
+	lease := c.lease
+	c.m.Unlock()
 	if err != nil {
 		return err
 	}
 
+	c.emit(&Event{Type: EventRegistered, Lease: lease})
+	return nil
+}
+
+// start 开启服务注册，需持有c.m
+func (c *Registry) start() error {
+	if c.started {
+		return nil
+	}
+
+	for _, srv := range c.srvs {
+		err := srv.GetRealIP()
+		if err != nil {
+			return err
+		}
+	}
+
 	if c.cli == nil {
-		cli, err := c.createEtcdClient()
+		cli, err := c.createBackend()
 		if err != nil {
 			return err
 		}
@@ -53,74 +90,300 @@ func (c *Registry) Start() error {
 		c.cli = cli
 	}
 
-	c.srv.CreateTime = time.Now().Format("2006-01-02 15:04:05")
-	val, err := json.Marshal(c.srv)
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
+	defer cancel()
+	leaseID, err := c.cli.Grant(ctx, int64(c.opts.TTL/time.Second))
 	if err != nil {
 		return err
 	}
 
-	lease := clientv3.NewLease(c.cli)
-	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
-	defer cancel()
-	grant, err := lease.Grant(ctx, int64(c.opts.TTL/time.Second))
+	// 所有服务写入同一租约
+	createTime := time.Now().Format("2006-01-02 15:04:05")
+	for _, srv := range c.srvs {
+		srv.CreateTime = createTime
+		err = c.put(srv, leaseID)
+		if err != nil {
+			c.revoke(leaseID)
+			return err
+		}
+	}
+
+	err = c.keepAlive(leaseID)
 	if err != nil {
-		return err
+		c.revoke(leaseID)
 	}
+	return err
+}
 
-	pCtx, pCancel := context.WithTimeout(context.Background(), c.opts.Timeout)
-	defer pCancel()
-	_, err = c.cli.Put(pCtx, c.key, string(val), clientv3.WithLease(grant.ID))
+// put 在租约下写入服务信息
+func (c *Registry) put(srv *service.Service, leaseID backend.LeaseID) error {
+	val, err := json.Marshal(srv)
 	if err != nil {
 		return err
 	}
 
-	return c.keepAlive(grant.ID)
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
+	defer cancel()
+	return c.cli.Put(ctx, c.opts.CreateServiceKey(srv), string(val), leaseID)
+}
+
+// revoke 撤销注册失败的租约，删除已写入的服务信息
+func (c *Registry) revoke(leaseID backend.LeaseID) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
+	defer cancel()
+	_ = c.cli.Revoke(ctx, leaseID)
 }
 
-func (c *Registry) keepAlive(grantID clientv3.LeaseID) error {
-	ctx := context.Background()
-	ch, err := c.cli.KeepAlive(ctx, grantID)
+func (c *Registry) keepAlive(leaseID backend.LeaseID) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch, err := c.cli.KeepAlive(ctx, leaseID)
 	if err != nil {
+		cancel()
 		return err
 	}
+	c.cancel = cancel
+	c.lease = leaseID
 
 	go func() {
 		for range ch {
 		}
 
 		c.m.Lock()
-		started := c.started
+		if !c.started || c.lease != leaseID { // 服务停止或已重新注册，无需重启
+			c.m.Unlock()
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		c.retry = cancel
 		c.m.Unlock()
-		if !started { // 服务停止，无需重启
+
+		// KeepAlive异常结束时，按退避策略重新注册
+		c.emit(&Event{Type: EventLeaseLost, Lease: leaseID, Err: ErrLeaseLost})
+		c.reregister(ctx, leaseID)
+	}()
+
+	c.started = true
+
+	return nil
+}
+
+// reregister 重新注册服务，失败时按退避策略重试，达到最大重试次数后放弃，ctx结束时停止重试
+func (c *Registry) reregister(ctx context.Context, leaseID backend.LeaseID) {
+	b := backoff.New(c.opts.Backoff)
+	var err error
+	for {
+		c.emit(&Event{Type: EventReregistering, Lease: leaseID, Err: err})
+
+		c.m.Lock()
+		if ctx.Err() != nil || (c.started && c.lease != leaseID) {
+			c.m.Unlock()
+			return // 已停止或已由调用方重新注册
+		}
+
+		err = c.stop()
+		if err == nil {
+			err = c.start()
+		}
+		lease := c.lease
+		c.m.Unlock()
+		if err == nil {
+			c.emit(&Event{Type: EventReregistered, Lease: lease})
+			return
+		}
+
+		delay, ok := b.Next()
+		if !ok {
+			return
+		}
+
+		if c.opts.OnRetry != nil {
+			c.opts.OnRetry(b.Attempt(), err)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
 			return
 		}
+	}
+}
+
+// Update 修改所有服务的信息，已注册时在原租约下重新写入，服务发现只会收到一次更新，实例不会下线。
+// fn修改的是服务信息的副本，写入失败的服务信息不变；不能修改服务名称与ID
+func (c *Registry) Update(fn func(srv *service.Service)) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.update(fn)
+}
 
-		// KeepAlive异常结束时，重启服务
-		for {
-			err := c.Stop()
+// update 修改所有服务的信息，需持有c.m
+func (c *Registry) update(fn func(srv *service.Service)) error {
+	list := make([]*service.Service, 0, len(c.srvs))
+	for _, one := range c.srvs {
+		srv := one.Clone()
+		fn(srv)
+		if srv.Name != one.Name || srv.ID != one.ID {
+			return ErrKeyChanged
+		}
+		list = append(list, srv)
+	}
+
+	for i, srv := range list {
+		if c.started {
+			err := srv.GetRealIP()
 			if err != nil {
-				time.Sleep(c.opts.Timeout)
-				continue
+				return err
 			}
 
-			err = c.Start()
-			if err == nil {
-				return
+			err = c.put(srv, c.lease)
+			if err != nil {
+				return err
 			}
-			time.Sleep(c.opts.Timeout)
 		}
-	}()
 
-	c.started = true
+		*c.srvs[i] = *srv
+	}
+	return nil
+}
+
+// Add 添加服务，已注册时立即在当前租约下写入
+func (c *Registry) Add(srv *service.Service) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.index(srv) >= 0 {
+		return ErrServiceExists
+	}
 
+	if c.started {
+		err := srv.GetRealIP()
+		if err != nil {
+			return err
+		}
+
+		srv.CreateTime = time.Now().Format("2006-01-02 15:04:05")
+		err = c.put(srv, c.lease)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.srvs = append(c.srvs, srv)
+	return nil
+}
+
+// Remove 移除服务，已注册时立即删除服务信息，其他服务不受影响
+func (c *Registry) Remove(srv *service.Service) error {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	i := c.index(srv)
+	if i < 0 {
+		return ErrServiceNotFound
+	}
+
+	if c.started {
+		ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
+		defer cancel()
+		err := c.cli.Delete(ctx, c.opts.CreateServiceKey(srv))
+		if err != nil {
+			return err
+		}
+	}
+
+	c.srvs = append(append([]*service.Service{}, c.srvs[:i]...), c.srvs[i+1:]...)
 	return nil
 }
 
+// Services 获取已添加的服务
+func (c *Registry) Services() []*service.Service {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return append([]*service.Service{}, c.srvs...)
+}
+
+// index 按服务名称与ID查找服务，需持有c.m
+func (c *Registry) index(srv *service.Service) int {
+	for i, one := range c.srvs {
+		if one.Name == srv.Name && one.ID == srv.ID {
+			return i
+		}
+	}
+	return -1
+}
+
+// Drain 优雅下线：将实例状态改为DRAINING，服务发现立即停止选择该实例，
+// 等待DrainGrace让处理中的请求完成后再Stop。ctx结束时提前Stop，停止后本地状态恢复为UP以便再次Start
+func (c *Registry) Drain(ctx context.Context) error {
+	c.m.Lock()
+	started := c.started
+	c.m.Unlock()
+	if !started {
+		return nil
+	}
+
+	err := c.Update(func(srv *service.Service) {
+		srv.Status = service.StatusDraining
+	})
+	if err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(c.opts.DrainGrace)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	err = c.Stop()
+	if err != nil {
+		return err
+	}
+
+	return c.Update(func(srv *service.Service) {
+		srv.Status = service.StatusUp
+	})
+}
+
 // Stop 停止服务注册
 func (c *Registry) Stop() error {
 	c.m.Lock()
-	defer c.m.Unlock()
+	if c.retry != nil {
+		c.retry()
+		c.retry = nil
+	}
+
+	if c.health != nil {
+		c.health()
+		c.health = nil
+	}
+
+	started := c.started
+	lease := c.lease
+	err := c.stop()
+	if err == nil {
+		// 健康检查标记的DOWN只在本次注册期间有效，再次Start时重新检查
+		for _, srv := range c.srvs {
+			if srv.Status == service.StatusDown {
+				srv.Status = service.StatusUp
+			}
+		}
+	}
+	c.m.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if started {
+		c.emit(&Event{Type: EventDeregistered, Lease: lease})
+	}
+	return nil
+}
 
+// stop 停止服务注册，需持有c.m
+func (c *Registry) stop() error {
 	if !c.started {
 		return nil
 	}
@@ -128,14 +391,25 @@ func (c *Registry) Stop() error {
 	if c.cli != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
 		defer cancel()
-		_, err := c.cli.Delete(ctx, c.key, clientv3.WithIgnoreLease())
-		if err != nil {
-			return err
+		for _, srv := range c.srvs {
+			err := c.cli.Delete(ctx, c.opts.CreateServiceKey(srv))
+			if err != nil {
+				return err
+			}
 		}
 
-		err = c.cli.Close()
-		if err != nil {
-			return err
+		if c.cancel != nil {
+			c.cancel()
+			c.cancel = nil
+		}
+		c.lease = backend.NoLease
+
+		// 外部传入的存储后端由调用方负责关闭
+		if c.opts.Backend == nil {
+			err := c.cli.Close()
+			if err != nil {
+				return err
+			}
 		}
 		c.cli = nil
 	}
@@ -143,15 +417,16 @@ func (c *Registry) Stop() error {
 	return nil
 }
 
-func (c *Registry) createEtcdClient() (*clientv3.Client, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
-	defer cancel()
+func (c *Registry) createBackend() (backend.Backend, error) {
+	if c.opts.Backend != nil {
+		return c.opts.Backend, nil
+	}
 
-	return clientv3.New(clientv3.Config{
-		Context:     ctx,
-		Endpoints:   c.opts.Addresses,
-		DialTimeout: c.opts.Timeout,
-		Username:    c.opts.Username,
-		Password:    c.opts.Password,
+	return etcd.NewBackend(etcd.Config{
+		Addresses: c.opts.Addresses,
+		Username:  c.opts.Username,
+		Password:  c.opts.Password,
+		Timeout:   c.opts.Timeout,
+		TLS:       c.opts.TLS,
 	})
 }
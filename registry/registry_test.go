@@ -2,10 +2,18 @@ package registry
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/yuanzhangcai/srsd/backend"
+	"github.com/yuanzhangcai/srsd/backend/etcd"
+	"github.com/yuanzhangcai/srsd/backend/memory"
+	"github.com/yuanzhangcai/srsd/backoff"
+	"github.com/yuanzhangcai/srsd/health"
 	"github.com/yuanzhangcai/srsd/service"
 )
 
@@ -16,13 +24,18 @@ func TestNewRegistry(t *testing.T) {
 	srv.Name = "zacyuan.com"
 	srv.Host = "127.0.0.1:4444"
 
+	b := memory.NewBackend()
 	reg := NewRegistry(srv,
 		Addresses(testEtcdAddr),
+		Backend(b),
 		Username("zacyuan"),
 		Password("12345678"),
 		Prefix("/zacyuan/test"),
 		Timeout(3*time.Second),
 		TTL(60*time.Second),
+		Backoff(backoff.Policy{Initial: time.Millisecond}),
+		OnRetry(func(attempt int, err error) {}),
+		TLS(etcd.TLSConfig{CAFile: "ca.pem"}),
 	)
 	assert.NotNil(t, reg)
 	assert.Equal(t, testEtcdAddr, reg.opts.Addresses)
@@ -31,6 +44,11 @@ func TestNewRegistry(t *testing.T) {
 	assert.Equal(t, "/zacyuan/test/", reg.opts.Prefix)
 	assert.Equal(t, 3*time.Second, reg.opts.Timeout)
 	assert.Equal(t, 60*time.Second, reg.opts.TTL)
+	assert.Equal(t, b, reg.opts.Backend)
+	assert.Equal(t, time.Millisecond, reg.opts.Backoff.Initial)
+	assert.NotNil(t, reg.opts.OnRetry)
+	assert.Equal(t, "ca.pem", reg.opts.TLS.CAFile)
+	assert.Equal(t, backoff.DefaultPolicy, NewRegistry(srv).opts.Backoff)
 }
 
 func TestStart(t *testing.T) {
@@ -44,12 +62,15 @@ func TestStart(t *testing.T) {
 		assert.NotNil(t, err)
 	})
 
+	b := memory.NewBackend()
+	defer b.Close()
+
 	t.Run("Start success", func(t *testing.T) {
 		srv := service.NewService()
 		srv.Name = "zacyuan.com"
 
 		srv.Host = "127.0.0.1:4444"
-		reg := NewRegistry(srv, Addresses(testEtcdAddr))
+		reg := NewRegistry(srv, Backend(b))
 		err := reg.Start()
 		assert.Nil(t, err)
 	})
@@ -59,7 +80,7 @@ func TestStart(t *testing.T) {
 		srv.Name = "zacyuan.com"
 
 		srv.Host = "127.0.0.1:4444"
-		reg := NewRegistry(srv, Addresses(testEtcdAddr), TTL(2*time.Second))
+		reg := NewRegistry(srv, Backend(b), TTL(2*time.Second))
 		err := reg.Start()
 		assert.Nil(t, err)
 		time.Sleep(3 * time.Second)
@@ -68,7 +89,7 @@ func TestStart(t *testing.T) {
 		key := reg.opts.CreateServiceKey(srv)
 		value, err := reg.cli.Get(context.Background(), key)
 		assert.Nil(t, err)
-		assert.Less(t, int64(0), value.Count)
+		assert.Less(t, 0, len(value.Kvs))
 		reg.m.Unlock()
 	})
 
@@ -77,22 +98,24 @@ func TestStart(t *testing.T) {
 		srv.Name = "zacyuan.com"
 
 		srv.Host = "127.0.0.1:4444"
-		reg := NewRegistry(srv, Addresses(testEtcdAddr), TTL(2*time.Second))
+		reg := NewRegistry(srv, Backend(b), TTL(2*time.Second))
 		err := reg.Start()
 		assert.Nil(t, err)
 
 		reg.m.Lock()
-		reg.cli.Close()
-		reg.cli = nil
+		lease := reg.lease
 		reg.m.Unlock()
+		err = b.ExpireLease(lease)
+		assert.Nil(t, err)
 
 		time.Sleep(1 * time.Second)
 
 		reg.m.Lock()
+		assert.NotEqual(t, lease, reg.lease)
 		key := reg.opts.CreateServiceKey(srv)
 		value, err := reg.cli.Get(context.Background(), key)
 		assert.Nil(t, err)
-		assert.Less(t, int64(0), value.Count)
+		assert.Less(t, 0, len(value.Kvs))
 		reg.m.Unlock()
 	})
 }
@@ -102,7 +125,9 @@ func TestStop(t *testing.T) {
 	srv.Name = "zacyuan.com"
 
 	srv.Host = "127.0.0.1:4444"
-	reg := NewRegistry(srv, Addresses(testEtcdAddr), TTL(2*time.Second))
+	b := memory.NewBackend()
+	defer b.Close()
+	reg := NewRegistry(srv, Backend(b), TTL(2*time.Second))
 
 	t.Run("Stop no start", func(t *testing.T) {
 		err := reg.Stop()
@@ -115,6 +140,529 @@ func TestStop(t *testing.T) {
 
 		err = reg.Stop()
 		assert.Nil(t, err)
+
+		value, err := b.Get(context.Background(), key(reg))
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(value.Kvs))
+	})
+
+}
+
+// downBackend 可以模拟不可用的存储后端
+type downBackend struct {
+	backend.Backend
+	m    sync.Mutex
+	down bool
+}
+
+func (c *downBackend) setDown(down bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.down = down
+}
+
+func (c *downBackend) Grant(ctx context.Context, ttl int64) (backend.LeaseID, error) {
+	c.m.Lock()
+	down := c.down
+	c.m.Unlock()
+	if down {
+		return backend.NoLease, errors.New("backend down")
+	}
+	return c.Backend.Grant(ctx, ttl)
+}
+
+func (c *downBackend) Put(ctx context.Context, key, value string, lease backend.LeaseID) error {
+	c.m.Lock()
+	down := c.down
+	c.m.Unlock()
+	if down {
+		return errors.New("backend down")
+	}
+	return c.Backend.Put(ctx, key, value, lease)
+}
+
+func TestRetry(t *testing.T) {
+	mem := memory.NewBackend()
+	defer mem.Close()
+	b := &downBackend{Backend: mem}
+
+	srv := service.NewService()
+	srv.Name = "zacyuan.com"
+	srv.Host = "127.0.0.1:4444"
+
+	var m sync.Mutex
+	var attempts []int
+	onRetry := func(attempt int, err error) {
+		m.Lock()
+		defer m.Unlock()
+		assert.NotNil(t, err)
+		attempts = append(attempts, attempt)
+	}
+	policy := backoff.Policy{Initial: 10 * time.Millisecond, Max: 20 * time.Millisecond, Multiplier: 2}
+
+	t.Run("retry until success", func(t *testing.T) {
+		attempts = nil
+		reg := NewRegistry(srv, Backend(b), Backoff(policy), OnRetry(onRetry))
+		assert.Nil(t, reg.Start())
+		defer reg.Stop()
+
+		reg.m.Lock()
+		lease := reg.lease
+		reg.m.Unlock()
+		b.setDown(true)
+		assert.Nil(t, mem.ExpireLease(lease))
+		time.Sleep(200 * time.Millisecond)
+
+		m.Lock()
+		assert.Less(t, 2, len(attempts))
+		assert.Equal(t, 1, attempts[0])
+		assert.Equal(t, 2, attempts[1])
+		m.Unlock()
+
+		b.setDown(false)
+		time.Sleep(100 * time.Millisecond)
+		value, err := mem.Get(context.Background(), key(reg))
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(value.Kvs))
+	})
+
+	t.Run("max attempts", func(t *testing.T) {
+		attempts = nil
+		p := policy
+		p.MaxAttempts = 3
+		reg := NewRegistry(srv, Backend(b), Backoff(p), OnRetry(onRetry))
+		assert.Nil(t, reg.Start())
+		defer reg.Stop()
+
+		reg.m.Lock()
+		lease := reg.lease
+		reg.m.Unlock()
+		b.setDown(true)
+		defer b.setDown(false)
+		assert.Nil(t, mem.ExpireLease(lease))
+		time.Sleep(200 * time.Millisecond)
+
+		m.Lock()
+		assert.Equal(t, []int{1, 2, 3}, attempts)
+		m.Unlock()
+	})
+
+	t.Run("stop while retrying", func(t *testing.T) {
+		attempts = nil
+		reg := NewRegistry(srv, Backend(b), Backoff(policy), OnRetry(onRetry))
+		assert.Nil(t, reg.Start())
+
+		reg.m.Lock()
+		lease := reg.lease
+		reg.m.Unlock()
+		b.setDown(true)
+		assert.Nil(t, mem.ExpireLease(lease))
+		time.Sleep(50 * time.Millisecond)
+		assert.Nil(t, reg.Stop())
+
+		// 停止后不再重试，存储后端恢复后也不会重新注册
+		m.Lock()
+		n := len(attempts)
+		m.Unlock()
+		b.setDown(false)
+		time.Sleep(100 * time.Millisecond)
+		m.Lock()
+		assert.Equal(t, n, len(attempts))
+		m.Unlock()
+		value, err := mem.Get(context.Background(), key(reg))
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(value.Kvs))
+	})
+}
+
+func TestEvent(t *testing.T) {
+	mem := memory.NewBackend()
+	defer mem.Close()
+	b := &downBackend{Backend: mem}
+
+	srv := service.NewService()
+	srv.Name = "zacyuan.com"
+	srv.Host = "127.0.0.1:4444"
+
+	var m sync.Mutex
+	var events []*Event
+	reg := NewRegistry(srv, Backend(b), Backoff(backoff.Policy{Initial: 10 * time.Millisecond}),
+		OnEvent(func(event *Event) {
+			m.Lock()
+			defer m.Unlock()
+			events = append(events, event)
+		}))
+	last := func() *Event {
+		m.Lock()
+		defer m.Unlock()
+		return events[len(events)-1]
+	}
+
+	assert.Nil(t, reg.Start())
+	assert.Nil(t, reg.Start())
+	m.Lock()
+	assert.Equal(t, 1, len(events))
+	m.Unlock()
+	ev := last()
+	assert.Equal(t, EventRegistered, ev.Type)
+	lease := ev.Lease
+	assert.NotEqual(t, backend.NoLease, lease)
+
+	// 租约丢失后重新注册
+	b.setDown(true)
+	assert.Nil(t, mem.ExpireLease(lease))
+	time.Sleep(100 * time.Millisecond)
+	m.Lock()
+	assert.Less(t, 3, len(events))
+	assert.Equal(t, EventLeaseLost, events[1].Type)
+	assert.Equal(t, lease, events[1].Lease)
+	assert.Equal(t, ErrLeaseLost, events[1].Err)
+	assert.Equal(t, EventReregistering, events[2].Type)
+	assert.Nil(t, events[2].Err)
+	assert.Equal(t, EventReregistering, events[3].Type)
+	assert.Equal(t, lease, events[3].Lease)
+	assert.NotNil(t, events[3].Err)
+	m.Unlock()
+
+	b.setDown(false)
+	time.Sleep(100 * time.Millisecond)
+	ev = last()
+	assert.Equal(t, EventReregistered, ev.Type)
+	assert.NotEqual(t, lease, ev.Lease)
+	lease = ev.Lease
+
+	assert.Nil(t, reg.Stop())
+	ev = last()
+	assert.Equal(t, EventDeregistered, ev.Type)
+	assert.Equal(t, lease, ev.Lease)
+
+	// 未注册时Stop不产生事件
+	assert.Nil(t, reg.Stop())
+	assert.Equal(t, ev, last())
+}
+
+func TestEventType(t *testing.T) {
+	assert.Equal(t, "REGISTERED", EventRegistered.String())
+	assert.Equal(t, "LEASE_LOST", EventLeaseLost.String())
+	assert.Equal(t, "REREGISTERING", EventReregistering.String())
+	assert.Equal(t, "REREGISTERED", EventReregistered.String())
+	assert.Equal(t, "DEREGISTERED", EventDeregistered.String())
+	assert.Equal(t, "UNHEALTHY", EventUnhealthy.String())
+	assert.Equal(t, "HEALTHY", EventHealthy.String())
+	assert.Equal(t, "UNKNOWN", EventType(10).String())
+}
+
+func TestUpdate(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+	down := &downBackend{Backend: b}
+	ctx := context.Background()
+
+	srv := service.NewService()
+	srv.Name = "zacyuan.com"
+	srv.Host = "127.0.0.1:4444"
+	reg := NewRegistry(srv, Backend(down))
+
+	// 未注册时只修改服务信息
+	assert.Nil(t, reg.Update(func(srv *service.Service) {
+		srv.Version = "v1"
+	}))
+	assert.Equal(t, "v1", srv.Version)
+
+	assert.Nil(t, reg.Start())
+	defer reg.Stop()
+	reg.m.Lock()
+	lease := reg.lease
+	reg.m.Unlock()
+
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ch := b.Watch(wctx, key(reg), b.Revision()+1)
+
+	// 在原租约下重新写入，只产生一次写入事件
+	assert.Nil(t, reg.Update(func(srv *service.Service) {
+		srv.Version = "v2"
+		srv.Metadata["canary"] = "true"
+	}))
+	assert.Equal(t, "v2", srv.Version)
+	assert.Equal(t, "true", srv.Metadata["canary"])
+
+	select {
+	case resp := <-ch:
+		assert.Equal(t, 1, len(resp.Events))
+		assert.Equal(t, backend.EventPut, resp.Events[0].Type)
+		assert.Equal(t, lease, resp.Events[0].Kv.Lease)
+		one := &service.Service{}
+		assert.Nil(t, json.Unmarshal(resp.Events[0].Kv.Value, one))
+		assert.Equal(t, "v2", one.Version)
+		assert.Equal(t, "true", one.Metadata["canary"])
+	case <-time.After(time.Second):
+		assert.Fail(t, "no watch event")
+	}
+
+	// 不能修改服务名称与ID
+	assert.Equal(t, ErrKeyChanged, reg.Update(func(srv *service.Service) {
+		srv.Name = "other.com"
+		srv.Version = "v3"
+	}))
+	assert.Equal(t, "zacyuan.com", srv.Name)
+	assert.Equal(t, "v2", srv.Version)
+
+	// 写入失败时服务信息不变
+	down.setDown(true)
+	defer down.setDown(false)
+	assert.NotNil(t, reg.Update(func(srv *service.Service) {
+		srv.Version = "v4"
+	}))
+	assert.Equal(t, "v2", srv.Version)
+}
+
+func TestDrain(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+	ctx := context.Background()
+
+	srv := service.NewService()
+	srv.Name = "zacyuan.com"
+	srv.Host = "127.0.0.1:4444"
+	reg := NewRegistry(srv, Backend(b), DrainGrace(200*time.Millisecond))
+	assert.Equal(t, 200*time.Millisecond, reg.opts.DrainGrace)
+
+	// 未注册时直接返回
+	assert.Nil(t, reg.Drain(ctx))
+	assert.Nil(t, reg.Start())
+
+	done := make(chan error)
+	start := time.Now()
+	go func() {
+		done <- reg.Drain(ctx)
+	}()
+
+	// 等待期间实例仍然注册，状态为DRAINING
+	time.Sleep(50 * time.Millisecond)
+	value, err := b.Get(ctx, key(reg))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(value.Kvs))
+	one := &service.Service{}
+	assert.Nil(t, json.Unmarshal(value.Kvs[0].Value, one))
+	assert.Equal(t, service.StatusDraining, one.Status)
+
+	assert.Nil(t, <-done)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(200*time.Millisecond))
+	value, err = b.Get(ctx, key(reg))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(value.Kvs))
+	assert.Equal(t, service.StatusUp, srv.Status)
+
+	// ctx结束时提前停止
+	assert.Nil(t, reg.Start())
+	cctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	reg.opts.DrainGrace = time.Hour
+	assert.Nil(t, reg.Drain(cctx))
+	value, err = b.Get(ctx, key(reg))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(value.Kvs))
+}
+
+func TestHealthCheck(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+	ctx := context.Background()
+
+	var m sync.Mutex
+	fail := false
+	checks := 0
+	checker := health.Func(func(ctx context.Context) error {
+		m.Lock()
+		defer m.Unlock()
+		checks++
+		if fail {
+			return assert.AnError
+		}
+		return nil
+	})
+	setFail := func(v bool) {
+		m.Lock()
+		defer m.Unlock()
+		fail = v
+	}
+	status := func(reg *Registry) string {
+		value, err := b.Get(ctx, key(reg))
+		assert.Nil(t, err)
+		if len(value.Kvs) == 0 {
+			return ""
+		}
+		one := &service.Service{}
+		assert.Nil(t, json.Unmarshal(value.Kvs[0].Value, one))
+		return one.Status
+	}
+
+	t.Run("mark down", func(t *testing.T) {
+		srv := service.NewService()
+		srv.Name = "zacyuan.com"
+		srv.Host = "127.0.0.1:4444"
+		var events []EventType
+		reg := NewRegistry(srv, Backend(b), HealthCheck(checker, 20*time.Millisecond, 2),
+			OnEvent(func(event *Event) {
+				m.Lock()
+				defer m.Unlock()
+				events = append(events, event.Type)
+			}))
+		assert.Equal(t, 2, reg.opts.HealthThreshold)
+		assert.False(t, reg.opts.HealthWithdraw)
+		assert.Nil(t, reg.Start())
+		defer reg.Stop()
+
+		time.Sleep(50 * time.Millisecond)
+		assert.Equal(t, service.StatusUp, status(reg))
+
+		setFail(true)
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, service.StatusDown, status(reg))
+
+		setFail(false)
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, service.StatusUp, status(reg))
+
+		m.Lock()
+		assert.Equal(t, []EventType{EventRegistered, EventUnhealthy, EventHealthy}, events)
+		m.Unlock()
+	})
+
+	t.Run("restart", func(t *testing.T) {
+		srv := service.NewService()
+		srv.Name = "zacyuan.com"
+		srv.Host = "127.0.0.1:4444"
+		reg := NewRegistry(srv, Backend(b), HealthCheck(checker, 20*time.Millisecond, 2))
+		assert.Nil(t, reg.Start())
+		defer reg.Stop()
+
+		setFail(true)
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, service.StatusDown, status(reg))
+
+		// 停止时恢复为UP，重新注册后按检查结果标记
+		assert.Nil(t, reg.Stop())
+		assert.Equal(t, service.StatusUp, reg.Services()[0].Status)
+		assert.Nil(t, reg.Start())
+		assert.Equal(t, service.StatusUp, status(reg))
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, service.StatusDown, status(reg))
+
+		assert.Nil(t, reg.Stop())
+		setFail(false)
+		srv.Status = service.StatusDown
+		assert.Nil(t, reg.Start())
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, service.StatusUp, status(reg))
+	})
+
+	t.Run("withdraw", func(t *testing.T) {
+		srv := service.NewService()
+		srv.Name = "zacyuan.com"
+		srv.Host = "127.0.0.1:4444"
+		reg := NewRegistry(srv, Backend(b), HealthCheck(checker, 20*time.Millisecond, 2), HealthWithdraw(true))
+		assert.Nil(t, reg.Start())
+		reg.m.Lock()
+		lease := reg.lease
+		reg.m.Unlock()
+
+		setFail(true)
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, "", status(reg))
+
+		setFail(false)
+		time.Sleep(100 * time.Millisecond)
+		assert.Equal(t, service.StatusUp, status(reg))
+		reg.m.Lock()
+		assert.NotEqual(t, lease, reg.lease)
+		reg.m.Unlock()
+
+		// 停止后不再检查
+		assert.Nil(t, reg.Stop())
+		time.Sleep(30 * time.Millisecond)
+		m.Lock()
+		n := checks
+		m.Unlock()
+		time.Sleep(100 * time.Millisecond)
+		m.Lock()
+		assert.Equal(t, n, checks)
+		m.Unlock()
+		assert.Equal(t, "", status(reg))
 	})
+}
+
+// key 第一个服务的注册key
+func key(reg *Registry) string {
+	return reg.opts.CreateServiceKey(reg.Services()[0])
+}
+
+func TestMultiService(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+	ctx := context.Background()
+
+	newService := func(name, host string) *service.Service {
+		srv := service.NewService()
+		srv.Name = name
+		srv.Host = host
+		return srv
+	}
+	lease := func(reg *Registry, srv *service.Service) backend.LeaseID {
+		value, err := b.Get(ctx, reg.opts.CreateServiceKey(srv))
+		assert.Nil(t, err)
+		if len(value.Kvs) == 0 {
+			return backend.NoLease
+		}
+		return value.Kvs[0].Lease
+	}
+
+	web := newService("web.zacyuan.com", "127.0.0.1:8080")
+	rpc := newService("rpc.zacyuan.com", "127.0.0.1:9090")
+	admin := newService("admin.zacyuan.com", "127.0.0.1:7070")
+
+	reg := NewRegistry(nil, Backend(b), Backoff(backoff.Policy{Initial: 10 * time.Millisecond}))
+	assert.Equal(t, 0, len(reg.Services()))
+	assert.Nil(t, reg.Add(web))
+	assert.Nil(t, reg.Add(rpc))
+	assert.Equal(t, ErrServiceExists, reg.Add(web))
+
+	// 所有服务共用一个租约
+	assert.Nil(t, reg.Start())
+	defer reg.Stop()
+	id := lease(reg, web)
+	assert.NotEqual(t, backend.NoLease, id)
+	assert.Equal(t, id, lease(reg, rpc))
+	assert.Equal(t, []backend.LeaseID{id}, b.Leases())
+
+	// 运行时添加、移除服务
+	assert.Nil(t, reg.Add(admin))
+	assert.Equal(t, id, lease(reg, admin))
+	assert.NotEmpty(t, admin.CreateTime)
+	assert.Nil(t, reg.Remove(rpc))
+	assert.Equal(t, backend.NoLease, lease(reg, rpc))
+	assert.Equal(t, id, lease(reg, web))
+	assert.Equal(t, ErrServiceNotFound, reg.Remove(rpc))
+	assert.Equal(t, []*service.Service{web, admin}, reg.Services())
+
+	// Update修改所有服务
+	assert.Nil(t, reg.Update(func(srv *service.Service) {
+		srv.Metadata["zone"] = "sz"
+	}))
+	assert.Equal(t, "sz", web.Metadata["zone"])
+	assert.Equal(t, "sz", admin.Metadata["zone"])
+
+	// 租约失效后所有服务在新租约下重新注册
+	assert.Nil(t, b.ExpireLease(id))
+	time.Sleep(100 * time.Millisecond)
+	newID := lease(reg, web)
+	assert.NotEqual(t, backend.NoLease, newID)
+	assert.NotEqual(t, id, newID)
+	assert.Equal(t, newID, lease(reg, admin))
+	assert.Equal(t, backend.NoLease, lease(reg, rpc))
 
+	assert.Nil(t, reg.Stop())
+	assert.Equal(t, backend.NoLease, lease(reg, web))
+	assert.Equal(t, backend.NoLease, lease(reg, admin))
 }
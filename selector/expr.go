@@ -0,0 +1,283 @@
+package selector
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+// ErrInvalidExpr 过滤表达式或版本条件格式错误
+var ErrInvalidExpr = errors.New("selector: invalid expression")
+
+// ParseExpr 解析过滤表达式，返回按表达式过滤实例的选择器，例如：
+//
+//	version>=1.2 && metadata.zone in (sh,bj)
+//	(version==v2 || metadata.canary) && status!=DOWN
+//
+// 字段为version、id、name、host、status、weight或metadata.<key>；
+// 运算符为==、!=、>=、<=、>、<、in (...)、not in (...)，只写字段时表示字段不为空；
+// 条件可以用&&、||、!与括号组合，值包含空格或运算符时用单引号或双引号括起。
+// >=、<=、>、<按版本号规则比较，version字段的==也按版本号比较（1.2与v1.2.0相等）
+func ParseExpr(expr string) (*Match, error) {
+	p := &parser{tokens: lex(expr)}
+	cond, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, p.errorf(tok, "unexpected %q", tok.text)
+	}
+	return NewMatch(cond), nil
+}
+
+// 词法单元类型
+const (
+	tokenEOF    = iota
+	tokenWord   // 字段名、值、in、not
+	tokenString // 引号括起的值
+	tokenOp     // 比较运算符
+	tokenAnd    // &&
+	tokenOr     // ||
+	tokenNot    // !
+	tokenLParen // (
+	tokenRParen // )
+	tokenComma  // ,
+	tokenError  // 无法识别的字符
+)
+
+type token struct {
+	kind int
+	text string
+	pos  int
+}
+
+// lex 将表达式拆分为词法单元，以tokenEOF或tokenError结尾
+func lex(s string) []token {
+	var tokens []token
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+			continue
+		case strings.HasPrefix(s[i:], "&&"):
+			tokens = append(tokens, token{kind: tokenAnd, text: "&&", pos: i})
+			i += 2
+		case strings.HasPrefix(s[i:], "||"):
+			tokens = append(tokens, token{kind: tokenOr, text: "||", pos: i})
+			i += 2
+		case strings.HasPrefix(s[i:], ">="), strings.HasPrefix(s[i:], "<="),
+			strings.HasPrefix(s[i:], "!="), strings.HasPrefix(s[i:], "=="):
+			tokens = append(tokens, token{kind: tokenOp, text: s[i : i+2], pos: i})
+			i += 2
+		case c == '>' || c == '<' || c == '=':
+			tokens = append(tokens, token{kind: tokenOp, text: s[i : i+1], pos: i})
+			i++
+		case c == '!':
+			tokens = append(tokens, token{kind: tokenNot, text: "!", pos: i})
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", pos: i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ",", pos: i})
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return append(tokens, token{kind: tokenError, text: s[i:], pos: i})
+			}
+			tokens = append(tokens, token{kind: tokenString, text: s[i+1 : i+1+end], pos: i})
+			i += end + 2
+		default:
+			start := i
+			for i < len(s) && !strings.ContainsRune(" \t\n\r&|!=<>(),\"'", rune(s[i])) {
+				i++
+			}
+			if i == start {
+				return append(tokens, token{kind: tokenError, text: s[i : i+1], pos: i})
+			}
+			tokens = append(tokens, token{kind: tokenWord, text: s[start:i], pos: start})
+			continue
+		}
+	}
+	return append(tokens, token{kind: tokenEOF, pos: len(s)})
+}
+
+// parser 递归下降解析器，优先级从低到高为 ||、&&、!
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (c *parser) peek() token {
+	return c.tokens[c.pos]
+}
+
+func (c *parser) next() token {
+	tok := c.tokens[c.pos]
+	if tok.kind != tokenEOF && tok.kind != tokenError {
+		c.pos++
+	}
+	return tok
+}
+
+func (c *parser) errorf(tok token, format string, args ...interface{}) error {
+	if tok.kind == tokenEOF {
+		return fmt.Errorf("%w: unexpected end of expression", ErrInvalidExpr)
+	}
+	return fmt.Errorf("%w at %d: %s", ErrInvalidExpr, tok.pos, fmt.Sprintf(format, args...))
+}
+
+// or 解析 and ( "||" and )*
+func (c *parser) or() (func(srv *service.Service) bool, error) {
+	left, err := c.and()
+	if err != nil {
+		return nil, err
+	}
+
+	for c.peek().kind == tokenOr {
+		c.next()
+		right, err := c.and()
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		left = func(srv *service.Service) bool {
+			return l(srv) || right(srv)
+		}
+	}
+	return left, nil
+}
+
+// and 解析 unary ( "&&" unary )*
+func (c *parser) and() (func(srv *service.Service) bool, error) {
+	left, err := c.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for c.peek().kind == tokenAnd {
+		c.next()
+		right, err := c.unary()
+		if err != nil {
+			return nil, err
+		}
+
+		l := left
+		left = func(srv *service.Service) bool {
+			return l(srv) && right(srv)
+		}
+	}
+	return left, nil
+}
+
+// unary 解析 "!" unary | "(" or ")" | cond
+func (c *parser) unary() (func(srv *service.Service) bool, error) {
+	switch tok := c.peek(); tok.kind {
+	case tokenNot:
+		c.next()
+		cond, err := c.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(srv *service.Service) bool {
+			return !cond(srv)
+		}, nil
+	case tokenLParen:
+		c.next()
+		cond, err := c.or()
+		if err != nil {
+			return nil, err
+		}
+		if tok := c.next(); tok.kind != tokenRParen {
+			return nil, c.errorf(tok, "expected ) but got %q", tok.text)
+		}
+		return cond, nil
+	}
+	return c.cond()
+}
+
+// cond 解析 field op value | field [not] in "(" value ("," value)* ")" | field
+func (c *parser) cond() (func(srv *service.Service) bool, error) {
+	tok := c.next()
+	if tok.kind != tokenWord {
+		return nil, c.errorf(tok, "expected field but got %q", tok.text)
+	}
+
+	f, ok := fields[tok.text]
+	if !ok {
+		if !strings.HasPrefix(tok.text, "metadata.") || len(tok.text) == len("metadata.") {
+			return nil, c.errorf(tok, "unknown field %q", tok.text)
+		}
+		f = metadataField(tok.text[len("metadata."):])
+	}
+
+	switch next := c.peek(); {
+	case next.kind == tokenOp:
+		c.next()
+		val, err := c.value()
+		if err != nil {
+			return nil, err
+		}
+		return compare(f, next.text, val), nil
+	case next.kind == tokenWord && next.text == "in":
+		c.next()
+		values, err := c.list()
+		if err != nil {
+			return nil, err
+		}
+		return in(f, values, false), nil
+	case next.kind == tokenWord && next.text == "not":
+		c.next()
+		if tok := c.next(); tok.kind != tokenWord || tok.text != "in" {
+			return nil, c.errorf(tok, "expected in but got %q", tok.text)
+		}
+		values, err := c.list()
+		if err != nil {
+			return nil, err
+		}
+		return in(f, values, true), nil
+	}
+	return exists(f), nil
+}
+
+// list 解析 "(" value ("," value)* ")"
+func (c *parser) list() ([]string, error) {
+	if tok := c.next(); tok.kind != tokenLParen {
+		return nil, c.errorf(tok, "expected ( but got %q", tok.text)
+	}
+
+	var values []string
+	for {
+		val, err := c.value()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, val)
+
+		switch tok := c.next(); tok.kind {
+		case tokenComma:
+		case tokenRParen:
+			return values, nil
+		default:
+			return nil, c.errorf(tok, "expected , or ) but got %q", tok.text)
+		}
+	}
+}
+
+// value 解析值
+func (c *parser) value() (string, error) {
+	tok := c.next()
+	if tok.kind != tokenWord && tok.kind != tokenString {
+		return "", c.errorf(tok, "expected value but got %q", tok.text)
+	}
+	return tok.text, nil
+}
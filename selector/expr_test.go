@@ -0,0 +1,69 @@
+package selector
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+func TestParseExpr(t *testing.T) {
+	srvs := []*service.Service{
+		newVersioned("a", "v1.0.0", map[string]string{"zone": "sh"}),
+		newVersioned("b", "1.2.5", map[string]string{"zone": "bj", "canary": "true"}),
+		newVersioned("c", "1.10", map[string]string{"zone": "gz", "owner": "zac yuan"}),
+		newVersioned("d", "2.0.0", map[string]string{"zone": "sh"}),
+	}
+	srvs[0].Host = "127.0.0.1:4001"
+	srvs[2].Status = service.StatusDraining
+	srvs[3].Weight = 10
+
+	for expr, want := range map[string]string{
+		"version>=1.2 && metadata.zone in (sh,bj)": "bd",
+		"version == 1":                                     "a",
+		"version = v2":                                     "d",
+		"version < 1.10 || metadata.zone=='gz'":            "abc",
+		"metadata.zone not in (sh, bj)":                    "c",
+		"metadata.canary":                                  "b",
+		"!metadata.canary && !(metadata.zone!=sh)":         "ad",
+		"(version==v2 || metadata.canary) && status!=DOWN": "bd",
+		"status == DRAINING":                               "c",
+		"weight > 1":                                       "d",
+		"host == \"127.0.0.1:4001\"":                       "a",
+		"id in (a, 'c')":                                   "ac",
+		"metadata.owner == \"zac yuan\"":                   "c",
+		"metadata.zone > 1":                                "",
+		"metadata.missing != x":                            "abcd",
+		"name == zacyuan.com || version >= 1.10 && metadata.zone == gz": "c",
+	} {
+		sel, err := ParseExpr(expr)
+		if !assert.Nil(t, err, expr) {
+			continue
+		}
+		assert.Equal(t, want, ids(sel, srvs), expr)
+	}
+}
+
+func TestParseExprError(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"version >=",
+		"zone == sh",
+		"metadata. == sh",
+		"version >= 1.2 &&",
+		"(version >= 1.2",
+		"version >= 1.2)",
+		"metadata.zone in sh",
+		"metadata.zone in (sh bj)",
+		"metadata.zone in (sh,",
+		"metadata.zone not (sh)",
+		"metadata.zone == 'sh",
+		"version 1.2",
+		"version == &",
+		"&& version",
+	} {
+		_, err := ParseExpr(expr)
+		assert.True(t, errors.Is(err, ErrInvalidExpr), expr)
+	}
+}
@@ -0,0 +1,49 @@
+package selector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+// Tracker 需要知道请求开始的选择器，如最少活跃请求。选中实例时调用Begin，请求结束时通过Feedback上报结果
+type Tracker interface {
+	// Begin 请求开始
+	Begin(name string, srv *service.Service)
+}
+
+// Handle 一次选择的结果，请求结束后需调用Done将结果上报给选择器
+type Handle struct {
+	Service   *service.Service
+	name      string
+	selectors []Selector
+	start     time.Time
+	once      sync.Once
+}
+
+// NewHandle 创建选择结果，并通知实现了Tracker的选择器请求开始
+func NewHandle(selectors []Selector, name string, srv *service.Service) *Handle {
+	for _, one := range selectors {
+		if tr, ok := one.(Tracker); ok {
+			tr.Begin(name, srv)
+		}
+	}
+
+	return &Handle{
+		Service:   srv,
+		name:      name,
+		selectors: selectors,
+		start:     time.Now(),
+	}
+}
+
+// Done 上报调用结果，err为nil表示调用成功，latency小于等于0时使用从选择到Done的耗时。多次调用只有第一次生效
+func (c *Handle) Done(err error, latency time.Duration) {
+	c.once.Do(func() {
+		if latency <= 0 {
+			latency = time.Since(c.start)
+		}
+		Report(c.selectors, c.name, c.Service, err, latency)
+	})
+}
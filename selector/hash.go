@@ -0,0 +1,161 @@
+package selector
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+const (
+	// defaultReplicas 每个权重单位的虚拟节点数
+	defaultReplicas = 160
+	// maxRings 每个服务最多缓存的哈希环数，前面的选择器可能每次传入不同的实例子集
+	maxRings = 8
+)
+
+// Hash ketama一致性哈希选择器，相同key总是选择同一实例，实例上下线时只有少量key重新映射。
+// 每个实例的虚拟节点数为 replicas*权重，按服务名与实例列表缓存哈希环。
+// 需通过SelectWithKey、PickWithKey等带key的方法使用，没有key时随机选择
+type Hash struct {
+	replicas int
+	m        sync.Mutex
+	rings    map[string]map[string]*ring
+}
+
+// NewHash 创建一致性哈希选择器，replicas为每个权重单位的虚拟节点数，小于等于0时使用160
+func NewHash(replicas int) *Hash {
+	if replicas <= 0 {
+		replicas = defaultReplicas
+	}
+
+	return &Hash{
+		replicas: replicas,
+		rings:    make(map[string]map[string]*ring),
+	}
+}
+
+// Filter 没有请求key时随机选择，跳过状态不是UP的实例
+func (c *Hash) Filter(name string, srvs []*service.Service) []*service.Service {
+	srvs = Available(srvs)
+	if len(srvs) == 0 {
+		return nil
+	}
+	return []*service.Service{srvs[rand.Intn(len(srvs))]}
+}
+
+// FilterKey 按请求key在哈希环上选择实例，跳过状态不是UP的实例
+func (c *Hash) FilterKey(name, key string, srvs []*service.Service) []*service.Service {
+	srvs = Available(srvs)
+	if len(srvs) == 0 {
+		return nil
+	}
+
+	c.m.Lock()
+	r := c.ring(name, srvs)
+	c.m.Unlock()
+
+	// 哈希环只保存实例ID，返回最新的服务信息
+	id := r.get(key)
+	for _, srv := range srvs {
+		if srv.ID == id {
+			return []*service.Service{srv}
+		}
+	}
+	return nil
+}
+
+// ring 获取实例列表对应的哈希环，没有时创建，超过maxRings时删除最久未使用的哈希环，需持有c.m
+func (c *Hash) ring(name string, srvs []*service.Service) *ring {
+	rings, ok := c.rings[name]
+	if !ok {
+		rings = make(map[string]*ring)
+		c.rings[name] = rings
+	}
+
+	key := ringKey(srvs)
+	r, ok := rings[key]
+	if !ok {
+		if len(rings) >= maxRings {
+			var oldest string
+			for k, one := range rings {
+				if oldest == "" || one.used.Before(rings[oldest].used) {
+					oldest = k
+				}
+			}
+			delete(rings, oldest)
+		}
+		r = newRing(srvs, c.replicas)
+		rings[key] = r
+	}
+	r.used = time.Now()
+	return r
+}
+
+// ringKey 由实例ID与权重生成哈希环的缓存key，与实例顺序无关
+func ringKey(srvs []*service.Service) string {
+	ids := make([]string, 0, len(srvs))
+	for _, srv := range srvs {
+		ids = append(ids, srv.ID+"/"+strconv.Itoa(srv.GetWeight()))
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+// ring 哈希环
+type ring struct {
+	points []uint32
+	nodes  map[uint32]string // 虚拟节点对应的实例ID
+	used   time.Time         // 上次使用时间
+}
+
+func newRing(srvs []*service.Service, replicas int) *ring {
+	r := &ring{
+		nodes: make(map[uint32]string),
+	}
+
+	for _, srv := range srvs {
+		weight := srv.GetWeight()
+
+		// 与ketama一致，每个md5摘要生成4个虚拟节点
+		for i := 0; i < (replicas*weight+3)/4; i++ {
+			digest := md5.Sum([]byte(srv.ID + "-" + strconv.Itoa(i)))
+			for j := 0; j < 4; j++ {
+				point := binary.LittleEndian.Uint32(digest[j*4:])
+				// 哈希冲突时保留ID较小的实例，保证结果与实例顺序无关
+				if old, ok := r.nodes[point]; ok && old < srv.ID {
+					continue
+				}
+				r.nodes[point] = srv.ID
+			}
+		}
+	}
+
+	r.points = make([]uint32, 0, len(r.nodes))
+	for point := range r.nodes {
+		r.points = append(r.points, point)
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i] < r.points[j]
+	})
+	return r
+}
+
+// get 顺时针查找第一个虚拟节点，返回实例ID
+func (c *ring) get(key string) string {
+	digest := md5.Sum([]byte(key))
+	hash := binary.LittleEndian.Uint32(digest[:4])
+	i := sort.Search(len(c.points), func(i int) bool {
+		return c.points[i] >= hash
+	})
+	if i == len(c.points) {
+		i = 0
+	}
+	return c.nodes[c.points[i]]
+}
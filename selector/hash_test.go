@@ -0,0 +1,161 @@
+package selector
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+func newHashServices(n int) []*service.Service {
+	var srvs []*service.Service
+	for i := 0; i < n; i++ {
+		srv := service.NewService()
+		srv.ID = fmt.Sprintf("node-%d", i)
+		srvs = append(srvs, srv)
+	}
+	return srvs
+}
+
+func mapping(sel *Hash, srvs []*service.Service, n int) map[string]string {
+	ret := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		ret[key] = sel.FilterKey("zacyuan.com", key, srvs)[0].ID
+	}
+	return ret
+}
+
+func TestNewHash(t *testing.T) {
+	assert.Equal(t, defaultReplicas, NewHash(0).replicas)
+	assert.Equal(t, 10, NewHash(10).replicas)
+}
+
+func TestHashFilterKey(t *testing.T) {
+	sel := NewHash(0)
+	srvs := newHashServices(5)
+
+	// 相同key总是选择同一实例，与实例顺序无关
+	before := mapping(sel, srvs, 1000)
+	reversed := append([]*service.Service{}, srvs...)
+	for i, j := 0, len(reversed)-1; i < j; i, j = i+1, j-1 {
+		reversed[i], reversed[j] = reversed[j], reversed[i]
+	}
+	assert.Equal(t, before, mapping(NewHash(0), reversed, 1000))
+
+	// 分布大致均匀
+	counts := make(map[string]int)
+	for _, id := range before {
+		counts[id]++
+	}
+	assert.Equal(t, 5, len(counts))
+	for _, n := range counts {
+		assert.Greater(t, n, 100)
+	}
+
+	// 实例下线时只有该实例的key重新映射
+	after := mapping(sel, srvs[:4], 1000)
+	for key, id := range before {
+		if id != "node-4" {
+			assert.Equal(t, id, after[key])
+		}
+	}
+
+	// 实例上线时只有少量key映射到新实例
+	srvs = append(srvs, newHashServices(6)[5])
+	after = mapping(sel, srvs, 1000)
+	moved := 0
+	for key, id := range before {
+		if after[key] != id {
+			moved++
+			assert.Equal(t, "node-5", after[key])
+		}
+	}
+	assert.Less(t, moved, 300)
+
+	// 不可用的实例不参与选择
+	for i := range srvs[1:] {
+		srvs[i+1].Status = service.StatusDown
+	}
+	for _, id := range mapping(sel, srvs, 100) {
+		assert.Equal(t, "node-0", id)
+	}
+	srvs[0].Status = service.StatusDraining
+	assert.Nil(t, sel.FilterKey("zacyuan.com", "key", srvs))
+}
+
+func TestHashWeight(t *testing.T) {
+	srvs := newHashServices(2)
+	srvs[0].Weight = 3
+	counts := make(map[string]int)
+	for _, id := range mapping(NewHash(0), srvs, 4000) {
+		counts[id]++
+	}
+	assert.Greater(t, counts["node-0"], 2500)
+
+	// 服务信息更新后返回最新的服务信息
+	sel := NewHash(1)
+	one := sel.FilterKey("zacyuan.com", "key", srvs)[0]
+	clone := one.Clone()
+	clone.Host = "127.0.0.1:4001"
+	list := []*service.Service{clone}
+	if one == srvs[0] {
+		list = append(list, srvs[1])
+	} else {
+		list = append(list, srvs[0])
+	}
+	assert.Equal(t, clone, sel.FilterKey("zacyuan.com", "key", list)[0])
+}
+
+func TestHashFilter(t *testing.T) {
+	sel := NewHash(0)
+	srvs := newHashServices(3)
+
+	// 没有key时随机选择
+	ids := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		list := sel.Filter("zacyuan.com", srvs)
+		assert.Equal(t, 1, len(list))
+		ids[list[0].ID] = true
+	}
+	assert.Equal(t, 3, len(ids))
+	srvs[0].Status = service.StatusDown
+	srvs[1].Status = service.StatusDown
+	assert.Equal(t, srvs[2], sel.Filter("zacyuan.com", srvs)[0])
+	srvs[2].Status = service.StatusDown
+	assert.Nil(t, sel.Filter("zacyuan.com", srvs))
+	srvs = newHashServices(3)
+
+	// 没有实现KeyFilter的选择器使用Filter
+	assert.Equal(t, 1, len(FilterWithKey(NewRound(), "zacyuan.com", "key", srvs)))
+	assert.Equal(t, sel.FilterKey("zacyuan.com", "key", srvs), FilterWithKey(sel, "zacyuan.com", "key", srvs))
+}
+
+func TestHashRings(t *testing.T) {
+	sel := NewHash(1)
+	srvs := newHashServices(maxRings + 2)
+
+	// 按实例列表缓存哈希环，不同子集交替传入时不重建
+	sel.FilterKey("zacyuan.com", "key", srvs)
+	sel.FilterKey("zacyuan.com", "key", srvs[1:])
+	rings := sel.rings["zacyuan.com"]
+	assert.Equal(t, 2, len(rings))
+	r := rings[ringKey(srvs)]
+	sel.FilterKey("zacyuan.com", "key", srvs)
+	assert.True(t, r == rings[ringKey(srvs)])
+
+	// 权重变化时使用新的哈希环
+	old := ringKey(srvs)
+	srvs[0].Weight = 5
+	sel.FilterKey("zacyuan.com", "key", srvs)
+	assert.Equal(t, 3, len(rings))
+
+	// 超过上限时删除最久未使用的哈希环
+	for i := 0; i < maxRings; i++ {
+		sel.FilterKey("zacyuan.com", "key", srvs[i:])
+	}
+	assert.Equal(t, maxRings, len(rings))
+	assert.NotNil(t, rings[ringKey(srvs)])
+	assert.Nil(t, rings[old])
+}
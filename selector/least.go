@@ -0,0 +1,124 @@
+package selector
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+// LeastRequest 最少活跃请求选择器，选择 活跃请求数/权重 最小的实例，相同时随机选择。
+// 活跃请求数在Begin时加一、Feedback时减一，需配合Discovery.Pick或selector.NewHandle使用
+type LeastRequest struct {
+	m      sync.Mutex
+	ttl    time.Duration
+	pruned time.Time
+	active map[string]map[string]*leastStat
+}
+
+// leastStat 实例的活跃请求数
+type leastStat struct {
+	active int       // 活跃请求数
+	seen   time.Time // 上次使用时间
+}
+
+// NewLeastRequest 创建最少活跃请求选择器
+func NewLeastRequest() *LeastRequest {
+	return &LeastRequest{
+		ttl:    stateTTL,
+		active: make(map[string]map[string]*leastStat),
+	}
+}
+
+// Filter 最少活跃请求过滤器，跳过状态不是UP的实例
+func (c *LeastRequest) Filter(name string, srvs []*service.Service) []*service.Service {
+	srvs = Available(srvs)
+	if len(srvs) == 0 {
+		return nil
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	now := time.Now()
+	var best *service.Service
+	var bs *leastStat
+	n := 0
+	for _, one := range srvs {
+		st := c.stat(name, one, now)
+		if best == nil {
+			best, bs, n = one, st, 1
+			continue
+		}
+
+		// 比较 active/weight，交叉相乘避免除法
+		cmp := st.active*best.GetWeight() - bs.active*one.GetWeight()
+		if cmp < 0 {
+			best, bs, n = one, st, 1
+		} else if cmp == 0 {
+			// 蓄水池抽样，在活跃请求数相同的实例中随机选择
+			n++
+			if rand.Intn(n) == 0 {
+				best, bs = one, st
+			}
+		}
+	}
+
+	c.prune(now)
+	return []*service.Service{best}
+}
+
+// Begin 实例活跃请求数加一
+func (c *LeastRequest) Begin(name string, srv *service.Service) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.stat(name, srv, time.Now()).active++
+}
+
+// Feedback 实例活跃请求数减一
+func (c *LeastRequest) Feedback(name string, srv *service.Service, err error, latency time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	st := c.stat(name, srv, time.Now())
+	if st.active > 0 {
+		st.active--
+	}
+}
+
+// stat 获取实例状态并更新使用时间，需持有c.m
+func (c *LeastRequest) stat(name string, srv *service.Service, now time.Time) *leastStat {
+	stats, ok := c.active[name]
+	if !ok {
+		stats = make(map[string]*leastStat)
+		c.active[name] = stats
+	}
+
+	st, ok := stats[srv.ID]
+	if !ok {
+		st = &leastStat{}
+		stats[srv.ID] = st
+	}
+	st.seen = now
+	return st
+}
+
+// prune 删除超过ttl未使用且没有活跃请求的实例状态，每个ttl最多执行一次，需持有c.m
+func (c *LeastRequest) prune(now time.Time) {
+	if now.Sub(c.pruned) < c.ttl {
+		return
+	}
+	c.pruned = now
+
+	for name, stats := range c.active {
+		for id, st := range stats {
+			if st.active == 0 && now.Sub(st.seen) >= c.ttl {
+				delete(stats, id)
+			}
+		}
+		if len(stats) == 0 {
+			delete(c.active, name)
+		}
+	}
+}
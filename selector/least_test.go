@@ -0,0 +1,81 @@
+package selector
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+func TestNewLeastRequest(t *testing.T) {
+	sel := NewLeastRequest()
+	assert.NotNil(t, sel)
+	assert.NotNil(t, sel.active)
+}
+
+func TestLeastRequestFilter(t *testing.T) {
+	sel := NewLeastRequest()
+	srvs := []*service.Service{newWeighted("a", 1), newWeighted("b", 1), newWeighted("c", 2)}
+
+	// 没有活跃请求时随机选择
+	ids := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		ids[sel.Filter("zacyuan.com", srvs)[0].ID] = true
+	}
+	assert.Equal(t, 3, len(ids))
+
+	// 选择 活跃请求数/权重 最小的实例
+	var handles []*Handle
+	for i := 0; i < 8; i++ {
+		srv := sel.Filter("zacyuan.com", srvs)[0]
+		handles = append(handles, NewHandle([]Selector{sel}, "zacyuan.com", srv))
+	}
+	active := sel.active["zacyuan.com"]
+	assert.Equal(t, 2, active["a"].active)
+	assert.Equal(t, 2, active["b"].active)
+	assert.Equal(t, 4, active["c"].active)
+
+	// 请求结束后活跃请求数减少
+	for _, h := range handles {
+		if h.Service.ID == "a" {
+			h.Done(nil, time.Millisecond)
+		}
+	}
+	assert.Equal(t, 0, active["a"].active)
+	assert.Equal(t, "a", sel.Filter("zacyuan.com", srvs)[0].ID)
+
+	// 不可用的实例不参与选择，但保留其状态
+	srvs[0].Status = service.StatusDown
+	assert.NotEqual(t, "a", sel.Filter("zacyuan.com", srvs)[0].ID)
+	assert.Equal(t, 3, len(active))
+
+	srvs[1].Status = service.StatusDown
+	srvs[2].Status = service.StatusDraining
+	assert.Nil(t, sel.Filter("zacyuan.com", srvs))
+}
+
+func TestLeastRequestPrune(t *testing.T) {
+	sel := NewLeastRequest()
+	sel.ttl = 50 * time.Millisecond
+	srvs := []*service.Service{newWeighted("a", 1), newWeighted("b", 1)}
+
+	h := NewHandle([]Selector{sel}, "zacyuan.com", srvs[0])
+	sel.Filter("zacyuan.com", srvs)
+
+	// 只传入部分实例时保留其他实例的状态
+	sel.Filter("zacyuan.com", srvs[1:])
+	assert.Equal(t, 2, len(sel.active["zacyuan.com"]))
+
+	// 超过ttl未使用的实例状态被删除，有活跃请求的实例保留
+	time.Sleep(60 * time.Millisecond)
+	sel.Filter("zacyuan.com", srvs[1:])
+	assert.Equal(t, 2, len(sel.active["zacyuan.com"]))
+	assert.Equal(t, 1, sel.active["zacyuan.com"]["a"].active)
+
+	h.Done(nil, time.Millisecond)
+	time.Sleep(60 * time.Millisecond)
+	sel.Filter("zacyuan.com", srvs[1:])
+	assert.Equal(t, 1, len(sel.active["zacyuan.com"]))
+	assert.NotNil(t, sel.active["zacyuan.com"]["b"])
+}
@@ -0,0 +1,305 @@
+package selector
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+// Match 按条件过滤实例的选择器，可以设置过滤后没有实例时使用的回退选择器
+type Match struct {
+	cond     func(srv *service.Service) bool
+	fallback Selector
+}
+
+// NewMatch 创建按条件过滤实例的选择器，cond返回true的实例被保留
+func NewMatch(cond func(srv *service.Service) bool) *Match {
+	return &Match{
+		cond: cond,
+	}
+}
+
+// NewVersion 创建按版本过滤的选择器。constraint为空格或逗号分隔的多个条件，需同时满足：
+// 不带运算符时版本相等（1.2与v1.2.0相等），支持 >=、<=、>、<、!=、==，^1.2表示>=1.2且<2，~1.2表示>=1.2且<1.3
+func NewVersion(constraint string) (*Match, error) {
+	parts := strings.FieldsFunc(constraint, func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("%w: empty version constraint", ErrInvalidExpr)
+	}
+
+	var conds []func(srv *service.Service) bool
+	for _, one := range parts {
+		op, ver := splitOperator(one)
+		if ver == "" {
+			return nil, fmt.Errorf("%w: invalid version constraint %q", ErrInvalidExpr, one)
+		}
+
+		switch op {
+		case "^", "~":
+			if !isVersion(ver) {
+				return nil, fmt.Errorf("%w: invalid version %q", ErrInvalidExpr, ver)
+			}
+			upper := nextVersion(ver, op == "~")
+			conds = append(conds, compare(versionField, ">=", ver), compare(versionField, "<", upper))
+		case "":
+			conds = append(conds, compare(versionField, "==", ver))
+		default:
+			conds = append(conds, compare(versionField, op, ver))
+		}
+	}
+
+	return NewMatch(func(srv *service.Service) bool {
+		for _, cond := range conds {
+			if !cond(srv) {
+				return false
+			}
+		}
+		return true
+	}), nil
+}
+
+// NewMetadata 创建按扩展信息过滤的选择器，values为空时保留Metadata[key]不为空的实例，否则保留Metadata[key]为其中之一的实例
+func NewMetadata(key string, values ...string) *Match {
+	f := metadataField(key)
+	if len(values) == 0 {
+		return NewMatch(exists(f))
+	}
+	return NewMatch(in(f, values, false))
+}
+
+// Fallback 设置过滤后没有实例时使用的回退选择器，回退选择器过滤的是过滤前的实例列表
+func (c *Match) Fallback(sel Selector) *Match {
+	c.fallback = sel
+	return c
+}
+
+// Filter 条件过滤器，没有实例满足条件且设置了回退选择器时使用回退选择器
+func (c *Match) Filter(name string, srvs []*service.Service) []*service.Service {
+	list := make([]*service.Service, 0, len(srvs))
+	for _, one := range srvs {
+		if c.cond(one) {
+			list = append(list, one)
+		}
+	}
+
+	if len(list) == 0 {
+		if c.fallback != nil {
+			return c.fallback.Filter(name, srvs)
+		}
+		return nil
+	}
+	return list
+}
+
+// All 不过滤的选择器，可以作为Match的回退选择器，条件过滤掉所有实例时返回全部实例
+type All struct {
+}
+
+// NewAll 创建不过滤的选择器
+func NewAll() *All {
+	return &All{}
+}
+
+// Filter 返回全部实例
+func (c *All) Filter(name string, srvs []*service.Service) []*service.Service {
+	return srvs
+}
+
+// field 实例字段
+type field struct {
+	get     func(srv *service.Service) (val string, ok bool) // 获取字段值，字段不存在时ok为false
+	version bool                                             // 按版本号判断相等
+}
+
+var versionField = field{
+	get:     func(srv *service.Service) (string, bool) { return srv.Version, true },
+	version: true,
+}
+
+func metadataField(key string) field {
+	return field{
+		get: func(srv *service.Service) (string, bool) {
+			val, ok := srv.Metadata[key]
+			return val, ok
+		},
+	}
+}
+
+// fields 表达式中可以使用的字段，另外支持metadata.<key>
+var fields = map[string]field{
+	"version": versionField,
+	"id":      {get: func(srv *service.Service) (string, bool) { return srv.ID, true }},
+	"name":    {get: func(srv *service.Service) (string, bool) { return srv.Name, true }},
+	"host":    {get: func(srv *service.Service) (string, bool) { return srv.Host, true }},
+	"status":  {get: func(srv *service.Service) (string, bool) { return srv.Status, true }},
+	"weight":  {get: func(srv *service.Service) (string, bool) { return strconv.Itoa(srv.GetWeight()), true }},
+}
+
+// equal 判断字段值是否相等，version字段按版本号比较
+func (c field) equal(val, want string) bool {
+	if c.version && isVersion(val) && isVersion(want) {
+		return compareVersion(val, want) == 0
+	}
+	return val == want
+}
+
+// compare 创建比较条件，>=、<=、>、<按版本号规则比较，不是版本号的值不满足条件
+func compare(f field, op, want string) func(srv *service.Service) bool {
+	return func(srv *service.Service) bool {
+		val, ok := f.get(srv)
+		switch op {
+		case "==", "=":
+			return ok && f.equal(val, want)
+		case "!=":
+			return !ok || !f.equal(val, want)
+		}
+
+		if !ok || !isVersion(val) || !isVersion(want) {
+			return false
+		}
+		n := compareVersion(val, want)
+		switch op {
+		case ">=":
+			return n >= 0
+		case "<=":
+			return n <= 0
+		case ">":
+			return n > 0
+		case "<":
+			return n < 0
+		}
+		return false
+	}
+}
+
+// in 创建集合条件，not为true时字段值不在集合中或字段不存在满足条件
+func in(f field, values []string, not bool) func(srv *service.Service) bool {
+	return func(srv *service.Service) bool {
+		val, ok := f.get(srv)
+		if ok {
+			for _, one := range values {
+				if f.equal(val, one) {
+					return !not
+				}
+			}
+		}
+		return not
+	}
+}
+
+// exists 创建字段存在且不为空的条件
+func exists(f field) func(srv *service.Service) bool {
+	return func(srv *service.Service) bool {
+		val, ok := f.get(srv)
+		return ok && val != ""
+	}
+}
+
+// splitOperator 拆分版本条件中的运算符与版本号
+func splitOperator(s string) (string, string) {
+	for _, op := range []string{">=", "<=", "!=", "==", ">", "<", "=", "^", "~"} {
+		if strings.HasPrefix(s, op) {
+			return op, s[len(op):]
+		}
+	}
+	return "", s
+}
+
+// isVersion 判断是否为数字开头的版本号，可以带v前缀
+func isVersion(s string) bool {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "v"), "V")
+	return s != "" && s[0] >= '0' && s[0] <= '9'
+}
+
+// compareVersion 按版本号规则比较：去掉v前缀与+之后的构建信息，按.逐段比较，缺少的段视为0，
+// 数字段按数值比较，其他按字符串比较；带-预发布后缀的版本小于对应的正式版本
+func compareVersion(a, b string) int {
+	a, preA := splitVersion(a)
+	b, preB := splitVersion(b)
+	if n := compareSegments(a, b); n != 0 {
+		return n
+	}
+
+	switch {
+	case preA == preB:
+		return 0
+	case preA == "":
+		return 1
+	case preB == "":
+		return -1
+	}
+	return compareSegments(preA, preB)
+}
+
+// splitVersion 拆分版本号与预发布后缀
+func splitVersion(s string) (string, string) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "v"), "V")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// compareSegments 按.逐段比较
+func compareSegments(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		x, y := "0", "0"
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+
+		nx, errX := strconv.ParseUint(x, 10, 64)
+		ny, errY := strconv.ParseUint(y, 10, 64)
+		switch {
+		case errX == nil && errY == nil:
+			if nx != ny {
+				if nx < ny {
+					return -1
+				}
+				return 1
+			}
+		case errX == nil: // 数字段小于非数字段
+			return -1
+		case errY == nil:
+			return 1
+		default:
+			if n := strings.Compare(x, y); n != 0 {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// nextVersion 计算^、~条件的上限：^1.2.3为2，^0.2.3为0.3，~1.2.3为1.3，~1为2。
+// 上限带-0后缀，使上限版本的预发布版本也不满足条件
+func nextVersion(ver string, tilde bool) string {
+	main, _ := splitVersion(ver)
+	segs := strings.Split(main, ".")
+	i := 0
+	if tilde {
+		if len(segs) > 1 {
+			i = 1
+		}
+	} else {
+		// ^按第一个不为0的段计算上限
+		for i < len(segs)-1 && segs[i] == "0" {
+			i++
+		}
+	}
+
+	n, _ := strconv.ParseUint(segs[i], 10, 64)
+	segs[i] = strconv.FormatUint(n+1, 10)
+	return strings.Join(segs[:i+1], ".") + "-0"
+}
@@ -0,0 +1,116 @@
+package selector
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+func newVersioned(id, version string, metadata map[string]string) *service.Service {
+	srv := service.NewService()
+	srv.ID = id
+	srv.Version = version
+	for k, v := range metadata {
+		srv.Metadata[k] = v
+	}
+	return srv
+}
+
+// ids 返回选择器过滤后的实例ID
+func ids(sel Selector, srvs []*service.Service) string {
+	s := ""
+	for _, one := range sel.Filter("zacyuan.com", srvs) {
+		s += one.ID
+	}
+	return s
+}
+
+func TestCompareVersion(t *testing.T) {
+	assert.Equal(t, 0, compareVersion("1.2", "v1.2.0"))
+	assert.Equal(t, 0, compareVersion("1.2.0+build", "1.2"))
+	assert.Equal(t, -1, compareVersion("1.2", "1.10"))
+	assert.Equal(t, 1, compareVersion("2", "1.99.99"))
+	assert.Equal(t, -1, compareVersion("1.2.0-rc1", "1.2.0"))
+	assert.Equal(t, -1, compareVersion("1.2.0-rc1", "1.2.0-rc2"))
+	assert.Equal(t, 1, compareVersion("1.2.0-rc.10", "1.2.0-rc.2"))
+	assert.Equal(t, -1, compareVersion("1.2.0-1", "1.2.0-alpha"))
+
+	assert.True(t, isVersion("v1"))
+	assert.False(t, isVersion("latest"))
+	assert.False(t, isVersion("v"))
+
+	assert.Equal(t, "2-0", nextVersion("1.2.3", false))
+	assert.Equal(t, "0.3-0", nextVersion("0.2.3", false))
+	assert.Equal(t, "0.0.4-0", nextVersion("0.0.3", false))
+	assert.Equal(t, "1.3-0", nextVersion("v1.2.3", true))
+	assert.Equal(t, "2-0", nextVersion("1", true))
+}
+
+func TestNewVersion(t *testing.T) {
+	srvs := []*service.Service{
+		newVersioned("a", "v1.0.0", nil),
+		newVersioned("b", "1.2.5", nil),
+		newVersioned("c", "1.10", nil),
+		newVersioned("d", "2.0.0-rc1", nil),
+		newVersioned("e", "latest", nil),
+	}
+
+	for constraint, want := range map[string]string{
+		"1":            "a",
+		"v1.2.5":       "b",
+		"==latest":     "e",
+		"!=1.2.5":      "acde",
+		">=1.2":        "bcd",
+		">1.2, <2":     "bcd",
+		"<=1.2.5 >1.0": "b",
+		"^1.2":         "bc",
+		"~1.2":         "b",
+		"^2.0.0-rc1":   "d",
+		">=3":          "",
+	} {
+		sel, err := NewVersion(constraint)
+		assert.Nil(t, err)
+		assert.Equal(t, want, ids(sel, srvs), constraint)
+	}
+
+	for _, constraint := range []string{"", " , ", ">=", "^latest"} {
+		_, err := NewVersion(constraint)
+		assert.True(t, errors.Is(err, ErrInvalidExpr), constraint)
+	}
+}
+
+func TestNewMetadata(t *testing.T) {
+	srvs := []*service.Service{
+		newVersioned("a", "1", map[string]string{"zone": "sh"}),
+		newVersioned("b", "1", map[string]string{"zone": "bj", "canary": "true"}),
+		newVersioned("c", "1", map[string]string{"zone": ""}),
+	}
+	srvs[2].Metadata = nil
+
+	assert.Equal(t, "a", ids(NewMetadata("zone", "sh"), srvs))
+	assert.Equal(t, "ab", ids(NewMetadata("zone", "sh", "bj"), srvs))
+	assert.Equal(t, "b", ids(NewMetadata("canary"), srvs))
+	assert.Equal(t, "", ids(NewMetadata("zone", "gz"), srvs))
+	assert.Nil(t, NewMetadata("zone", "gz").Filter("zacyuan.com", srvs))
+}
+
+func TestMatchFallback(t *testing.T) {
+	srvs := []*service.Service{
+		newVersioned("a", "1", map[string]string{"zone": "sh"}),
+		newVersioned("b", "1", map[string]string{"zone": "bj"}),
+	}
+
+	// 过滤掉所有实例时使用回退选择器过滤原列表
+	sel := NewMetadata("zone", "gz").Fallback(NewAll())
+	assert.Equal(t, "ab", ids(sel, srvs))
+	sel = NewMetadata("zone", "gz").Fallback(NewMetadata("zone", "bj"))
+	assert.Equal(t, "b", ids(sel, srvs))
+	assert.Equal(t, "a", ids(NewMetadata("zone", "sh").Fallback(NewAll()), srvs))
+
+	// 可以多级回退
+	sel = NewMetadata("zone", "gz").Fallback(NewMetadata("zone", "sz").Fallback(NewMetadata("zone", "sh")))
+	assert.Equal(t, "a", ids(sel, srvs))
+	assert.Equal(t, "", ids(NewMatch(func(srv *service.Service) bool { return false }), srvs))
+}
@@ -0,0 +1,178 @@
+package selector
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+const (
+	// defaultDecay EWMA延迟的衰减时间
+	defaultDecay = 10 * time.Second
+	// errorPenalty 调用失败时按该延迟计入EWMA，使失败的实例负载升高
+	errorPenalty = time.Second
+)
+
+// P2C 基于EWMA延迟的两次随机选择器：随机取两个实例，选择 EWMA延迟*(活跃请求数+1)/权重 较小的实例。
+// 较差的实例超过衰减时间未被选中时强制选择一次，以便更新其延迟。需配合Discovery.Pick或selector.NewHandle使用
+type P2C struct {
+	decay  time.Duration
+	ttl    time.Duration
+	pruned time.Time
+	m      sync.Mutex
+	stats  map[string]map[string]*p2cStat
+}
+
+// p2cStat 实例的调用统计
+type p2cStat struct {
+	ewma   float64   // EWMA延迟，单位纳秒
+	active int       // 活跃请求数
+	update time.Time // 上次更新EWMA的时间
+	picked time.Time // 上次被选中的时间
+	seen   time.Time // 上次使用时间
+}
+
+// NewP2C 创建两次随机选择器，decay为EWMA延迟的衰减时间，小于等于0时使用10秒
+func NewP2C(decay time.Duration) *P2C {
+	if decay <= 0 {
+		decay = defaultDecay
+	}
+
+	return &P2C{
+		decay: decay,
+		ttl:   stateTTL,
+		stats: make(map[string]map[string]*p2cStat),
+	}
+}
+
+// Filter 两次随机过滤器，跳过状态不是UP的实例
+func (c *P2C) Filter(name string, srvs []*service.Service) []*service.Service {
+	srvs = Available(srvs)
+	if len(srvs) <= 1 {
+		return srvs
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	now := time.Now()
+	c.prune(now)
+	stats := c.service(name)
+	i := rand.Intn(len(srvs))
+	j := rand.Intn(len(srvs) - 1)
+	if j >= i {
+		j++
+	}
+
+	best, worse := srvs[i], srvs[j]
+	bs, ws := c.stat(stats, best), c.stat(stats, worse)
+	bs.seen, ws.seen = now, now
+	if c.load(bs, best) > c.load(ws, worse) {
+		best, worse = worse, best
+		bs, ws = ws, bs
+	}
+
+	// 较差的实例长时间未被选中时强制选择一次
+	if !ws.picked.IsZero() && now.Sub(ws.picked) > c.decay {
+		best, bs = worse, ws
+	}
+	bs.picked = now
+
+	return []*service.Service{best}
+}
+
+// Begin 实例活跃请求数加一
+func (c *P2C) Begin(name string, srv *service.Service) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	st := c.stat(c.service(name), srv)
+	st.active++
+	st.seen = time.Now()
+}
+
+// Feedback 实例活跃请求数减一，并按调用耗时更新EWMA延迟：延迟升高时立即取新值，降低时按时间衰减，失败时至少按1秒计算
+func (c *P2C) Feedback(name string, srv *service.Service, err error, latency time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	st := c.stat(c.service(name), srv)
+	if st.active > 0 {
+		st.active--
+	}
+
+	if err != nil && latency < errorPenalty {
+		latency = errorPenalty
+	}
+
+	now := time.Now()
+	if st.update.IsZero() || float64(latency) > st.ewma {
+		// 延迟升高时立即生效，及时避开变慢或失败的实例
+		st.ewma = float64(latency)
+	} else {
+		// 按距上次更新的时间衰减，间隔越久新样本的权重越大
+		w := math.Exp(-float64(now.Sub(st.update)) / float64(c.decay))
+		st.ewma = st.ewma*w + float64(latency)*(1-w)
+	}
+	st.update = now
+	st.seen = now
+}
+
+// stat 获取实例的调用统计，新实例使用已有实例的平均延迟，避免新实例瞬间接收大量请求，需持有c.m
+func (c *P2C) stat(stats map[string]*p2cStat, srv *service.Service) *p2cStat {
+	st, ok := stats[srv.ID]
+	if ok {
+		return st
+	}
+
+	st = &p2cStat{}
+	n := 0
+	for _, one := range stats {
+		if !one.update.IsZero() {
+			st.ewma += one.ewma
+			n++
+		}
+	}
+	if n > 0 {
+		st.ewma /= float64(n)
+	}
+	stats[srv.ID] = st
+	return st
+}
+
+// load 计算实例负载，没有延迟数据时按活跃请求数比较
+func (c *P2C) load(st *p2cStat, srv *service.Service) float64 {
+	return (st.ewma + 1) * float64(st.active+1) / float64(srv.GetWeight())
+}
+
+// service 获取服务的实例统计，需持有c.m
+func (c *P2C) service(name string) map[string]*p2cStat {
+	stats, ok := c.stats[name]
+	if !ok {
+		stats = make(map[string]*p2cStat)
+		c.stats[name] = stats
+	}
+	return stats
+}
+
+// prune 删除超过ttl未使用且没有活跃请求的实例统计，每个ttl最多执行一次，需持有c.m
+func (c *P2C) prune(now time.Time) {
+	if now.Sub(c.pruned) < c.ttl {
+		return
+	}
+	c.pruned = now
+
+	for name, stats := range c.stats {
+		for id, st := range stats {
+			if st.active == 0 && now.Sub(st.seen) >= c.ttl {
+				delete(stats, id)
+			}
+		}
+		if len(stats) == 0 {
+			delete(c.stats, name)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package selector
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+func TestNewP2C(t *testing.T) {
+	sel := NewP2C(0)
+	assert.Equal(t, defaultDecay, sel.decay)
+	assert.NotNil(t, sel.stats)
+	assert.Equal(t, time.Second, NewP2C(time.Second).decay)
+}
+
+// call 选择实例并按实例耗时上报结果，返回选中的实例ID
+func call(sel Selector, srvs []*service.Service, latency map[string]time.Duration, err map[string]error) string {
+	srv := sel.Filter("zacyuan.com", srvs)[0]
+	h := NewHandle([]Selector{sel}, "zacyuan.com", srv)
+	h.Done(err[srv.ID], latency[srv.ID])
+	return srv.ID
+}
+
+func TestP2CFilter(t *testing.T) {
+	sel := NewP2C(0)
+	srvs := []*service.Service{newWeighted("a", 1), newWeighted("b", 1), newWeighted("c", 1)}
+
+	// 大部分请求选择延迟最低的实例
+	latency := map[string]time.Duration{"a": time.Millisecond, "b": 20 * time.Millisecond, "c": 50 * time.Millisecond}
+	counts := make(map[string]int)
+	for i := 0; i < 300; i++ {
+		counts[call(sel, srvs, latency, nil)]++
+	}
+	assert.Greater(t, counts["a"], 150)
+	assert.Greater(t, counts["a"], counts["b"])
+	assert.Greater(t, counts["b"], counts["c"])
+
+	// 调用失败的实例负载升高
+	errs := map[string]error{"a": errors.New("failed")}
+	for i := 0; i < 50; i++ {
+		call(sel, srvs, latency, errs)
+	}
+	counts = make(map[string]int)
+	for i := 0; i < 300; i++ {
+		counts[call(sel, srvs, latency, nil)]++
+	}
+	assert.Greater(t, counts["b"], counts["a"])
+
+	// 不可用的实例不参与选择，但保留其统计
+	srvs[0].Status = service.StatusDown
+	for i := 0; i < 10; i++ {
+		assert.NotEqual(t, "a", call(sel, srvs, latency, nil))
+	}
+	assert.Equal(t, 3, len(sel.stats["zacyuan.com"]))
+
+	srvs[1].Status = service.StatusDraining
+	assert.Equal(t, "c", sel.Filter("zacyuan.com", srvs)[0].ID)
+	srvs[2].Status = service.StatusDown
+	assert.Equal(t, 0, len(sel.Filter("zacyuan.com", srvs)))
+}
+
+func TestP2CActive(t *testing.T) {
+	sel := NewP2C(0)
+	srvs := []*service.Service{newWeighted("a", 1), newWeighted("b", 1)}
+
+	// 延迟相同时选择活跃请求数较少的实例
+	h := NewHandle([]Selector{sel}, "zacyuan.com", srvs[0])
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "b", sel.Filter("zacyuan.com", srvs)[0].ID)
+	}
+	h.Done(nil, time.Millisecond)
+	assert.Equal(t, 0, sel.stats["zacyuan.com"]["a"].active)
+}
+
+func TestP2CForcePick(t *testing.T) {
+	sel := NewP2C(50 * time.Millisecond)
+	srvs := []*service.Service{newWeighted("a", 1), newWeighted("b", 1)}
+	latency := map[string]time.Duration{"a": time.Millisecond, "b": time.Second}
+	call(sel, srvs[:1], latency, nil)
+	call(sel, srvs[1:], latency, nil)
+
+	// 较差的实例超过衰减时间未被选中时强制选择一次
+	sel.stats["zacyuan.com"]["b"].picked = time.Now()
+	assert.Equal(t, "a", sel.Filter("zacyuan.com", srvs)[0].ID)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, "b", sel.Filter("zacyuan.com", srvs)[0].ID)
+	assert.Equal(t, "a", sel.Filter("zacyuan.com", srvs)[0].ID)
+}
+
+func TestP2CPrune(t *testing.T) {
+	sel := NewP2C(0)
+	sel.ttl = 50 * time.Millisecond
+	srvs := []*service.Service{newWeighted("a", 1), newWeighted("b", 1), newWeighted("c", 1)}
+
+	h := NewHandle([]Selector{sel}, "zacyuan.com", srvs[0])
+	sel.Feedback("zacyuan.com", srvs[1], nil, time.Millisecond)
+	sel.Feedback("zacyuan.com", srvs[2], nil, time.Millisecond)
+
+	// 只传入部分实例时保留其他实例的统计
+	sel.Filter("zacyuan.com", srvs[1:])
+	assert.Equal(t, 3, len(sel.stats["zacyuan.com"]))
+
+	// 超过ttl未使用的实例统计被删除，有活跃请求的实例保留
+	time.Sleep(60 * time.Millisecond)
+	sel.Filter("zacyuan.com", srvs[1:])
+	assert.Equal(t, 3, len(sel.stats["zacyuan.com"]))
+
+	h.Done(nil, time.Millisecond)
+	time.Sleep(60 * time.Millisecond)
+	sel.Filter("zacyuan.com", srvs[1:])
+	assert.Equal(t, 2, len(sel.stats["zacyuan.com"]))
+	assert.Nil(t, sel.stats["zacyuan.com"]["a"])
+}
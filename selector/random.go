@@ -20,8 +20,13 @@ func NewRandom() *Random {
 	return &Random{}
 }
 
-// Filter 随机过滤器
+// Filter 随机过滤器，跳过状态不是UP的实例
 func (c *Random) Filter(name string, srvs []*service.Service) []*service.Service {
+	srvs = Available(srvs)
+	if len(srvs) == 0 {
+		return nil
+	}
+
 	index := rand.Int() % len(srvs)
 	return []*service.Service{srvs[index]}
 }
@@ -19,8 +19,13 @@ func NewRound() *Round {
 	}
 }
 
-// Filter 轮询过滤器
+// Filter 轮询过滤器，跳过状态不是UP的实例
 func (c *Round) Filter(name string, srvs []*service.Service) []*service.Service {
+	srvs = Available(srvs)
+	if len(srvs) == 0 {
+		return nil
+	}
+
 	c.m.Lock()
 	defer c.m.Unlock()
 	index := c.index[name] % uint(len(srvs))
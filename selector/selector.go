@@ -1,11 +1,64 @@
 package selector
 
 import (
+	"time"
+
 	"github.com/yuanzhangcai/srsd/service"
 )
 
+// stateTTL 选择器保存的实例状态超过该时间未使用时删除。实例可能只是在某次选择中被前面的选择器过滤掉，
+// 不能因为Filter收到的列表中没有该实例就删除其状态
+const stateTTL = time.Minute
+
 // Selector 服务选择器
 type Selector interface {
 	// Filter 选择过滤器
 	Filter(name string, srvs []*service.Service) []*service.Service
 }
+
+// Feedback 可以接收调用结果的选择器，调用方在每次请求结束后上报实例的成功/失败与耗时
+type Feedback interface {
+	// Feedback 上报调用结果，err为nil表示调用成功
+	Feedback(name string, srv *service.Service, err error, latency time.Duration)
+}
+
+// KeyFilter 可以按请求key选择实例的选择器，如一致性哈希
+type KeyFilter interface {
+	// FilterKey 按请求key选择过滤器
+	FilterKey(name, key string, srvs []*service.Service) []*service.Service
+}
+
+// FilterWithKey 选择器实现了KeyFilter时按key过滤，否则使用Filter
+func FilterWithKey(sel Selector, name, key string, srvs []*service.Service) []*service.Service {
+	if kf, ok := sel.(KeyFilter); ok {
+		return kf.FilterKey(name, key, srvs)
+	}
+	return sel.Filter(name, srvs)
+}
+
+// Report 将调用结果上报给实现了Feedback的选择器
+func Report(selectors []Selector, name string, srv *service.Service, err error, latency time.Duration) {
+	for _, one := range selectors {
+		if fb, ok := one.(Feedback); ok {
+			fb.Feedback(name, srv, err, latency)
+		}
+	}
+}
+
+// Available 过滤状态不是UP的实例，所有实例都可用时返回原列表
+func Available(srvs []*service.Service) []*service.Service {
+	for i, one := range srvs {
+		if one.IsUp() {
+			continue
+		}
+
+		list := append([]*service.Service{}, srvs[:i]...)
+		for _, one := range srvs[i+1:] {
+			if one.IsUp() {
+				list = append(list, one)
+			}
+		}
+		return list
+	}
+	return srvs
+}
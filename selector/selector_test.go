@@ -0,0 +1,74 @@
+package selector
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+type feedback struct {
+	Round
+	errs []error
+}
+
+func (c *feedback) Feedback(name string, srv *service.Service, err error, latency time.Duration) {
+	c.errs = append(c.errs, err)
+}
+
+func TestReport(t *testing.T) {
+	fb := &feedback{}
+	srv := service.NewService()
+	Report([]Selector{NewRandom(), fb}, "zacyuan.com", srv, nil, time.Millisecond)
+	Report([]Selector{NewRandom(), fb}, "zacyuan.com", srv, errors.New("failed"), time.Millisecond)
+	assert.Equal(t, 2, len(fb.errs))
+	assert.Nil(t, fb.errs[0])
+	assert.NotNil(t, fb.errs[1])
+}
+
+func TestAvailable(t *testing.T) {
+	var srvs []*service.Service
+	for i := 0; i < 4; i++ {
+		srvs = append(srvs, service.NewService())
+	}
+	assert.Equal(t, srvs, Available(srvs))
+
+	srvs[1].Status = service.StatusDraining
+	srvs[3].Status = service.StatusDown
+	assert.Equal(t, []*service.Service{srvs[0], srvs[2]}, Available(srvs))
+	assert.Equal(t, 4, len(srvs))
+
+	srvs[0].Status = service.StatusDown
+	srvs[2].Status = service.StatusDown
+	assert.Equal(t, 0, len(Available(srvs)))
+	assert.Nil(t, NewRound().Filter("zacyuan.com", srvs))
+	assert.Nil(t, NewRandom().Filter("zacyuan.com", srvs))
+
+	// 只选择状态为UP的实例
+	srvs[2].Status = ""
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, srvs[2], NewRandom().Filter("zacyuan.com", srvs)[0])
+	}
+	sel := NewRound()
+	for i := 0; i < 4; i++ {
+		assert.Equal(t, srvs[2], sel.Filter("zacyuan.com", srvs)[0])
+	}
+}
+
+func TestHandle(t *testing.T) {
+	sel := NewLeastRequest()
+	fb := &feedback{}
+	srv := service.NewService()
+
+	// 创建时通知Tracker请求开始，Done只上报一次
+	h := NewHandle([]Selector{sel, fb}, "zacyuan.com", srv)
+	assert.Equal(t, srv, h.Service)
+	assert.Equal(t, 1, sel.active["zacyuan.com"][srv.ID].active)
+	h.Done(errors.New("failed"), 0)
+	h.Done(nil, time.Millisecond)
+	assert.Equal(t, 0, sel.active["zacyuan.com"][srv.ID].active)
+	assert.Equal(t, 1, len(fb.errs))
+	assert.NotNil(t, fb.errs[0])
+}
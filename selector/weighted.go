@@ -0,0 +1,92 @@
+package selector
+
+import (
+	"sync"
+	"time"
+
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+// WeightedRound 平滑加权轮询选择器，与nginx的smooth weighted round-robin算法一致，
+// 按服务名保存每个实例的当前权重，实例上下线或权重变化时自动调整
+type WeightedRound struct {
+	m       sync.Mutex
+	ttl     time.Duration
+	pruned  time.Time
+	current map[string]map[string]*weightedStat
+}
+
+// weightedStat 实例的当前权重
+type weightedStat struct {
+	current int       // 当前权重
+	seen    time.Time // 上次使用时间
+}
+
+// NewWeightedRound 创建平滑加权轮询选择器
+func NewWeightedRound() *WeightedRound {
+	return &WeightedRound{
+		ttl:     stateTTL,
+		current: make(map[string]map[string]*weightedStat),
+	}
+}
+
+// Filter 平滑加权轮询过滤器，跳过状态不是UP的实例
+func (c *WeightedRound) Filter(name string, srvs []*service.Service) []*service.Service {
+	srvs = Available(srvs)
+	if len(srvs) == 0 {
+		return nil
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	current, ok := c.current[name]
+	if !ok {
+		current = make(map[string]*weightedStat)
+		c.current[name] = current
+	}
+
+	// 每个实例的当前权重加上自身权重，选择当前权重最大的实例，并将其当前权重减去总权重
+	now := time.Now()
+	total := 0
+	var best *service.Service
+	var bs *weightedStat
+	for _, one := range srvs {
+		st, ok := current[one.ID]
+		if !ok {
+			st = &weightedStat{}
+			current[one.ID] = st
+		}
+		st.seen = now
+
+		weight := one.GetWeight()
+		total += weight
+		st.current += weight
+		if best == nil || st.current > bs.current {
+			best, bs = one, st
+		}
+	}
+	bs.current -= total
+
+	c.prune(now)
+	return []*service.Service{best}
+}
+
+// prune 删除超过ttl未使用的实例状态，每个ttl最多执行一次，需持有c.m
+func (c *WeightedRound) prune(now time.Time) {
+	if now.Sub(c.pruned) < c.ttl {
+		return
+	}
+	c.pruned = now
+
+	for name, current := range c.current {
+		for id, st := range current {
+			if now.Sub(st.seen) >= c.ttl {
+				delete(current, id)
+			}
+		}
+		if len(current) == 0 {
+			delete(c.current, name)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package selector
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+func newWeighted(id string, weight int) *service.Service {
+	srv := service.NewService()
+	srv.ID = id
+	srv.Weight = weight
+	return srv
+}
+
+func pick(sel Selector, name string, srvs []*service.Service, n int) string {
+	var ids []string
+	for i := 0; i < n; i++ {
+		ids = append(ids, sel.Filter(name, srvs)[0].ID)
+	}
+	return strings.Join(ids, "")
+}
+
+func TestNewWeightedRound(t *testing.T) {
+	sel := NewWeightedRound()
+	assert.NotNil(t, sel)
+	assert.NotNil(t, sel.current)
+}
+
+func TestWeightedRoundFilter(t *testing.T) {
+	sel := NewWeightedRound()
+	srvs := []*service.Service{newWeighted("a", 5), newWeighted("b", 1), newWeighted("c", 1)}
+
+	// 与nginx平滑加权轮询的顺序一致
+	assert.Equal(t, "aabacaa", pick(sel, "zacyuan.com", srvs, 7))
+	assert.Equal(t, "aabacaa", pick(sel, "zacyuan.com", srvs, 7))
+
+	// 不同服务的状态相互独立
+	other := []*service.Service{newWeighted("x", 1), newWeighted("y", 0)}
+	assert.Equal(t, "xyxy", pick(sel, "other.com", other, 4))
+
+	// 不可用的实例不参与选择
+	srvs[0].Status = service.StatusDraining
+	assert.Equal(t, "bcbc", pick(sel, "zacyuan.com", srvs, 4))
+	srvs[1].Status = service.StatusDown
+	srvs[2].Status = service.StatusDown
+	assert.Nil(t, sel.Filter("zacyuan.com", srvs))
+}
+
+func TestWeightedRoundChange(t *testing.T) {
+	sel := NewWeightedRound()
+	srvs := []*service.Service{newWeighted("a", 2), newWeighted("b", 1)}
+	assert.Equal(t, "aba", pick(sel, "zacyuan.com", srvs, 3))
+
+	// 实例上线后按新的权重分配
+	srvs = append(srvs, newWeighted("c", 3))
+	counts := make(map[string]int)
+	for _, id := range pick(sel, "zacyuan.com", srvs, 60) {
+		counts[string(id)]++
+	}
+	assert.Equal(t, map[string]int{"a": 20, "b": 10, "c": 30}, counts)
+
+	// 实例下线后按剩余实例的权重分配，其状态超过ttl未使用后删除
+	sel.ttl = 50 * time.Millisecond
+	srvs = srvs[1:]
+	pick(sel, "zacyuan.com", srvs, 1)
+	assert.Equal(t, 3, len(sel.current["zacyuan.com"]))
+	time.Sleep(60 * time.Millisecond)
+	pick(sel, "zacyuan.com", srvs, 1)
+	assert.Equal(t, 2, len(sel.current["zacyuan.com"]))
+	counts = make(map[string]int)
+	for _, id := range pick(sel, "zacyuan.com", srvs, 40) {
+		counts[string(id)]++
+	}
+	assert.Equal(t, map[string]int{"b": 10, "c": 30}, counts)
+}
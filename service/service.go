@@ -5,6 +5,13 @@ import (
 	"github.com/yuanzhangcai/srsd/utils"
 )
 
+// 服务实例状态
+const (
+	StatusUp       = "UP"       // 正常提供服务
+	StatusDraining = "DRAINING" // 即将下线，不再接收新请求，处理中的请求继续完成
+	StatusDown     = "DOWN"     // 不可用
+)
+
 // Service 服务注册信息
 type Service struct {
 	ID         string            `json:"id"`          // 服务唯一ID
@@ -13,6 +20,8 @@ type Service struct {
 	Host       string            `json:"host"`        // 服务地址
 	PProf      string            `json:"pprof"`       // pprof地址
 	Metrics    string            `json:"metrics"`     // prometheus指标曝露地址
+	Status     string            `json:"status"`      // 实例状态，为空时视为UP
+	Weight     int               `json:"weight"`      // 权重，小于等于0时视为1
 	Metadata   map[string]string `json:"metadata"`    // 扩展信息
 	CreateTime string            `json:"create_time"` // 服务注册时间
 }
@@ -22,10 +31,37 @@ func NewService() *Service {
 	return &Service{
 		ID:       uuid.New().String(),
 		Version:  "latest",
+		Status:   StatusUp,
+		Weight:   1,
 		Metadata: make(map[string]string),
 	}
 }
 
+// IsUp 实例是否可以接收新请求，兼容没有状态字段的旧版本注册信息
+func (c *Service) IsUp() bool {
+	return c.Status == "" || c.Status == StatusUp
+}
+
+// GetWeight 获取权重，兼容没有权重字段的旧版本注册信息
+func (c *Service) GetWeight() int {
+	if c.Weight <= 0 {
+		return 1
+	}
+	return c.Weight
+}
+
+// Clone 复制服务信息，Metadata同样复制
+func (c *Service) Clone() *Service {
+	srv := *c
+	if c.Metadata != nil {
+		srv.Metadata = make(map[string]string, len(c.Metadata))
+		for k, v := range c.Metadata {
+			srv.Metadata[k] = v
+		}
+	}
+	return &srv
+}
+
 // GetRealIP 获取Host、Metrics、PProf的真实IP
 func (c *Service) GetRealIP() error {
 	var err error
@@ -11,6 +11,30 @@ func TestNewService(t *testing.T) {
 	assert.NotNil(t, srv)
 	assert.NotNil(t, srv.Metadata)
 	assert.NotEmpty(t, srv.ID)
+	assert.Equal(t, StatusUp, srv.Status)
+	assert.Equal(t, 1, srv.Weight)
+}
+
+func TestGetWeight(t *testing.T) {
+	srv := NewService()
+	assert.Equal(t, 1, srv.GetWeight())
+	srv.Weight = 0
+	assert.Equal(t, 1, srv.GetWeight())
+	srv.Weight = -1
+	assert.Equal(t, 1, srv.GetWeight())
+	srv.Weight = 8
+	assert.Equal(t, 8, srv.GetWeight())
+}
+
+func TestIsUp(t *testing.T) {
+	srv := NewService()
+	assert.True(t, srv.IsUp())
+	srv.Status = ""
+	assert.True(t, srv.IsUp())
+	srv.Status = StatusDraining
+	assert.False(t, srv.IsUp())
+	srv.Status = StatusDown
+	assert.False(t, srv.IsUp())
 }
 
 func TestGetRealIP(t *testing.T) {
@@ -24,3 +48,18 @@ func TestGetRealIP(t *testing.T) {
 	assert.Equal(t, "10.10.8.59:4001", srv.PProf)
 	assert.Equal(t, "10.10.8.159:4002", srv.Metrics)
 }
+
+func TestClone(t *testing.T) {
+	srv := NewService()
+	srv.Metadata["env"] = "prod"
+	one := srv.Clone()
+	assert.Equal(t, srv, one)
+
+	one.Metadata["env"] = "test"
+	one.Version = "v2"
+	assert.Equal(t, "prod", srv.Metadata["env"])
+	assert.Equal(t, "latest", srv.Version)
+
+	srv.Metadata = nil
+	assert.Nil(t, srv.Clone().Metadata)
+}
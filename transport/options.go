@@ -0,0 +1,69 @@
+package transport
+
+import (
+	"net/http"
+
+	"github.com/yuanzhangcai/srsd/selector"
+)
+
+var (
+	defaultPrefix  = "srsd."
+	defaultRetries = 2
+)
+
+// Option 设置Transport参数
+type Option func(*Options)
+
+// Options Transport参数
+type Options struct {
+	Base      http.RoundTripper   // 实际发送请求的Transport，默认为http.DefaultTransport
+	Prefix    string              // 服务域名前缀，http://srsd.服务名/path 按服务名解析
+	Retries   int                 // 请求失败后更换实例重试的次数
+	Selectors []selector.Selector // 服务选择器，为空时使用discovery配置的选择器
+}
+
+// newOptions 创建Transport参数对象
+func newOptions(opts ...Option) *Options {
+	opt := &Options{
+		Base:    http.DefaultTransport,
+		Prefix:  defaultPrefix,
+		Retries: defaultRetries,
+	}
+
+	for _, one := range opts {
+		one(opt)
+	}
+	return opt
+}
+
+// Base 设置实际发送请求的Transport
+func Base(base http.RoundTripper) Option {
+	return func(opt *Options) {
+		opt.Base = base
+	}
+}
+
+// Prefix 设置服务域名前缀
+func Prefix(prefix string) Option {
+	if prefix != "" && prefix[len(prefix)-1] != '.' {
+		prefix += "."
+	}
+
+	return func(opt *Options) {
+		opt.Prefix = prefix
+	}
+}
+
+// Retries 设置重试次数
+func Retries(retries int) Option {
+	return func(opt *Options) {
+		opt.Retries = retries
+	}
+}
+
+// Selectors 设置服务选择器
+func Selectors(selectors ...selector.Selector) Option {
+	return func(opt *Options) {
+		opt.Selectors = selectors
+	}
+}
@@ -0,0 +1,182 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/yuanzhangcai/srsd/discovery"
+	"github.com/yuanzhangcai/srsd/selector"
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+// ErrNoInstance 服务没有可用实例
+var ErrNoInstance = errors.New("transport: no available instance")
+
+// Transport 通过服务发现解析请求地址的http.RoundTripper，
+// 将 http://srsd.服务名/path 改写为选择器选出的实例地址，其他请求直接交给Base处理
+type Transport struct {
+	opts *Options
+	dis  *discovery.Discovery
+}
+
+// NewTransport 创建Transport，dis需由调用方启动
+func NewTransport(dis *discovery.Discovery, opts ...Option) *Transport {
+	return &Transport{
+		opts: newOptions(opts...),
+		dis:  dis,
+	}
+}
+
+// RoundTrip 发送请求，连接失败或幂等请求失败时更换实例重试，并将每个实例的调用结果上报给选择器
+func (c *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	name, ok := c.serviceName(req.URL.Hostname())
+	if !ok {
+		return c.opts.Base.RoundTrip(req)
+	}
+
+	selectors := c.opts.Selectors
+	if len(selectors) == 0 {
+		selectors = c.dis.Selectors()
+	}
+
+	// 每次尝试都通过GetBody获取新的请求体，原请求体不会交给Base，需在这里关闭；
+	// 没有GetBody时原请求体由Base关闭，没有发送请求时在返回前关闭
+	sent := false
+	if req.Body != nil {
+		if req.GetBody != nil {
+			_ = req.Body.Close()
+		} else {
+			defer func() {
+				if !sent {
+					_ = req.Body.Close()
+				}
+			}()
+		}
+	}
+
+	tried := make(map[string]bool)
+	var lastErr error
+	for i := 0; i <= c.opts.Retries; i++ {
+		srv := c.pick(name, selectors, tried)
+		if srv == nil {
+			break
+		}
+		tried[srv.ID] = true
+
+		out, err := c.rewrite(req, srv)
+		if err != nil {
+			return nil, err
+		}
+
+		h := c.dis.NewHandle(name, srv, selectors...)
+		sent = true
+		resp, err := c.opts.Base.RoundTrip(out)
+		if err == nil {
+			var reportErr error
+			if resp.StatusCode >= http.StatusInternalServerError {
+				reportErr = errors.New(resp.Status)
+			}
+			h.Done(reportErr, 0)
+			return resp, nil
+		}
+
+		h.Done(err, 0)
+		lastErr = err
+		if !c.retryable(req, err) {
+			break
+		}
+	}
+
+	if lastErr == nil {
+		lastErr = ErrNoInstance
+	}
+	return nil, lastErr
+}
+
+// serviceName 从请求域名中解析服务名
+func (c *Transport) serviceName(host string) (string, bool) {
+	if len(host) <= len(c.opts.Prefix) || !strings.EqualFold(host[:len(c.opts.Prefix)], c.opts.Prefix) {
+		return "", false
+	}
+	return host[len(c.opts.Prefix):], true
+}
+
+// pick 选择一个未尝试过的实例
+func (c *Transport) pick(name string, selectors []selector.Selector, tried map[string]bool) *service.Service {
+	exclude := &excludeSelector{tried: tried}
+	list := c.dis.Filter(name, append([]selector.Selector{exclude}, selectors...)...)
+	if len(list) == 0 {
+		return nil
+	}
+	return list[0]
+}
+
+// rewrite 复制请求并将地址改为实例地址
+func (c *Transport) rewrite(req *http.Request, srv *service.Service) (*http.Request, error) {
+	out := req.Clone(req.Context())
+	out.URL.Host = srv.Host
+	if req.Host == "" || req.Host == req.URL.Host {
+		out.Host = ""
+	}
+
+	// 重试时需要重新获取请求体
+	if req.Body != nil && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		out.Body = body
+	}
+	return out, nil
+}
+
+// retryable 判断失败的请求能否更换实例重试，连接未建立时总是可以重试，其他错误只重试幂等请求
+func (c *Transport) retryable(req *http.Request, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+
+	// 请求体无法重新获取时不能重试
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+
+	if isDialError(err) {
+		return true
+	}
+
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != ""
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return opErr.Op == "dial"
+	}
+	return false
+}
+
+// excludeSelector 过滤已经尝试过的实例
+type excludeSelector struct {
+	tried map[string]bool
+}
+
+func (c *excludeSelector) Filter(name string, srvs []*service.Service) []*service.Service {
+	if len(c.tried) == 0 {
+		return srvs
+	}
+
+	list := make([]*service.Service, 0, len(srvs))
+	for _, one := range srvs {
+		if !c.tried[one.ID] {
+			list = append(list, one)
+		}
+	}
+	return list
+}
@@ -0,0 +1,239 @@
+package transport
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuanzhangcai/srsd/backend/memory"
+	"github.com/yuanzhangcai/srsd/discovery"
+	"github.com/yuanzhangcai/srsd/registry"
+	"github.com/yuanzhangcai/srsd/selector"
+	"github.com/yuanzhangcai/srsd/service"
+)
+
+// recorder 记录上报结果的选择器，按实例顺序选择
+type recorder struct {
+	m       sync.Mutex
+	begin   map[string]int
+	success map[string]int
+	failure map[string]int
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		begin:   make(map[string]int),
+		success: make(map[string]int),
+		failure: make(map[string]int),
+	}
+}
+
+func (c *recorder) Filter(name string, srvs []*service.Service) []*service.Service {
+	return srvs
+}
+
+func (c *recorder) Begin(name string, srv *service.Service) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.begin[srv.Host]++
+}
+
+func (c *recorder) Feedback(name string, srv *service.Service, err error, latency time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if err == nil {
+		c.success[srv.Host]++
+	} else {
+		c.failure[srv.Host]++
+	}
+}
+
+func register(t *testing.T, b *memory.Backend, host string) *registry.Registry {
+	info := service.NewService()
+	info.Name = "zacyuan.com"
+	info.Host = host
+	reg := registry.NewRegistry(info, registry.Backend(b), registry.TTL(10*time.Second))
+	assert.Nil(t, reg.Start())
+	return reg
+}
+
+// deadAddr 返回一个没有监听的地址
+func deadAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	return addr
+}
+
+func TestNewTransport(t *testing.T) {
+	tr := NewTransport(nil, Base(http.DefaultTransport), Prefix("zacyuan"), Retries(3), Selectors(selector.NewRandom()))
+	assert.Equal(t, "zacyuan.", tr.opts.Prefix)
+	assert.Equal(t, 3, tr.opts.Retries)
+	assert.Equal(t, 1, len(tr.opts.Selectors))
+
+	name, ok := tr.serviceName("ZACYUAN.www.zacyuan.com")
+	assert.True(t, ok)
+	assert.Equal(t, "www.zacyuan.com", name)
+	_, ok = tr.serviceName("www.zacyuan.com")
+	assert.False(t, ok)
+	_, ok = tr.serviceName("zacyuan.")
+	assert.False(t, ok)
+}
+
+func TestRoundTrip(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		_, _ = w.Write([]byte(r.Method + " " + r.URL.Path + " " + string(body)))
+	}))
+	defer srv.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	dead := deadAddr(t)
+
+	b := memory.NewBackend()
+	defer b.Close()
+	reg1 := register(t, b, dead)
+	defer reg1.Stop()
+	reg2 := register(t, b, host)
+	defer reg2.Stop()
+
+	dis := discovery.NewDiscovery(discovery.Backend(b))
+	assert.Nil(t, dis.Start(""))
+	defer dis.Stop()
+
+	rec := newRecorder()
+	client := &http.Client{Transport: NewTransport(dis, Selectors(rec))}
+
+	t.Run("retry on dial error", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			resp, err := client.Post("http://srsd.zacyuan.com/path", "text/plain", strings.NewReader("data"))
+			assert.Nil(t, err)
+			body, _ := ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			assert.Equal(t, "POST /path data", string(body))
+		}
+
+		rec.m.Lock()
+		defer rec.m.Unlock()
+		assert.Equal(t, 2, rec.begin[host])
+		assert.Equal(t, 2, rec.success[host])
+		assert.Equal(t, 0, rec.failure[host])
+	})
+
+	t.Run("no instance", func(t *testing.T) {
+		_, err := client.Get("http://srsd.other.com/path")
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), ErrNoInstance.Error())
+	})
+
+	t.Run("close body", func(t *testing.T) {
+		tr := NewTransport(dis, Selectors(rec))
+
+		// 使用GetBody时原请求体在RoundTrip中关闭
+		body := &closeBody{Reader: strings.NewReader("data")}
+		req, err := http.NewRequest(http.MethodPost, "http://srsd.zacyuan.com/path", strings.NewReader("data"))
+		assert.Nil(t, err)
+		req.Body = body
+		resp, err := tr.RoundTrip(req)
+		assert.Nil(t, err)
+		_ = resp.Body.Close()
+		assert.True(t, body.isClosed())
+
+		// 没有发送请求时关闭请求体
+		body = &closeBody{Reader: strings.NewReader("data")}
+		req, err = http.NewRequest(http.MethodPost, "http://srsd.other.com/path", body)
+		assert.Nil(t, err)
+		_, err = tr.RoundTrip(req)
+		assert.Equal(t, ErrNoInstance, err)
+		assert.True(t, body.isClosed())
+	})
+
+	t.Run("pass through", func(t *testing.T) {
+		resp, err := client.Get(srv.URL + "/direct")
+		assert.Nil(t, err)
+		body, _ := ioutil.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		assert.Equal(t, "GET /direct ", string(body))
+	})
+}
+
+// closeBody 记录是否被关闭的请求体
+type closeBody struct {
+	*strings.Reader
+	m      sync.Mutex
+	closed bool
+}
+
+func (c *closeBody) Close() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *closeBody) isClosed() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.closed
+}
+
+func TestRetryLimit(t *testing.T) {
+	b := memory.NewBackend()
+	defer b.Close()
+
+	var regs []*registry.Registry
+	for i := 0; i < 3; i++ {
+		regs = append(regs, register(t, b, deadAddr(t)))
+	}
+	defer func() {
+		for _, one := range regs {
+			_ = one.Stop()
+		}
+	}()
+
+	dis := discovery.NewDiscovery(discovery.Backend(b))
+	assert.Nil(t, dis.Start(""))
+	defer dis.Stop()
+
+	rec := newRecorder()
+	client := &http.Client{Transport: NewTransport(dis, Retries(1), Selectors(rec))}
+	_, err := client.Get("http://srsd.zacyuan.com/path")
+	assert.NotNil(t, err)
+
+	// 重试1次，共尝试2个实例
+	rec.m.Lock()
+	defer rec.m.Unlock()
+	failure := 0
+	for host, n := range rec.failure {
+		assert.Equal(t, 1, n)
+		assert.Equal(t, 1, rec.begin[host])
+		failure += n
+	}
+	assert.Equal(t, 2, failure)
+}
+
+func TestRetryable(t *testing.T) {
+	tr := NewTransport(nil)
+	dialErr := &net.OpError{Op: "dial", Err: assert.AnError}
+	readErr := &net.OpError{Op: "read", Err: assert.AnError}
+
+	req, _ := http.NewRequest(http.MethodPost, "http://srsd.zacyuan.com", strings.NewReader("data"))
+	assert.True(t, tr.retryable(req, dialErr))
+	assert.False(t, tr.retryable(req, readErr))
+
+	req.Header.Set("Idempotency-Key", "1")
+	assert.True(t, tr.retryable(req, readErr))
+
+	req, _ = http.NewRequest(http.MethodGet, "http://srsd.zacyuan.com", nil)
+	assert.True(t, tr.retryable(req, readErr))
+
+	// 请求体无法重新获取时不重试
+	req, _ = http.NewRequest(http.MethodPut, "http://srsd.zacyuan.com", ioutil.NopCloser(strings.NewReader("data")))
+	assert.False(t, tr.retryable(req, dialErr))
+}